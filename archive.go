@@ -0,0 +1,116 @@
+/*
+bsearch archive functions, for distributing a dataset and its index as a
+single file
+*/
+
+package bsearch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	archiveMagic      = "BSXARCH1"
+	archiveFooterSize = len(archiveMagic) + 16
+)
+
+var (
+	ErrArchiveInvalid = errors.New("invalid archive")
+)
+
+// WriteArchive writes a combined archive of the dataset at dataPath and
+// its index to w. The archive consists of the dataset, followed by the
+// (zstd-compressed) index, followed by a footer giving the index offset
+// and length. An existing index is used if valid, otherwise a new one is
+// generated (but not written). Compressed datasets are not supported.
+func WriteArchive(dataPath string, w io.Writer) error {
+	if reCompressedUnsupported.MatchString(dataPath) {
+		return ErrFileCompressed
+	}
+	index, err := LoadIndex(dataPath)
+	if err != nil {
+		index, err = NewIndex(dataPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	fh, err := os.Open(dataPath)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	dataLength, err := io.Copy(w, fh)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	err = index.encode(&buf)
+	if err != nil {
+		return err
+	}
+	indexLength := int64(buf.Len())
+
+	footer := make([]byte, archiveFooterSize)
+	copy(footer, archiveMagic)
+	binary.LittleEndian.PutUint64(footer[len(archiveMagic):], uint64(dataLength))
+	binary.LittleEndian.PutUint64(footer[len(archiveMagic)+8:], uint64(indexLength))
+	buf.Write(footer)
+
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// OpenArchive returns a new Searcher for the archive of length bytes in r
+// (as written by WriteArchive). The dataset region of the archive is read
+// into memory. The caller remains responsible for closing r (if required)
+// when finished.
+func OpenArchive(r io.ReaderAt, length int64) (*Searcher, error) {
+	if length < int64(archiveFooterSize) {
+		return nil, fmt.Errorf("%w: length %d shorter than footer", ErrArchiveInvalid, length)
+	}
+	footer := make([]byte, archiveFooterSize)
+	_, err := r.ReadAt(footer, length-int64(archiveFooterSize))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(footer[:len(archiveMagic)]) != archiveMagic {
+		return nil, fmt.Errorf("%w: bad magic %q", ErrArchiveInvalid, footer[:len(archiveMagic)])
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(footer[len(archiveMagic):]))
+	indexLength := int64(binary.LittleEndian.Uint64(footer[len(archiveMagic)+8:]))
+	if indexOffset < 0 || indexLength <= 0 ||
+		indexOffset+indexLength != length-int64(archiveFooterSize) {
+		return nil, fmt.Errorf("%w: index offset %d, length %d inconsistent with archive length %d",
+			ErrArchiveInvalid, indexOffset, indexLength, length)
+	}
+
+	index, err := decodeIndex(io.NewSectionReader(r, indexOffset, indexLength))
+	if err != nil {
+		return nil, err
+	}
+	if len(index.List) == 0 {
+		return nil, ErrIndexEmpty
+	}
+
+	// The dataset region runs from the start of the archive to the index
+	data := make([]byte, indexOffset)
+	n, err := r.ReadAt(data, 0)
+	if err != nil && !(err == io.EOF && int64(n) == indexOffset) {
+		return nil, err
+	}
+
+	s := Searcher{
+		r:     io.NewSectionReader(r, 0, indexOffset),
+		l:     indexOffset,
+		mmap:  data,
+		Index: index,
+	}
+	return &s, nil
+}
@@ -0,0 +1,73 @@
+package bsearch
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test WriteArchive() and OpenArchive() round trips
+func TestArchiveRoundTrip(t *testing.T) {
+	var tests = []struct {
+		dataset string
+		keys    []string
+	}{
+		{"rdns1.csv", []string{"001.000.128.000", "202.047.145.000", "000.000.000.000"}},
+		{"domains2.csv", []string{"accuweather.com", "adyen.com", "zzz.com"}},
+		{"foo.csv", []string{"bar", "foo", "baz"}},
+	}
+
+	for _, tc := range tests {
+		path := "testdata/" + tc.dataset
+		var buf bytes.Buffer
+		err := WriteArchive(path, &buf)
+		if err != nil {
+			t.Fatalf("%s: %s\n", tc.dataset, err.Error())
+		}
+
+		as, err := OpenArchive(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatalf("%s: %s\n", tc.dataset, err.Error())
+		}
+		defer as.Close()
+		s, err := NewSearcher(path)
+		if err != nil {
+			t.Fatalf("%s: %s\n", tc.dataset, err.Error())
+		}
+		defer s.Close()
+
+		assert.Equal(t, s.l, as.l, tc.dataset+" data length")
+		for _, key := range tc.keys {
+			expect, experr := s.Lines([]byte(key))
+			got, err := as.Lines([]byte(key))
+			assert.Equal(t, experr, err, tc.dataset+" "+key)
+			assert.Equal(t, expect, got, tc.dataset+" "+key)
+		}
+	}
+}
+
+// Test OpenArchive() with invalid archives
+func TestArchiveInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteArchive("testdata/rdns1.csv", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.Bytes()
+
+	// Truncated
+	_, err = OpenArchive(bytes.NewReader(archive), int64(len(archive)-1))
+	assert.True(t, errors.Is(err, ErrArchiveInvalid), "truncated archive")
+	_, err = OpenArchive(bytes.NewReader(archive[:10]), 10)
+	assert.True(t, errors.Is(err, ErrArchiveInvalid), "short archive")
+
+	// Plain dataset (no footer)
+	_, err = OpenArchive(bytes.NewReader(archive[:1024]), 1024)
+	assert.True(t, errors.Is(err, ErrArchiveInvalid), "plain dataset")
+
+	// Compressed datasets are not supported
+	err = WriteArchive("testdata/rdns1.csv.zst", &buf)
+	assert.Equal(t, ErrFileCompressed, err)
+}
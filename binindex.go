@@ -0,0 +1,303 @@
+/*
+bsearch binary index encoding, a compact index file format that is fast
+to load (see IndexOptions.Format)
+
+The binary format (before any zstd compression) is laid out as follows,
+where uvarint and varint are encoding/binary variable-length integers,
+and bytes are a uvarint length followed by that many bytes:
+
+	magic          "BSXB"
+	version        uvarint  index Version
+	blocksize      uvarint
+	delimiter      bytes
+	epoch          varint
+	filepath       bytes
+	flags          uvarint  bitmask of the binaryFlag* flags
+	header text    bytes
+	sort column    uvarint  SortKeyColumn
+	checksum       uint64   Checksum (little-endian)
+	entry count    uvarint
+	entries        (entry count times)
+	  prefix       uvarint  length of the prefix shared with the previous key
+	  suffix       bytes    remainder of the key
+	  offset       varint   offset delta from the previous entry offset
+	  line count   uvarint  LineCount (only if binaryFlagLineCounts is set)
+	crc            uint32   CRC-32 (IEEE) of all preceding bytes (little-endian)
+*/
+
+package bsearch
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// binaryIndexMagic begins binary index files
+var binaryIndexMagic = []byte("BSXB")
+
+// binaryIndexMaxLen is the maximum length of a byte string in a binary
+// index, to reject corrupt lengths before allocating
+const binaryIndexMaxLen = 1 << 24
+
+// Binary index flags, recording the Index boolean fields
+const (
+	binaryFlagHeader = 1 << iota
+	binaryFlagKeysIndexFirst
+	binaryFlagKeysUnique
+	binaryFlagTrimKeySpace
+	binaryFlagLineCounts
+	binaryFlagDescending
+	binaryFlagCSVQuoting
+)
+
+// marshalBinary returns the binary encoding of the index
+func (i *Index) marshalBinary() []byte {
+	var flags uint64
+	for _, f := range []struct {
+		set  bool
+		flag uint64
+	}{
+		{i.Header, binaryFlagHeader},
+		{i.KeysIndexFirst, binaryFlagKeysIndexFirst},
+		{i.KeysUnique, binaryFlagKeysUnique},
+		{i.TrimKeySpace, binaryFlagTrimKeySpace},
+		{i.LineCounts, binaryFlagLineCounts},
+		{i.Descending, binaryFlagDescending},
+		{i.CSVQuoting, binaryFlagCSVQuoting},
+	} {
+		if f.set {
+			flags |= f.flag
+		}
+	}
+
+	var tmp [binary.MaxVarintLen64]byte
+	appendUvarint := func(buf []byte, v uint64) []byte {
+		return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+	}
+	appendVarint := func(buf []byte, v int64) []byte {
+		return append(buf, tmp[:binary.PutVarint(tmp[:], v)]...)
+	}
+	appendBytes := func(buf, b []byte) []byte {
+		return append(appendUvarint(buf, uint64(len(b))), b...)
+	}
+
+	buf := append([]byte{}, binaryIndexMagic...)
+	buf = appendUvarint(buf, uint64(i.Version))
+	buf = appendUvarint(buf, uint64(i.Blocksize))
+	buf = appendBytes(buf, i.Delimiter)
+	buf = appendVarint(buf, i.Epoch)
+	buf = appendBytes(buf, []byte(i.Filepath))
+	buf = appendUvarint(buf, flags)
+	buf = appendBytes(buf, []byte(i.HeaderText))
+	buf = appendUvarint(buf, uint64(i.SortKeyColumn))
+	binary.LittleEndian.PutUint64(tmp[:8], i.Checksum)
+	buf = append(buf, tmp[:8]...)
+	buf = appendUvarint(buf, uint64(len(i.List)))
+
+	var prevKey string
+	var prevOffset int64
+	for _, entry := range i.List {
+		prefix := 0
+		for prefix < len(prevKey) && prefix < len(entry.Key) &&
+			prevKey[prefix] == entry.Key[prefix] {
+			prefix++
+		}
+		buf = appendUvarint(buf, uint64(prefix))
+		buf = appendBytes(buf, []byte(entry.Key[prefix:]))
+		buf = appendVarint(buf, entry.Offset-prevOffset)
+		if i.LineCounts {
+			buf = appendUvarint(buf, uint64(entry.LineCount))
+		}
+		prevKey, prevOffset = entry.Key, entry.Offset
+	}
+
+	binary.LittleEndian.PutUint32(tmp[:4], crc32.ChecksumIEEE(buf))
+	return append(buf, tmp[:4]...)
+}
+
+// binaryIndexReader reads binary index fields from r, hashing the bytes
+// read for the trailing crc
+type binaryIndexReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+	buf []byte
+	one [1]byte
+}
+
+func (br *binaryIndexReader) ReadByte() (byte, error) {
+	b, err := br.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	br.one[0] = b
+	br.crc.Write(br.one[:])
+	return b, nil
+}
+
+// read returns the next n bytes, which are only valid until the next call
+func (br *binaryIndexReader) read(n int) ([]byte, error) {
+	if cap(br.buf) < n {
+		br.buf = make([]byte, n)
+	}
+	buf := br.buf[:n]
+	_, err := io.ReadFull(br.r, buf)
+	if err != nil {
+		return nil, err
+	}
+	br.crc.Write(buf)
+	return buf, nil
+}
+
+func (br *binaryIndexReader) uvarint() (uint64, error) {
+	return binary.ReadUvarint(br)
+}
+
+func (br *binaryIndexReader) varint() (int64, error) {
+	return binary.ReadVarint(br)
+}
+
+// int returns a uvarint that must fit in an int no larger than max
+func (br *binaryIndexReader) int(max int) (int, error) {
+	v, err := br.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if v > uint64(max) {
+		return 0, fmt.Errorf("value %d exceeds maximum %d", v, max)
+	}
+	return int(v), nil
+}
+
+func (br *binaryIndexReader) bytes() ([]byte, error) {
+	n, err := br.int(binaryIndexMaxLen)
+	if err != nil {
+		return nil, err
+	}
+	return br.read(n)
+}
+
+// decodeBinaryIndex decodes a binary index from r into index, streaming
+// the entries. Returns an ErrIndexCorrupt error if the index is malformed
+// or fails its crc check.
+func decodeBinaryIndex(r *bufio.Reader, index *Index) error {
+	err := decodeBinaryIndexFields(r, index)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrIndexCorrupt, err)
+	}
+	return nil
+}
+
+func decodeBinaryIndexFields(r *bufio.Reader, index *Index) error {
+	br := &binaryIndexReader{r: r, crc: crc32.NewIEEE()}
+	magic, err := br.read(len(binaryIndexMagic))
+	if err != nil {
+		return err
+	}
+	if string(magic) != string(binaryIndexMagic) {
+		return fmt.Errorf("bad magic %q", magic)
+	}
+
+	if index.Version, err = br.int(binaryIndexMaxLen); err != nil {
+		return err
+	}
+	if index.Blocksize, err = br.int(binaryIndexMaxLen); err != nil {
+		return err
+	}
+	b, err := br.bytes()
+	if err != nil {
+		return err
+	}
+	index.Delimiter = clonebs(b)
+	if index.Epoch, err = br.varint(); err != nil {
+		return err
+	}
+	if b, err = br.bytes(); err != nil {
+		return err
+	}
+	index.Filepath = string(b)
+	flags, err := br.uvarint()
+	if err != nil {
+		return err
+	}
+	index.Header = flags&binaryFlagHeader != 0
+	index.KeysIndexFirst = flags&binaryFlagKeysIndexFirst != 0
+	index.KeysUnique = flags&binaryFlagKeysUnique != 0
+	index.TrimKeySpace = flags&binaryFlagTrimKeySpace != 0
+	index.LineCounts = flags&binaryFlagLineCounts != 0
+	index.Descending = flags&binaryFlagDescending != 0
+	index.CSVQuoting = flags&binaryFlagCSVQuoting != 0
+	if b, err = br.bytes(); err != nil {
+		return err
+	}
+	if len(b) > 0 {
+		index.setHeader(b)
+	}
+	if index.SortKeyColumn, err = br.int(binaryIndexMaxLen); err != nil {
+		return err
+	}
+	if b, err = br.read(8); err != nil {
+		return err
+	}
+	index.Checksum = binary.LittleEndian.Uint64(b)
+
+	count, err := br.int(binaryIndexMaxLen)
+	if err != nil {
+		return err
+	}
+	// Cap the preallocation, in case count is corrupt
+	capacity := count
+	if capacity > 1<<20 {
+		capacity = 1 << 20
+	}
+	index.List = make([]IndexEntry, 0, capacity)
+	var key []byte
+	var offset int64
+	for n := 0; n < count; n++ {
+		prefix, err := br.int(len(key))
+		if err != nil {
+			return err
+		}
+		suffix, err := br.bytes()
+		if err != nil {
+			return err
+		}
+		key = append(key[:prefix], suffix...)
+		delta, err := br.varint()
+		if err != nil {
+			return err
+		}
+		offset += delta
+		entry := IndexEntry{Key: string(key), Offset: offset}
+		if index.LineCounts {
+			lines, err := br.uvarint()
+			if err != nil {
+				return err
+			}
+			entry.LineCount = int64(lines)
+		}
+		index.List = append(index.List, entry)
+	}
+	index.Length = len(index.List)
+
+	// Check the crc (which is not itself hashed), and that it ends the index
+	sum := br.crc.Sum32()
+	crc := make([]byte, 4)
+	_, err = io.ReadFull(r, crc)
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(crc) != sum {
+		return fmt.Errorf("crc mismatch")
+	}
+	if _, err = r.ReadByte(); err != io.EOF {
+		return fmt.Errorf("trailing data after crc")
+	}
+	return nil
+}
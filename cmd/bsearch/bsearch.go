@@ -1,8 +1,11 @@
-// Binary search ordered Filename for lines beginning with SearchString
+// Binary search ordered Filename for lines beginning with each Key (read
+// from stdin, one per line, if no keys are given). Exits with status 1 if
+// no lines match (like grep), or 2 on errors.
 
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"os"
 	"regexp"
@@ -18,15 +21,20 @@ var opts struct {
 	Verbose []bool `short:"v" long:"verbose" description:"display verbose debug output"`
 	Header  bool   `short:"H" long:"hdr" description:"ignore first line (header) in Filename when doing lookups"`
 	Rev     bool   `short:"r" long:"rev" description:"reverse SearchString for search, and reverse output lines when printing"`
-	Args    struct {
-		SearchString string
-		Filename     string
-	} `positional-args:"yes" required:"yes"`
+	Compare string `long:"compare" description:"key comparison the dataset is sorted and indexed with (bytes, bytes-ci, numeric, runes)"`
+	Delim   string `short:"t" long:"delimiter" description:"delimiter separating fields in Filename (default: derived from the filename extension)"`
+	Prefix  bool   `long:"prefix" description:"print lines whose key begins with Key, rather than equals it"`
+	Exact   bool   `long:"exact" description:"compare Key with the full key field of each line (the default already requires the delimiter after Key, so matches are the same)"`
+	MaxN    int    `short:"n" long:"max" description:"print at most n lines per Key"`
 }
 
 // Disable flags.PrintErrors for more control
 var parser = flags.NewParser(&opts, flags.Default&^flags.PrintErrors)
 
+func init() {
+	parser.Usage = "[OPTIONS] [Key...] Filename"
+}
+
 func usage() {
 	parser.WriteHelp(os.Stderr)
 	os.Exit(2)
@@ -40,18 +48,28 @@ func vprintf(format string, args ...interface{}) {
 
 func die(msg string) {
 	fmt.Fprintln(os.Stderr, msg)
-	os.Exit(1)
+	os.Exit(2)
 }
 
 func main() {
 	// Parse options
-	_, err := parser.Parse()
+	args, err := parser.Parse()
 	if err != nil {
 		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type != flags.ErrHelp {
 			fmt.Fprintf(os.Stderr, "%s\n\n", err)
 		}
 		usage()
 	}
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Filename is required\n\n")
+		usage()
+	}
+	if opts.Prefix && opts.Exact {
+		fmt.Fprintf(os.Stderr, "--prefix and --exact are mutually exclusive\n\n")
+		usage()
+	}
+	filename := args[len(args)-1]
+	keys := args[:len(args)-1]
 
 	// Setup
 	switch len(opts.Verbose) {
@@ -67,23 +85,33 @@ func main() {
 
 	// Die if Filename looks compressed
 	re := regexp.MustCompile(`\.(gz|bz2|br)$`)
-	if re.MatchString(opts.Args.Filename) {
-		fmt.Fprintf(os.Stderr, "Filename %q appears to be compressed - cannot binary search\n", opts.Args.Filename)
+	if re.MatchString(filename) {
+		fmt.Fprintf(os.Stderr, "Filename %q appears to be compressed - cannot binary search\n", filename)
 		os.Exit(2)
 	}
 
 	// Instantiate searcher
-	o := bsearch.SearcherOptions{Header: opts.Header}
+	o := bsearch.SearcherOptions{Header: opts.Header, FullKeyMatch: opts.Exact}
+	if opts.Delim != "" {
+		o.Delimiter = []byte(opts.Delim)
+	}
+	if opts.Compare != "" {
+		o.Compare, err = bsearch.CompareByName(opts.Compare)
+		if err != nil {
+			die(err.Error())
+		}
+	}
 	if len(opts.Verbose) > 0 {
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 		o.Logger = &log.Logger
 	}
-	bss, err := bsearch.NewSearcherOptions(opts.Args.Filename, o)
+	bss, err := bsearch.NewSearcherOptions(filename, o)
 	if err != nil {
 		die(err.Error())
 	}
+	defer bss.Close()
 	if len(opts.Verbose) > 0 {
-		idxpath, err := bsearch.IndexPath(opts.Args.Filename)
+		idxpath, err := bsearch.IndexPath(filename)
 		if err != nil {
 			die(err.Error())
 		}
@@ -92,13 +120,43 @@ func main() {
 			Msg("using index")
 	}
 
-	searchStr := opts.Args.SearchString
+	// Search
+	found := false
+	if len(keys) > 0 {
+		for _, key := range keys {
+			found = search(bss, key) || found
+		}
+	} else {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			found = search(bss, scanner.Text()) || found
+		}
+		if err := scanner.Err(); err != nil {
+			die("Error: " + err.Error())
+		}
+	}
+	if !found {
+		bss.Close()
+		os.Exit(1)
+	}
+}
+
+// search prints the lines matching key, returning true if there were any
+func search(bss *bsearch.Searcher, key string) bool {
 	if opts.Rev {
-		searchStr = reverse(searchStr)
+		key = reverse(key)
 	}
 
-	// Search
-	results, err := bss.Lines([]byte(searchStr))
+	var results [][]byte
+	var err error
+	if opts.Prefix {
+		results, err = searchPrefix(bss, []byte(key))
+	} else {
+		results, err = bss.LinesN([]byte(key), opts.MaxN)
+	}
+	if err == bsearch.ErrNotFound {
+		return false
+	}
 	if err != nil {
 		if err == bsearch.ErrIndexNotFound {
 			die("Error: compressed dataset without index - recompress using bsearch_compress.")
@@ -114,6 +172,22 @@ func main() {
 		}
 		fmt.Println(line)
 	}
+	return len(results) > 0
+}
+
+// searchPrefix returns the lines whose key begins with prefix, iterating
+// so that the scan stops once opts.MaxN lines have been found
+func searchPrefix(bss *bsearch.Searcher, prefix []byte) ([][]byte, error) {
+	it, err := bss.LinesPrefixIter(prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	var results [][]byte
+	for (opts.MaxN == 0 || len(results) < opts.MaxN) && it.Next() {
+		results = append(results, append([]byte(nil), it.Bytes()...))
+	}
+	return results, it.Err()
 }
 
 // reverse returns its argument string reversed rune-wise left to right.
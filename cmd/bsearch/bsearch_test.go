@@ -61,6 +61,55 @@ func TestCmdBsearch(t *testing.T) {
 	}
 }
 
+func TestCmdBsearchOptions(t *testing.T) {
+	var tests = []struct {
+		name   string
+		cmd    string
+		status int
+		expect string
+	}{
+		{"max", "./bsearch -n 2 032.176.184.000 INFILE", 0,
+			`032.176.184.000,mobile000.mycingular.net,202003,mycingular.net
+032.176.184.000,mobile001.mycingular.net,202003,mycingular.net`},
+		{"multiple keys", "./bsearch 001.000.128.000 000.000.000.000 223.252.003.000 INFILE", 0,
+			`001.000.128.000,node-0.pool-1-0.dynamic.totinternet.net,202003,totinternet.net
+223.252.003.000,223-252-3-0.as45671.net,202003,as45671.net`},
+		{"stdin", "printf '001.034.164.000\\n024.066.017.000\\n' | ./bsearch INFILE", 0,
+			`001.034.164.000,1-34-164-0.HINET-IP.hinet.net,202003,hinet.net
+024.066.017.000,S0106905851b9f0e0.rd.shawcable.net,202003,shawcable.net`},
+		{"prefix", "./bsearch --prefix -n 3 003.12 INFILE", 0,
+			`003.122.207.000,ec2-3-122-207-0.eu-central-1.compute.amazonaws.com,202003,amazonaws.com
+003.126.183.000,ec2-3-126-183-0.eu-central-1.compute.amazonaws.com,202003,amazonaws.com`},
+		{"prefix max", "./bsearch --prefix -n 1 003.12 INFILE", 0,
+			`003.122.207.000,ec2-3-122-207-0.eu-central-1.compute.amazonaws.com,202003,amazonaws.com`},
+		{"not prefix", "./bsearch 003.12 INFILE", 1, ""},
+		{"exact", "./bsearch --exact -t , 223.252.003.000 INFILE", 0,
+			"223.252.003.000,223-252-3-0.as45671.net,202003,as45671.net"},
+		{"not found", "./bsearch 000.000.000.000 INFILE", 1, ""},
+		{"no filename", "./bsearch", 2, ""},
+	}
+
+	infile := filepath.Join("..", "..", "testdata", "rdns1.csv")
+
+	for _, tc := range tests {
+		cmd := strings.Replace(tc.cmd, "INFILE", infile, 1)
+		output, err := exec.Command("bash", "-c", cmd).Output()
+		status := 0
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			status = exitErr.ExitCode()
+		} else if err != nil {
+			t.Fatalf("%s: %s", tc.name, err.Error())
+		}
+		if status != tc.status {
+			t.Errorf("test %q exited with status %d, expected %d", tc.name, status, tc.status)
+		}
+		got := strings.TrimSpace(string(output))
+		if got != tc.expect {
+			t.Errorf("test %q failed:\n\ngot:\n%s\n\nexpected:\n%s\n", tc.name, got, tc.expect)
+		}
+	}
+}
+
 /*
 // FIXME: these are non-terminated text files - revisit
 func TestRev(t *testing.T) {
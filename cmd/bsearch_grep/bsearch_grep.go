@@ -0,0 +1,136 @@
+/*
+bsearch_grep is a prefix-aware grep for sorted datasets - it prints all
+lines in Filename whose key begins with SearchString (or equals it, with
+--key). Unlike grep(1), it uses a binary search (via the bsearch index) to
+find the first match, so it doesn't need to scan the whole file, and
+matches are streamed rather than held in memory.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/ProfoundNetworks/bsearch"
+	flags "github.com/jessevdk/go-flags"
+	"github.com/rs/zerolog"
+	log "github.com/rs/zerolog/log"
+)
+
+// Options
+var opts struct {
+	Verbose []bool `short:"v" long:"verbose" description:"display verbose debug output"`
+	Count   bool   `short:"c" long:"count" description:"print a count of matching lines instead of the lines themselves"`
+	Max     int    `short:"m" long:"max-count" description:"stop after N matching lines"`
+	Header  bool   `short:"H" long:"hdr" description:"ignore first line (header) in Filename when doing lookups"`
+	Key     bool   `short:"k" long:"key" description:"match whole keys only, rather than key prefixes"`
+	Args    struct {
+		SearchString string
+		Filename     string
+	} `positional-args:"yes" required:"yes"`
+}
+
+// Disable flags.PrintErrors for more control
+var parser = flags.NewParser(&opts, flags.Default&^flags.PrintErrors)
+
+func usage() {
+	parser.WriteHelp(os.Stderr)
+	os.Exit(2)
+}
+
+func die(msg string) {
+	fmt.Fprintln(os.Stderr, msg)
+	os.Exit(1)
+}
+
+func main() {
+	// Parse options
+	_, err := parser.Parse()
+	if err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type != flags.ErrHelp {
+			fmt.Fprintf(os.Stderr, "%s\n\n", err)
+		}
+		usage()
+	}
+	if opts.Max < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid --max-count %d\n\n", opts.Max)
+		usage()
+	}
+
+	// Setup
+	switch len(opts.Verbose) {
+	case 0:
+		zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	case 1:
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	case 2:
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	default:
+		zerolog.SetGlobalLevel(zerolog.TraceLevel)
+	}
+
+	// Instantiate searcher
+	o := bsearch.SearcherOptions{Header: opts.Header}
+	if len(opts.Verbose) > 0 {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+		o.Logger = &log.Logger
+	}
+	bss, err := bsearch.NewSearcherOptions(opts.Args.Filename, o)
+	if err != nil {
+		die(err.Error())
+	}
+	defer bss.Close()
+
+	// Count whole key matches without scanning them here
+	key := []byte(opts.Args.SearchString)
+	if opts.Count && opts.Key {
+		count, err := bss.Count(key)
+		if err != nil {
+			die("Error: " + err.Error())
+		}
+		if opts.Max > 0 && count > opts.Max {
+			count = opts.Max
+		}
+		fmt.Println(count)
+		if count == 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Search, streaming matches
+	var it *bsearch.LineIter
+	if opts.Key {
+		it, err = bss.LinesIter(key)
+	} else {
+		it, err = bss.LinesPrefixIter(key)
+	}
+	if err != nil {
+		die("Error: " + err.Error())
+	}
+	w := bufio.NewWriter(os.Stdout)
+	count := 0
+	for (opts.Max == 0 || count < opts.Max) && it.Next() {
+		count++
+		if !opts.Count {
+			w.Write(it.Bytes())
+			w.WriteByte('\n')
+		}
+	}
+	it.Close()
+	if err := it.Err(); err != nil && err != bsearch.ErrNotFound {
+		w.Flush()
+		die("Error: " + err.Error())
+	}
+	if opts.Count {
+		fmt.Fprintln(w, count)
+	}
+	w.Flush()
+
+	// Exit 1 if no lines were found, like grep(1)
+	if count == 0 {
+		os.Exit(1)
+	}
+}
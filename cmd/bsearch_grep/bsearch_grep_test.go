@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCmdBsearchGrep(t *testing.T) {
+	var tests = []struct {
+		name   string
+		args   string
+		search string
+		expect string
+	}{
+		{"key", "", "024.066.017.000",
+			"024.066.017.000,S0106905851b9f0e0.rd.shawcable.net,202003,shawcable.net"},
+		{"multiple", "", "032.176.184.000",
+			`032.176.184.000,mobile000.mycingular.net,202003,mycingular.net
+032.176.184.000,mobile001.mycingular.net,202003,mycingular.net
+032.176.184.000,mobile002.mycingular.net,202003,mycingular.net
+032.176.184.000,mobile003.mycingular.net,202003,mycingular.net
+032.176.184.000,mobile004.mycingular.net,202003,mycingular.net
+032.176.184.000,mobile005.mycingular.net,202003,mycingular.net`},
+		{"max", "-m 2", "032.176.184.000",
+			`032.176.184.000,mobile000.mycingular.net,202003,mycingular.net
+032.176.184.000,mobile001.mycingular.net,202003,mycingular.net`},
+		{"count", "-c", "032.176.184.000", "6"},
+		{"count max", "-c -m 4", "032.176.184.000", "4"},
+		{"prefix", "", "003.12",
+			`003.122.207.000,ec2-3-122-207-0.eu-central-1.compute.amazonaws.com,202003,amazonaws.com
+003.126.183.000,ec2-3-126-183-0.eu-central-1.compute.amazonaws.com,202003,amazonaws.com`},
+		{"prefix max", "-m 1", "003.12",
+			"003.122.207.000,ec2-3-122-207-0.eu-central-1.compute.amazonaws.com,202003,amazonaws.com"},
+		{"prefix count", "-c", "032.176", "7"},
+		{"key count", "-k -c", "032.176.184.000", "6"},
+		{"key count max", "-k -c -m 4", "032.176.184.000", "4"},
+	}
+
+	infile := filepath.Join("..", "..", "testdata", "rdns1.csv")
+
+	for _, tc := range tests {
+		cmd := "./bsearch_grep " + tc.args + " " + tc.search + " " + infile
+
+		output, err := exec.Command("bash", "-c", cmd).CombinedOutput()
+		got := strings.TrimSpace(string(output))
+		if err != nil {
+			t.Fatalf("%s: %s", err.Error(), got)
+		}
+
+		if got != tc.expect {
+			t.Errorf("test %q arg test failed:\n\ngot:\n%s\n\nexpected:\n%s\n", tc.name, got, tc.expect)
+		}
+	}
+
+	// Missing keys (including key prefixes with --key) should output
+	// nothing and exit 1
+	for _, args := range []string{"999.999.999.999", "-k 003.12", "-k -c 003.12"} {
+		cmd := "./bsearch_grep " + args + " " + infile
+		output, err := exec.Command("bash", "-c", cmd).CombinedOutput()
+		got := strings.TrimSpace(string(output))
+		if err == nil || (got != "" && got != "0") {
+			t.Errorf("%s: expected exit 1 and no output, got %v: %q", args, err, output)
+		}
+	}
+}
@@ -4,6 +4,10 @@ bsearch utility to generate a bsearch index file for a dataset.
 The index file is a zstd-compressed yaml file. It has the same name and
 location as the dataset, but with all '.' characters changed to '_', and
 a '.bsx' suffix e.g. the index for `test_foobar.csv` is `test_foobar_csv.bsx`.
+
+The index path, number of index entries, and whether the dataset keys are
+unique are printed on completion (also if the index is already up to date),
+so that indexes can be generated as a build step.
 */
 
 package main
@@ -23,14 +27,21 @@ import (
 // Options
 var opts struct {
 	Verbose   []bool `short:"v" long:"verbose" description:"display verbose debug output"`
-	Delim     string `short:"t" long:"sep" description:"separator/delimiter character"`
-	Header    bool   `long:"hdr" description:"Filename includes a header, which should be skipped (usually optional)"`
+	Delim     string `short:"t" long:"delimiter" description:"separator/delimiter character"`
+	Header    bool   `long:"header" description:"Filename includes a header, which should be skipped (usually optional)"`
 	Force     bool   `short:"f" long:"force" description:"force index generation even if up-to-date"`
 	Cat       bool   `short:"c" long:"cat" description:"write generated index to stdout instead of to file"`
-	Blocksize int    `short:"b" long:"bs" description:"index blocksize (kB, default 2kB)"`
+	Blocksize int    `short:"b" long:"blocksize" description:"index blocksize (kB, default 2kB)"`
+	Compare   string `long:"compare" description:"key comparison the dataset is sorted with (bytes, bytes-ci, numeric, runes)"`
+	Jobs      int    `short:"j" long:"jobs" description:"number of goroutines used to generate the index (default 1)"`
 	Args      struct {
 		Filename string
 	} `positional-args:"yes" required:"yes"`
+
+	// Deprecated option names
+	OldDelim     string `long:"sep" hidden:"yes"`
+	OldHeader    bool   `long:"hdr" hidden:"yes"`
+	OldBlocksize int    `long:"bs" hidden:"yes"`
 }
 
 func die(msg string) {
@@ -53,6 +64,14 @@ func main() {
 		os.Exit(2)
 	}
 
+	if opts.Delim == "" {
+		opts.Delim = opts.OldDelim
+	}
+	opts.Header = opts.Header || opts.OldHeader
+	if opts.Blocksize == 0 {
+		opts.Blocksize = opts.OldBlocksize
+	}
+
 	// Setup
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	switch len(opts.Verbose) {
@@ -82,9 +101,10 @@ func main() {
 
 	// Noop if a valid index already exists (unless --force is specified)
 	if !opts.Force && !opts.Cat {
-		_, err = bsearch.LoadIndex(opts.Args.Filename)
+		index, err := bsearch.LoadIndex(opts.Args.Filename)
 		if err == nil {
 			log.Info().Msg("index file found and up to date")
+			report(index)
 			os.Exit(0)
 		}
 	}
@@ -100,6 +120,15 @@ func main() {
 	if opts.Blocksize > 0 {
 		idxopt.Blocksize = opts.Blocksize * 1024
 	}
+	if opts.Jobs > 1 {
+		idxopt.Concurrency = opts.Jobs
+	}
+	if opts.Compare != "" {
+		idxopt.Compare, err = bsearch.CompareByName(opts.Compare)
+		if err != nil {
+			die(err.Error())
+		}
+	}
 	index, err := bsearch.NewIndexOptions(opts.Args.Filename, idxopt)
 	if err != nil {
 		die(err.Error())
@@ -120,4 +149,14 @@ func main() {
 	if err != nil {
 		die(err.Error())
 	}
+	report(index)
+}
+
+// report prints the index path, entry count, and key uniqueness of index
+func report(index *bsearch.Index) {
+	idxpath, err := bsearch.IndexPath(index.Filepath)
+	if err != nil {
+		die(err.Error())
+	}
+	fmt.Printf("%s: %d entries, keys unique: %t\n", idxpath, len(index.List), index.KeysUnique)
 }
@@ -2,8 +2,11 @@ package main
 
 import (
 	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/ProfoundNetworks/bsearch"
@@ -205,3 +208,42 @@ func TestIndexRIRHeader(t *testing.T) {
 		}
 	}
 }
+
+// Test the bsearch_index command writes an index and reports on it
+func TestCmdBsearchIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch_index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, err := ioutil.ReadFile("testdata/foo.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "foo.csv")
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idxpath, err := bsearch.IndexPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := idxpath + ": 2 entries, keys unique: false"
+
+	// Generate the index, and then report on the existing one
+	for i := 0; i < 2; i++ {
+		output, err := exec.Command("./bsearch_index", "--header", "--delimiter", ",",
+			"--blocksize", "1", path).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expect, strings.TrimSpace(string(output)))
+	}
+	index, err := bsearch.LoadIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1024, index.Blocksize)
+	assert.True(t, index.Header)
+}
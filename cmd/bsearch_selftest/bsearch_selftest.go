@@ -23,6 +23,7 @@ var opts struct {
 	Sep     string `short:"t" long:"sep" description:"separator"`
 	Header  bool   `short:"H" long:"hdr" description:"CSV file includes a header (don't test)"`
 	Stdin   bool   `short:"i" long:"stdin" description:"read test data from stdin instead of from CSVFile"`
+	Multi   bool   `short:"m" long:"multi" description:"test only duplicate keys, checking Lines() returns exactly their lines, in order"`
 	Args    struct {
 		CSVFile string `description:"CSV file to be processed"`
 	} `positional-args:"yes" required:"yes"`
@@ -102,6 +103,47 @@ func processBatch(bss *bsearch.Searcher, key string, batch []string, rownum int)
 	}
 }
 
+// multiDiag checks that Lines(key) returns exactly the lines in batch,
+// in order, returning a diagnostic on failure, or "" on success
+func multiDiag(bss *bsearch.Searcher, key string, batch []string) string {
+	lines, err := bss.Lines([]byte(key))
+	if err != nil {
+		return "# " + err.Error()
+	}
+	if len(lines) != len(batch) {
+		return fmt.Sprintf("# got %d lines for key %q, expected %d",
+			len(lines), key, len(batch))
+	}
+	for i, line := range lines {
+		if string(line) != batch[i] {
+			return fmt.Sprintf("# line %d for key %q: got %q, expected %q",
+				i+1, key, line, batch[i])
+		}
+	}
+	return ""
+}
+
+func processMulti(bss *bsearch.Searcher, key string, batch []string, rownum int) {
+	status := "ok"
+	diag := multiDiag(bss, key, batch)
+	if diag != "" {
+		status = "not ok"
+	}
+	tap(rownum, status, key, diag)
+}
+
+// processKeyBatch processes a batch of lines with the same key
+func processKeyBatch(bss *bsearch.Searcher, key string, batch []string, rownum int) {
+	if !opts.Multi {
+		processBatch(bss, key, batch, rownum)
+		return
+	}
+	// Multi mode only tests duplicate keys
+	if len(batch) > 1 {
+		processMulti(bss, key, batch, rownum)
+	}
+}
+
 func main() {
 	// Parse default options are HelpFlag | PrintErrors | PassDoubleDash
 	parser := flags.NewParser(&opts, flags.Default)
@@ -142,11 +184,22 @@ func main() {
 	log.Info().
 		Str("sep", opts.Sep).
 		Msg("")
-	bss, err := bsearch.NewSearcher(opts.Args.CSVFile)
+	// Use the separator (which may be multi-byte) for the index as well
+	delim := []byte(opts.Sep)
+	bss, err := bsearch.NewSearcherOptions(opts.Args.CSVFile,
+		bsearch.SearcherOptions{Delimiter: delim})
 	if err != nil {
 		die(err.Error())
 	}
 	defer bss.Close()
+	if bss.Index == nil {
+		// No index file exists, so generate one
+		bss.Index, err = bsearch.NewIndexOptions(opts.Args.CSVFile,
+			bsearch.IndexOptions{Delimiter: delim})
+		if err != nil {
+			die(err.Error())
+		}
+	}
 	keysUnique := bss.Index.KeysUnique
 	scanner := bufio.NewScanner(fh)
 
@@ -173,7 +226,7 @@ func main() {
 		key := splits[0]
 
 		// keysUnique processing - individual lines
-		if keysUnique {
+		if keysUnique && !opts.Multi {
 			processLine(bss, key, line, rownum)
 			rownum += 1
 			continue
@@ -189,7 +242,7 @@ func main() {
 		} else {
 			// Break - process batch and reset
 			if len(batch) > 0 {
-				processBatch(bss, prevKey, batch, rownum)
+				processKeyBatch(bss, prevKey, batch, rownum)
 			}
 			prevKey = key
 			rownum += len(batch)
@@ -200,6 +253,6 @@ func main() {
 		die(err.Error())
 	}
 	if len(batch) > 0 {
-		processBatch(bss, prevKey, batch, rownum)
+		processKeyBatch(bss, prevKey, batch, rownum)
 	}
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ProfoundNetworks/bsearch"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test multiDiag() with the duplicate keys in testdata/multi.csv, some of
+// which span multiple index blocks
+func TestMultiDiag(t *testing.T) {
+	fh, err := os.Open("testdata/multi.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	batches := make(map[string][]string)
+	var keys []string
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := scanner.Text()
+		key := strings.SplitN(line, ",", 2)[0]
+		if _, ok := batches[key]; !ok {
+			keys = append(keys, key)
+		}
+		batches[key] = append(batches[key], line)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	bss, err := bsearch.NewSearcher("testdata/multi.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bss.Close()
+
+	for _, key := range keys {
+		batch := batches[key]
+		assert.Equal(t, "", multiDiag(bss, key, batch), key)
+		if len(batch) < 2 {
+			continue
+		}
+
+		// Missing and misordered lines should fail
+		assert.NotEqual(t, "", multiDiag(bss, key, batch[1:]), key)
+		swapped := append([]string{}, batch...)
+		swapped[0], swapped[1] = swapped[1], swapped[0]
+		assert.NotEqual(t, "", multiDiag(bss, key, swapped), key)
+	}
+}
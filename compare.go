@@ -0,0 +1,243 @@
+/*
+bsearch key comparison and normalisation functions, for use with
+SearcherOptions.Compare, IndexOptions.Compare, and SearcherOptions.KeyPad
+*/
+
+package bsearch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	ErrUnknownCompare = errors.New("unknown compare function")
+)
+
+// compareFuncs are the comparison functions available via CompareByName
+var compareFuncs = map[string]func(a, b []byte) int{
+	"bytes":    bytes.Compare,
+	"bytes-ci": CompareFold,
+	"numeric":  CompareNumeric,
+	"runes":    CompareRunes,
+}
+
+// CompareByName returns the key comparison function registered as name,
+// for selecting a Compare function by name (e.g. from a CLI --compare
+// flag). See CompareNames for the registered names. Returns
+// ErrUnknownCompare if no function is registered as name.
+func CompareByName(name string) (func(a, b []byte) int, error) {
+	compare, ok := compareFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q (known: %s)", ErrUnknownCompare, name,
+			strings.Join(CompareNames(), ", "))
+	}
+	return compare, nil
+}
+
+// CompareNames returns the names of the comparison functions available
+// via CompareByName, in sorted order
+func CompareNames() []string {
+	names := make([]string, 0, len(compareFuncs))
+	for name := range compareFuncs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// asciiFold returns c lowercased if it is an ASCII uppercase letter
+func asciiFold(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// CompareFold compares a and b bytewise after lowercasing ASCII letters,
+// without allocating. The dataset must be sorted on lowercased keys
+// (e.g. sort -f, with LC_ALL=C).
+func CompareFold(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		ca, cb := asciiFold(a[i]), asciiFold(b[i])
+		if ca < cb {
+			return -1
+		}
+		if ca > cb {
+			return 1
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return 0
+}
+
+// PrefixCompareInsensitive compares bufa with b as a prefix comparison
+// (comparing only the first len(b) bytes of bufa, so that a bufa beginning
+// with b compares as equal, and a shorter bufa as less), but lowercasing
+// ASCII letters byte-by-byte, without allocating. It may be used as
+// SearcherOptions.Compare for lookups of mixed-case user input, matching
+// keys beginning with the search key. The dataset must then also be
+// sorted case-insensitively (e.g. LC_ALL=C sort -f), and indexed with the
+// same Compare. Note that since longer keys compare as equal, matches
+// spanning more than one index block may be missed - use CompareFold for
+// case-insensitive full key comparisons.
+func PrefixCompareInsensitive(bufa, b []byte) int {
+	n := len(b)
+	if len(bufa) < n {
+		n = len(bufa)
+	}
+	if cmp := CompareFold(bufa[:n], b[:n]); cmp != 0 {
+		return cmp
+	}
+	if len(bufa) < len(b) {
+		// An equal match here is short, so actually a less than
+		return -1
+	}
+	return 0
+}
+
+// leadingInt splits k into a leading integer (an optional '-' followed by
+// digits) and the remaining tail, returning the integer sign and its
+// digits without leading zeros. Returns ok false if k does not begin with
+// an integer.
+func leadingInt(k []byte) (neg bool, digits, tail []byte, ok bool) {
+	i := 0
+	if len(k) > 0 && k[0] == '-' {
+		neg = true
+		i = 1
+	}
+	j := i
+	for j < len(k) && k[j] >= '0' && k[j] <= '9' {
+		j++
+	}
+	if j == i {
+		return false, nil, k, false
+	}
+	digits = bytes.TrimLeft(k[i:j], "0")
+	if len(digits) == 0 {
+		// -0 == 0
+		neg = false
+	}
+	return neg, digits, k[j:], true
+}
+
+// CompareNumeric compares keys beginning with integers (e.g. unpadded
+// keys like 2, 10, 100, or -5) numerically on their leading integers, and
+// then bytewise on the remaining tails. Keys beginning with an integer
+// sort before those that do not, and keys without leading integers are
+// compared bytewise. Integers may be arbitrarily long.
+func CompareNumeric(a, b []byte) int {
+	nega, da, ta, oka := leadingInt(a)
+	negb, db, tb, okb := leadingInt(b)
+	switch {
+	case !oka && !okb:
+		return bytes.Compare(a, b)
+	case !okb:
+		return -1
+	case !oka:
+		return 1
+	}
+	if nega != negb {
+		if nega {
+			return -1
+		}
+		return 1
+	}
+
+	// Compare magnitudes (longer digit runs are larger)
+	var cmp int
+	switch {
+	case len(da) < len(db):
+		cmp = -1
+	case len(da) > len(db):
+		cmp = 1
+	default:
+		cmp = bytes.Compare(da, db)
+	}
+	if nega {
+		cmp = -cmp
+	}
+	if cmp != 0 {
+		return cmp
+	}
+	return bytes.Compare(ta, tb)
+}
+
+// CompareRunes compares a and b rune-by-rune on their Unicode code points.
+// This matches bytes.Compare for valid UTF-8, but treats invalid UTF-8
+// bytes as utf8.RuneError (U+FFFD).
+func CompareRunes(a, b []byte) int {
+	return compareRunes(a, b)
+}
+
+var compareRunes = NewCollationCompare(func(r rune) int { return int(r) })
+
+// NewCollationCompare returns a key comparison function that compares
+// keys rune-by-rune using the collation weights returned by weights
+// (e.g. a precomputed table derived from an ICU collation). Runes with
+// equal weights compare as equal. If one key is a prefix of the other
+// (by weight), the shorter key sorts first, as with bytes.Compare.
+// Note that the dataset must be sorted using the same collation.
+func NewCollationCompare(weights func(rune) int) func(a, b []byte) int {
+	return func(a, b []byte) int {
+		for len(a) > 0 && len(b) > 0 {
+			ra, na := utf8.DecodeRune(a)
+			rb, nb := utf8.DecodeRune(b)
+			wa, wb := weights(ra), weights(rb)
+			if wa < wb {
+				return -1
+			}
+			if wa > wb {
+				return 1
+			}
+			a = a[na:]
+			b = b[nb:]
+		}
+		switch {
+		case len(a) < len(b):
+			return -1
+		case len(a) > len(b):
+			return 1
+		}
+		return 0
+	}
+}
+
+// NormalizeIPKey zero-pads each octet of a dotted-quad IPv4 address key to
+// three digits (e.g. 1.0.128.0 becomes 001.000.128.000), so that it
+// matches datasets using zero-padded keys (for which byte order matches
+// numeric order). Keys that are not IPv4 addresses are returned unchanged.
+func NormalizeIPKey(k []byte) []byte {
+	octets := bytes.Split(k, []byte{'.'})
+	if len(octets) != 4 {
+		return k
+	}
+	padded := make([]byte, 0, 15)
+	for i, octet := range octets {
+		if len(octet) == 0 || len(octet) > 3 {
+			return k
+		}
+		for _, c := range octet {
+			if c < '0' || c > '9' {
+				return k
+			}
+		}
+		if i > 0 {
+			padded = append(padded, '.')
+		}
+		for j := len(octet); j < 3; j++ {
+			padded = append(padded, '0')
+		}
+		padded = append(padded, octet...)
+	}
+	return padded
+}
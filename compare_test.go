@@ -0,0 +1,428 @@
+package bsearch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// collationWeights is a tiny collation table treating accented vowels
+// as equal to their unaccented forms
+func collationWeights(r rune) int {
+	switch r {
+	case 'à':
+		return 'a'
+	case 'é':
+		return 'e'
+	}
+	return int(r)
+}
+
+func TestNewCollationCompare(t *testing.T) {
+	var tests = []struct {
+		a      string
+		b      string
+		expect int
+	}{
+		{"abc", "abc", 0},
+		{"àbc", "abc", 0},
+		{"àbd", "abc", 1},
+		{"àbd", "acd", -1},
+		{"école", "ecole", 0},
+		{"éclair", "ecole", -1},
+		{"ab", "abc", -1},
+		{"àbc", "ab", 1},
+		{"", "a", -1},
+		{"", "", 0},
+	}
+
+	compare := NewCollationCompare(collationWeights)
+	for _, tc := range tests {
+		assert.Equal(t, tc.expect, compare([]byte(tc.a), []byte(tc.b)),
+			tc.a+" vs "+tc.b)
+	}
+}
+
+// Test CompareByName() and each registered comparison function
+func TestCompareByName(t *testing.T) {
+	var tests = []struct {
+		name   string
+		a      string
+		b      string
+		expect int
+	}{
+		{"bytes", "abc", "abc", 0},
+		{"bytes", "ABC", "abc", -1},
+		{"bytes", "10", "9", -1},
+		{"bytes", "ab", "abc", -1},
+		{"bytes-ci", "ABC", "abc", 0},
+		{"bytes-ci", "Abd", "abc", 1},
+		{"bytes-ci", "abc", "ABD", -1},
+		{"bytes-ci", "AB", "abc", -1},
+		{"bytes-ci", "[", "a", -1},
+		{"numeric", "10", "9", 1},
+		{"numeric", "2", "10", -1},
+		{"numeric", "007", "7", 0},
+		{"numeric", "100", "100", 0},
+		{"numeric", "-5", "-10", 1},
+		{"numeric", "-5", "3", -1},
+		{"numeric", "-0", "0", 0},
+		{"numeric", "10a", "10b", -1},
+		{"numeric", "9z", "10a", -1},
+		{"numeric", "10", "abc", -1},
+		{"numeric", "abc", "abd", -1},
+		{"numeric", "123456789012345678901234567890", "99", 1},
+		{"runes", "abc", "abc", 0},
+		{"runes", "abc", "abd", -1},
+		{"runes", "é", "z", 1},
+		{"runes", "ab", "abc", -1},
+	}
+
+	for _, tc := range tests {
+		compare, err := CompareByName(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc := fmt.Sprintf("%s: %q vs %q", tc.name, tc.a, tc.b)
+		assert.Equal(t, tc.expect, compare([]byte(tc.a), []byte(tc.b)), desc)
+		assert.Equal(t, -tc.expect, compare([]byte(tc.b), []byte(tc.a)), desc+" (reversed)")
+	}
+
+	assert.Equal(t, []string{"bytes", "bytes-ci", "numeric", "runes"}, CompareNames())
+	_, err := CompareByName("nosuch")
+	assert.True(t, errors.Is(err, ErrUnknownCompare), "unknown name returns ErrUnknownCompare")
+}
+
+// Test Searcher.Lines() with a collation Compare using testdata/collated.csv
+// (which is not bytewise sorted)
+func TestSearcherLinesCollation(t *testing.T) {
+	var tests = []struct {
+		key    string
+		expect []string
+	}{
+		{"abc", []string{"abc,1"}},
+		{"abd", []string{"àbd,2"}},
+		{"àbd", []string{"àbd,2"}},
+		{"acd", []string{"acd,3"}},
+		{"eclair", []string{"éclair,4"}},
+		{"ecole", []string{"ecole,5", "école,6"}},
+		{"école", []string{"ecole,5", "école,6"}},
+		{"zed", []string{"zed,7"}},
+		{"ab", nil},
+		{"ecol", nil},
+	}
+
+	path := "testdata/collated.csv"
+	compare := NewCollationCompare(collationWeights)
+	idx, err := NewIndexOptions(path, IndexOptions{Compare: compare})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, false, idx.Header)
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSearcherOptions(path, SearcherOptions{Compare: compare})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range tests {
+		lines, err := s.Lines([]byte(tc.key))
+		if tc.expect == nil {
+			assert.Equal(t, ErrNotFound, err, tc.key)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s\n", tc.key, err.Error())
+		}
+		got := []string{}
+		for _, line := range lines {
+			got = append(got, string(line))
+		}
+		assert.Equal(t, tc.expect, got, tc.key)
+	}
+}
+
+func TestNormalizeIPKey(t *testing.T) {
+	var tests = []struct {
+		key    string
+		expect string
+	}{
+		{"1.0.128.0", "001.000.128.000"},
+		{"001.000.128.000", "001.000.128.000"},
+		{"202.47.145.0", "202.047.145.000"},
+		{"10.1.2", "10.1.2"},
+		{"1.2.3.4.5", "1.2.3.4.5"},
+		{"1.2.3.1000", "1.2.3.1000"},
+		{"1.2..4", "1.2..4"},
+		{"a.b.c.d", "a.b.c.d"},
+		{"example.com", "example.com"},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.expect, string(NormalizeIPKey([]byte(tc.key))), tc.key)
+	}
+}
+
+// Test Searcher.Line() with KeyPad: NormalizeIPKey using testdata/rdns1.csv
+func TestSearcherLineKeyPad(t *testing.T) {
+	var tests = []struct {
+		key    string
+		expect string
+	}{
+		{"001.000.128.000", "001.000.128.000,node-0.pool-1-0.dynamic.totinternet.net,202003,totinternet.net"},
+		{"1.0.128.0", "001.000.128.000,node-0.pool-1-0.dynamic.totinternet.net,202003,totinternet.net"},
+		{"1.34.164.0", "001.034.164.000,1-34-164-0.HINET-IP.hinet.net,202003,hinet.net"},
+		{"202.47.145.0", "202.047.145.000,mozart145-0.guamcell.net,202003,guamcell.net"},
+		{"202.047.145.000", "202.047.145.000,mozart145-0.guamcell.net,202003,guamcell.net"},
+	}
+
+	s, err := NewSearcherOptions("testdata/rdns1.csv", SearcherOptions{KeyPad: NormalizeIPKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range tests {
+		line, err := s.Line([]byte(tc.key))
+		if err != nil {
+			t.Fatalf("%s: %s\n", tc.key, err.Error())
+		}
+		assert.Equal(t, tc.expect, string(line), tc.key)
+	}
+
+	// Unpadded keys are not found without KeyPad
+	s2, err := NewSearcher("testdata/rdns1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	_, err = s2.Line([]byte("1.0.128.0"))
+	assert.Equal(t, ErrNotFound, err)
+}
+
+// fnvKeyHash returns the hex-encoded 32-bit FNV-1a hash of k (as used
+// for the testdata/hashed.csv key column)
+func fnvKeyHash(k []byte) []byte {
+	h := fnv.New32a()
+	h.Write(k)
+	return []byte(fmt.Sprintf("%08x", h.Sum32()))
+}
+
+func TestSearcherLineKeyHash(t *testing.T) {
+	var tests = []struct {
+		key    string
+		expect string
+	}{
+		{"apple.com", "be91c6d0,apple.com,1"},
+		{"golang.org", "84afaefb,golang.org,10"},
+		{"hotkey.net", "317d411a,hotkey.net,4"},
+		{"zoom.us", "9d08b840,zoom.us,9"},
+	}
+
+	s, err := NewSearcherOptions("testdata/hashed.csv", SearcherOptions{KeyHash: fnvKeyHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range tests {
+		line, err := s.Line([]byte(tc.key))
+		if err != nil {
+			t.Fatalf("%s: %s\n", tc.key, err.Error())
+		}
+		assert.Equal(t, tc.expect, string(line), tc.key)
+	}
+	_, err = s.Line([]byte("missing.com"))
+	assert.Equal(t, ErrNotFound, err)
+}
+
+// Test Searcher.LinesPrefixSuffix() prefix and suffix matching using a
+// collation Compare on testdata/collated.csv
+func TestSearcherLinesPrefixSuffixCollation(t *testing.T) {
+	var tests = []struct {
+		prefix string
+		suffix string
+		expect []string
+	}{
+		{"ab", "", []string{"abc,1", "àbd,2"}},
+		{"àb", "", []string{"abc,1", "àbd,2"}},
+		{"ab", "d", []string{"àbd,2"}},
+		{"ec", "", []string{"éclair,4", "ecole,5", "école,6"}},
+		{"éc", "ole", []string{"ecole,5", "école,6"}},
+		{"ec", "olé", []string{"ecole,5", "école,6"}},
+		{"z", "", []string{"zed,7"}},
+	}
+
+	s, err := NewSearcherOptions("testdata/collated.csv", SearcherOptions{
+		Compare: NewCollationCompare(collationWeights),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range tests {
+		lines, err := s.LinesPrefixSuffix([]byte(tc.prefix), []byte(tc.suffix))
+		if err != nil {
+			t.Fatalf("%s/%s: %s\n", tc.prefix, tc.suffix, err.Error())
+		}
+		got := make([]string, len(lines))
+		for i, line := range lines {
+			got[i] = string(line)
+		}
+		assert.Equal(t, tc.expect, got, tc.prefix+"/"+tc.suffix)
+	}
+	_, err = s.LinesPrefixSuffix([]byte("b"), nil)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestPrefixCompareInsensitive(t *testing.T) {
+	var tests = []struct {
+		a      string
+		b      string
+		expect int
+	}{
+		{"abc", "abc", 0},
+		{"ABC", "abc", 0},
+		{"abc", "ABC", 0},
+		{"AbCd", "aBc", 0},
+		{"ab", "abc", -1},
+		{"AB", "abc", -1},
+		{"abd", "ABC", 1},
+		{"ABC", "abd", -1},
+		{"", "a", -1},
+		{"a", "", 0},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.expect, PrefixCompareInsensitive([]byte(tc.a), []byte(tc.b)),
+			tc.a+" vs "+tc.b)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		PrefixCompareInsensitive([]byte("alstom.com"), []byte("ALSTOM"))
+	})
+	assert.Equal(t, float64(0), allocs, "PrefixCompareInsensitive() allocations")
+}
+
+// Test Searcher.Lines() with PrefixCompareInsensitive using
+// testdata/casefold.csv (which is sorted case-insensitively)
+func TestSearcherLinesPrefixCompareInsensitive(t *testing.T) {
+	var tests = []struct {
+		key    string
+		expect []string
+	}{
+		{"ALSTOM.COM", []string{"alstom.com,2"}},
+		{"beta.ORG", []string{"BETA.org,3", "beta.org,4"}},
+		{"gamma", []string{"Gamma.net,5"}},
+		{"AL", []string{"Alpha.com,1", "alstom.com,2"}},
+		{"delta", nil},
+	}
+
+	idx, err := NewIndexOptions("testdata/casefold.csv",
+		IndexOptions{Compare: PrefixCompareInsensitive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, idx.Header, "casefold.csv is sorted")
+	ensureNoIndex(t, "casefold.csv")
+	s, err := NewSearcherOptions("testdata/casefold.csv",
+		SearcherOptions{Compare: PrefixCompareInsensitive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range tests {
+		lines, err := s.Lines([]byte(tc.key))
+		if tc.expect == nil {
+			assert.Equal(t, ErrNotFound, err, tc.key)
+			continue
+		}
+		assert.Nil(t, err, tc.key)
+		got := make([]string, len(lines))
+		for i, line := range lines {
+			got[i] = string(line)
+		}
+		assert.Equal(t, tc.expect, got, tc.key)
+	}
+}
+
+// Test CompareNumeric() with negative, unpadded and mixed keys
+func TestCompareNumeric(t *testing.T) {
+	var tests = []struct {
+		a      string
+		b      string
+		expect int
+	}{
+		{"2", "10", -1},
+		{"10", "100", -1},
+		{"100", "99", 1},
+		{"007", "7", 0},
+		{"-5", "3", -1},
+		{"-5", "-10", 1},
+		{"-0", "0", 0},
+		{"-1", "-1", 0},
+		{"10abc", "10abd", -1},
+		{"2b", "10a", -1},
+		{"10", "10a", -1},
+		{"123456789012345678901234567890", "123456789012345678901234567891", -1},
+		{"9", "abc", -1},
+		{"abc", "-1", 1},
+		{"abc", "abd", -1},
+		{"-", "-1", 1},
+	}
+
+	for _, tc := range tests {
+		desc := tc.a + " vs " + tc.b
+		assert.Equal(t, tc.expect, CompareNumeric([]byte(tc.a), []byte(tc.b)), desc)
+		assert.Equal(t, -tc.expect, CompareNumeric([]byte(tc.b), []byte(tc.a)), desc)
+	}
+}
+
+// Test the warning logged when indexing bytewise-sorted numeric keys that
+// are not in numeric order
+func TestCompareNumericIndexWarning(t *testing.T) {
+	var tests = []struct {
+		data    string
+		compare func(a, b []byte) int
+		warn    bool
+	}{
+		{"1,a\n10,b\n100,c\n2,d\n", nil, true},
+		{"001,a\n002,b\n010,c\n100,d\n", nil, false},
+		{"alpha,a\nbeta,b\n", nil, false},
+		{"1,a\n2,d\n10,b\n100,c\n", CompareNumeric, false},
+	}
+
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "numeric.csv")
+
+	for _, tc := range tests {
+		err = ioutil.WriteFile(path, []byte(tc.data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		logger := zerolog.New(&buf).Level(zerolog.WarnLevel)
+		_, err := NewIndexOptions(path, IndexOptions{Logger: &logger, Compare: tc.compare})
+		assert.Nil(t, err, tc.data)
+		assert.Equal(t, tc.warn, strings.Contains(buf.String(), "CompareNumeric"), tc.data)
+	}
+}
@@ -38,7 +38,7 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 	}
 
 	// Remove leading key+delimiter from line
-	prefix := append(key, db.bss.Index.Delimiter...)
+	prefix := keyDelim(key, db.bss.Index.Delimiter)
 	// Sanity check
 	if !bytes.HasPrefix(line, prefix) {
 		panic(
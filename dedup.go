@@ -0,0 +1,153 @@
+/*
+bsearch deduplication functions, for collapsing duplicate keys in a
+dataset before indexing it
+*/
+
+package bsearch
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeepMode selects which line DedupAndIndex keeps for duplicate keys
+type KeepMode int
+
+const (
+	KeepFirst KeepMode = iota // keep the first line for each key
+	KeepLast                  // keep the last line for each key
+)
+
+// dedupPath returns the output path used by DedupAndIndex for path
+// (e.g. foo_dedup.csv for foo.csv, retaining the extension so that the
+// delimiter can still be derived from it)
+func dedupPath(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "_dedup" + ext
+}
+
+// DedupAndIndex writes a copy of the dataset at path with consecutive
+// lines with equal keys collapsed to one (the first or last, per keep),
+// and then generates and writes an index for it using opt. The dataset
+// must be sorted (as required for indexing), so that all lines with a
+// given key are consecutive - ErrUnsorted is returned otherwise. Keys are
+// extracted and compared as for index generation (using opt.Delimiter,
+// Header, TrimKeySpace, Compare, Descending, SortKeyColumn, CSVQuoting and
+// KeyFunc). The output is written alongside path (e.g. foo_dedup.csv for
+// foo.csv), and its path returned.
+func DedupAndIndex(path string, keep KeepMode, opt IndexOptions) (outPath string, idx *Index, err error) {
+	delim := opt.Delimiter
+	if len(delim) == 0 {
+		delim, err = deriveDelimiter(path)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	keyIndex := optionsKeyIndex(opt, delim)
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer fh.Close()
+	stat, err := fh.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Write to a temporary file, and rename into place when complete
+	outPath = dedupPath(path)
+	tmp, err := ioutil.TempFile(filepath.Dir(outPath), filepath.Base(outPath)+".tmp")
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	w := bufio.NewWriter(tmp)
+	// bufio.Writer errors are sticky, so any write error is returned by
+	// the final Flush
+	writeLine := func(line []byte) {
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, defaultBlocksize), autoBlocksizeMax)
+	skipHeader := opt.Header
+	var prevKey, pending []byte
+	var lineNumber, prevLineNumber int
+	havePrev := false
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		lineNumber++
+		if skipHeader {
+			skipHeader = false
+			writeLine(line)
+			continue
+		}
+
+		key, _ := keyIndex.lineKey(line)
+		if havePrev {
+			cmp := keyIndex.compareKeys(prevKey, key)
+			// As with generateLineIndex, allow the first line to be an
+			// undeclared header
+			if cmp > 0 && (prevLineNumber != 1 || opt.Header) {
+				return "", nil, fmt.Errorf("%w: line %d key %q < line %d key %q",
+					ErrUnsorted, lineNumber, key, prevLineNumber, prevKey)
+			}
+			if cmp == 0 {
+				if keep == KeepLast {
+					pending = append(pending[:0], line...)
+				}
+				continue
+			}
+		}
+		if havePrev {
+			writeLine(pending)
+		}
+		pending = append(pending[:0], line...)
+		prevKey = append(prevKey[:0], key...)
+		prevLineNumber = lineNumber
+		havePrev = true
+	}
+	if err = scanner.Err(); err != nil {
+		return "", nil, err
+	}
+	if havePrev {
+		writeLine(pending)
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return "", nil, err
+	}
+	// Give the output the source permissions (TempFile creates it 0600)
+	err = tmp.Chmod(stat.Mode().Perm())
+	if err != nil {
+		return "", nil, err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return "", nil, err
+	}
+	err = os.Rename(tmp.Name(), outPath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Index the deduplicated dataset
+	opt.Delimiter = delim
+	idx, err = NewIndexOptions(outPath, opt)
+	if err != nil {
+		return "", nil, err
+	}
+	err = idx.Write()
+	if err != nil {
+		return "", nil, err
+	}
+	return outPath, idx, nil
+}
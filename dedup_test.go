@@ -0,0 +1,75 @@
+package bsearch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupAndIndex(t *testing.T) {
+	var tests = []struct {
+		keep   KeepMode
+		expect string
+	}{
+		{KeepFirst, "key,value\nalpha,1\nbeta,2\ngamma,5\nzeta,7\n"},
+		{KeepLast, "key,value\nalpha,1\nbeta,4\ngamma,6\nzeta,7\n"},
+	}
+
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dups.csv")
+	data := "key,value\nalpha,1\nbeta,2\nbeta,3\nbeta,4\ngamma,5\ngamma,6\nzeta,7\n"
+
+	for _, tc := range tests {
+		err = ioutil.WriteFile(path, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outPath, idx, err := DedupAndIndex(path, tc.keep, IndexOptions{Header: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, filepath.Join(dir, "dups_dedup.csv"), outPath)
+		got, err := ioutil.ReadFile(outPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.expect, string(got))
+		assert.True(t, idx.KeysUnique)
+
+		// The output has the source permissions
+		stat, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outStat, err := os.Stat(outPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, stat.Mode().Perm(), outStat.Mode().Perm())
+
+		// The written index is usable
+		s, err := NewSearcher(outPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines, err := s.Lines([]byte("beta"))
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(lines))
+		s.Close()
+	}
+
+	// Unsorted data
+	err = ioutil.WriteFile(path, []byte("alpha,1\nbeta,2\nalpha,3\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = DedupAndIndex(path, KeepFirst, IndexOptions{})
+	assert.ErrorIs(t, err, ErrUnsorted)
+}
@@ -0,0 +1,108 @@
+/*
+bsearch record framing, for searching datasets of records that are not
+newline-terminated lines (e.g. length-prefixed binary records)
+*/
+
+package bsearch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrRecordTruncated   = errors.New("truncated record")
+	ErrFramerUnsupported = errors.New("not supported with a custom record framer")
+)
+
+// RecordFramer frames the records of a dataset, for use with
+// IndexOptions.Framer and SearcherOptions.Framer.
+//
+// NextRecord returns the bounds [start, end) of the payload of the first
+// record in buf at or after pos, or false if buf holds no complete record
+// there. pos is either the start of a record frame, or the end of the
+// previous record payload, so framers must skip any record terminator or
+// prefix at pos (the next record is found by calling NextRecord with the
+// end of the current one). Record payloads have the same layout as lines,
+// i.e. they begin with the record key followed by the delimiter, and the
+// dataset must be sorted by key.
+type RecordFramer interface {
+	NextRecord(buf []byte, pos int) (start, end int, ok bool)
+}
+
+// lineFramer is the default RecordFramer, for newline-terminated lines.
+// Empty lines are skipped.
+type lineFramer struct{}
+
+func (lineFramer) NextRecord(buf []byte, pos int) (int, int, bool) {
+	// Skip the terminator of the previous line (and any empty lines)
+	for pos < len(buf) && buf[pos] == '\n' {
+		pos++
+	}
+	if pos >= len(buf) {
+		return 0, 0, false
+	}
+	nlidx := bytes.IndexByte(buf[pos:], '\n')
+	if nlidx == -1 {
+		return pos, len(buf), true
+	}
+	return pos, pos + nlidx, true
+}
+
+// LengthPrefixFramer is a RecordFramer for records consisting of an
+// unsigned varint payload length (as written by binary.PutUvarint),
+// followed by the payload.
+type LengthPrefixFramer struct{}
+
+func (LengthPrefixFramer) NextRecord(buf []byte, pos int) (int, int, bool) {
+	if pos >= len(buf) {
+		return 0, 0, false
+	}
+	length, n := binary.Uvarint(buf[pos:])
+	if n <= 0 || length > uint64(len(buf)-pos-n) {
+		return 0, 0, false
+	}
+	start := pos + n
+	return start, start + int(length), true
+}
+
+// framerSplit returns a bufio.SplitFunc returning the record payloads
+// framed by framer, which sets *pos to the dataset position of each
+// record (i.e. the position NextRecord frames it from) before returning it
+func framerSplit(framer RecordFramer, pos *int64) bufio.SplitFunc {
+	var consumed int64
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		start, end, ok := framer.NextRecord(data, 0)
+		if !ok || (end == len(data) && !atEOF) {
+			if atEOF && len(data) > 0 {
+				return 0, nil, fmt.Errorf("%w at offset %d", ErrRecordTruncated, consumed)
+			}
+			// Request more data
+			return 0, nil, nil
+		}
+		*pos = consumed
+		consumed += int64(end)
+		return end, data[start:end], nil
+	}
+}
+
+// framer returns the searcher's record framer
+func (s *Searcher) framer() RecordFramer {
+	if s.Index.framer != nil {
+		return s.Index.framer
+	}
+	return lineFramer{}
+}
+
+// requireLineFramer returns ErrFramerUnsupported if the searcher uses a
+// custom record framer (for methods that only support newline-terminated
+// lines)
+func (s *Searcher) requireLineFramer() error {
+	if s.Index.framer != nil {
+		return ErrFramerUnsupported
+	}
+	return nil
+}
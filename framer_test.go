@@ -0,0 +1,134 @@
+package bsearch
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLineFramer(t *testing.T) {
+	buf := []byte("a,1\nb,2\n\nc,3")
+	var got []string
+	var f lineFramer
+	pos := 0
+	for {
+		start, end, ok := f.NextRecord(buf, pos)
+		if !ok {
+			break
+		}
+		got = append(got, string(buf[start:end]))
+		pos = end
+	}
+	assert.Equal(t, []string{"a,1", "b,2", "c,3"}, got)
+}
+
+func TestLengthPrefixFramer(t *testing.T) {
+	var buf []byte
+	var last int
+	prefix := make([]byte, binary.MaxVarintLen64)
+	for _, rec := range []string{"a,1", "b,2\n", strings.Repeat("c", 300)} {
+		last = len(buf)
+		n := binary.PutUvarint(prefix, uint64(len(rec)))
+		buf = append(buf, prefix[:n]...)
+		buf = append(buf, rec...)
+	}
+
+	var got []string
+	var f LengthPrefixFramer
+	pos := 0
+	for {
+		start, end, ok := f.NextRecord(buf, pos)
+		if !ok {
+			break
+		}
+		got = append(got, string(buf[start:end]))
+		pos = end
+	}
+	assert.Equal(t, []string{"a,1", "b,2\n", strings.Repeat("c", 300)}, got)
+	assert.Equal(t, len(buf), pos)
+
+	// Truncated record
+	_, _, ok := f.NextRecord(buf[:len(buf)-1], last)
+	assert.False(t, ok)
+}
+
+// Test searching the length-prefixed testdata/lenprefix.bin, whose
+// records have embedded newlines
+func TestSearcherLengthPrefixed(t *testing.T) {
+	var tests = []struct {
+		key    string
+		expect []string
+	}{
+		{"key000", []string{"key000,value 0-0\nline two"}},
+		{"key050", []string{
+			"key050,value 50-0\nline two",
+			"key050,value 50-1\nline two",
+			"key050,value 50-2\nline two",
+		}},
+		{"key123", []string{"key123,value 123-0\nline two"}},
+		{"key199", []string{"key199,value 199-0\nline two"}},
+		{"key200", []string{"key200," + strings.Repeat("x", 200)}},
+	}
+
+	s, err := NewSearcherOptions("testdata/lenprefix.bin", SearcherOptions{
+		Delimiter: []byte{','},
+		Framer:    LengthPrefixFramer{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range tests {
+		lines, err := s.Lines([]byte(tc.key))
+		if err != nil {
+			t.Fatalf("%s: %s\n", tc.key, err.Error())
+		}
+		got := make([]string, len(lines))
+		for i, line := range lines {
+			got[i] = string(line)
+		}
+		assert.Equal(t, tc.expect, got, tc.key)
+	}
+	assert.True(t, len(s.Index.List) > 1, "multiple index blocks")
+
+	for _, key := range []string{"key", "key05", "key0500", "key201", "value"} {
+		_, err = s.Line([]byte(key))
+		assert.Equal(t, ErrNotFound, err, key)
+	}
+
+	lines, err := s.LinesPrefixSuffix([]byte("key1"), []byte("9"))
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(lines))
+
+	_, err = s.LineRange(0, 1)
+	assert.ErrorIs(t, err, ErrFramerUnsupported)
+}
+
+func TestIndexLengthPrefixedTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, err := ioutil.ReadFile("testdata/lenprefix.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "truncated.bin")
+	err = ioutil.WriteFile(path, data[:len(data)-1], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewIndexOptions(path, IndexOptions{
+		Delimiter: []byte{','},
+		Framer:    LengthPrefixFramer{},
+	})
+	assert.ErrorIs(t, err, ErrRecordTruncated)
+}
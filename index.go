@@ -12,10 +12,14 @@ package bsearch
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -30,40 +34,210 @@ const (
 	indexVersion     = 2
 	indexSuffix      = "bsx"
 	defaultBlocksize = 2048
+	// AutoBlocksize settings
+	defaultLinesPerBlock = 16
+	autoBlocksizeSample  = 64 * 1024
+	autoBlocksizeMin     = 256
+	autoBlocksizeMax     = 1024 * 1024
+	// Lines sampled to check the delimiter occurs in the dataset
+	delimiterSampleLines = 100
 )
 
 var (
-	ErrIndexNotFound     = errors.New("index file not found")
-	ErrIndexExpired      = errors.New("index file out of date")
-	ErrIndexEmpty        = errors.New("index contains no entries")
-	ErrIndexPathMismatch = errors.New("index file path mismatch")
+	ErrIndexNotFound           = errors.New("index file not found")
+	ErrIndexExpired            = errors.New("index file out of date")
+	ErrIndexEmpty              = errors.New("index contains no entries")
+	ErrIndexPathMismatch       = errors.New("index file path mismatch")
+	ErrIndexDuplicateEntry     = errors.New("duplicate index entry")
+	ErrIndexCorrupt            = errors.New("index is corrupt")
+	ErrIndexInvalid            = errors.New("index validation failed")
+	ErrUnsorted                = errors.New("data is not sorted")
+	ErrNoDelimiter             = errors.New("line without delimiter found")
+	ErrIndexVersionUnsupported = errors.New("index version not supported")
+	ErrDuplicateKey            = errors.New("duplicate key")
+	ErrDelimiterNotFound       = errors.New("delimiter not found in dataset")
+	ErrIndexChecksumMismatch   = errors.New("index checksum mismatch")
+	ErrIndexCompressionUnknown = errors.New("unknown index compression")
+	ErrIndexFormatUnknown      = errors.New("unknown index format")
 )
 
+// Index file compression options (see IndexOptions.Compression)
+const (
+	IndexCompressionZstd = "zstd"
+	IndexCompressionNone = "none"
+)
+
+// Index file formats (see IndexOptions.Format)
+const (
+	IndexFormatYAML   = "yaml"
+	IndexFormatJSON   = "json"
+	IndexFormatBinary = "binary"
+)
+
+// zstdMagic is the magic number beginning zstd frames
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
 type IndexOptions struct {
 	Blocksize int
 	Delimiter []byte
 	Header    bool
 	Logger    *zerolog.Logger // debug logger
+	// Return ErrIndexDuplicateEntry if a key's lines span a block boundary,
+	// so that the later block would begin with the same key as the entry
+	// before it. Such duplicate entries are otherwise skipped, keeping only
+	// the key's first entry (as KeysIndexFirst indexes require), which is
+	// valid but makes lookups on that key scan multiple blocks.
+	DuplicateEntryError bool
+	// Trim leading and trailing ASCII spaces from keys (the dataset must
+	// be sorted on the trimmed keys)
+	TrimKeySpace bool
+	// Return an error if the generated index fails validation (by default
+	// validation failures are just logged), and also check that each entry
+	// is at the start of a line beginning with its key (which reads the
+	// dataset at every entry offset, so is skipped by default)
+	StrictValidate bool
+	// If AutoBlocksize is set (and Blocksize is not), choose a blocksize
+	// by sampling the start of the dataset, targeting LinesPerBlock lines
+	// per block (default 16). As with explicit blocksizes, indexing fails
+	// if a line longer than the chosen blocksize is found later.
+	AutoBlocksize bool
+	LinesPerBlock int
+	// Compare, if set, is used to compare keys instead of bytes.Compare
+	// (e.g. a collation comparison from NewCollationCompare). The dataset
+	// must be sorted using the same comparison.
+	Compare func(a, b []byte) int
+	// Record the number of lines in each block, for ordinal line access
+	// via Searcher.LineRange
+	LineCounts bool
+	// SortKeyColumn, if set, is the (0-based) column the dataset is sorted
+	// on and indexed by, instead of the first column (e.g. a column of
+	// precomputed, byte-comparable locale sort keys)
+	SortKeyColumn int
+	// Framer, if set, frames dataset records instead of newline-terminated
+	// lines (e.g. LengthPrefixFramer). As with Compare, the framer is not
+	// recorded in the index, so must also be given to searchers.
+	Framer RecordFramer
+	// Return ErrDuplicateKey on the first duplicate key found (instead of
+	// just setting KeysUnique to false), for datasets that must have
+	// unique keys. This is enforced as part of the line-by-line scan done
+	// by index generation.
+	RequireUnique bool
+	// CompactKeys stores all index entry keys in a single contiguous
+	// allocation (as substrings of one string), rather than one allocation
+	// per key, reducing memory overhead and GC pressure for indexes with
+	// very many entries. Note that retaining any entry Key then retains
+	// the memory for all keys.
+	CompactKeys bool
+	// KeyFunc, if set, extracts the key from each line instead of taking
+	// the leading delimited field (or SortKeyColumn), e.g. for keys at a
+	// fixed column range. The dataset must be sorted by the keys KeyFunc
+	// returns (after TrimKeySpace, if set), and KeyFunc must not modify
+	// or retain line. As with Compare, KeyFunc is not recorded in the
+	// index, so must also be given to searchers.
+	KeyFunc func(line []byte) []byte
+	// Descending is set for datasets sorted in descending key order (e.g.
+	// by sort -r), reversing the key comparison (bytes.Compare, or Compare
+	// if set). It is recorded in the index.
+	Descending bool
+	// CSVQuoting parses line keys as CSV fields, so that a key field
+	// beginning with a double quote ends at the closing quote (and may
+	// contain the delimiter), with the quotes removed and doubled quotes
+	// unescaped. Index entries, and the keys searches are compared with,
+	// are then the unquoted keys, so the dataset must be sorted by them.
+	// Since matching lines can no longer be found by comparing the search
+	// key with the start of each line, each line key is extracted in
+	// full, which is slower than raw delimiter splitting. Unquoted keys
+	// are handled as usual. It is recorded in the index.
+	CSVQuoting bool
+	// Concurrency, if greater than 1, generates the index using up to
+	// Concurrency goroutines, each scanning a separate region of the
+	// dataset, for faster indexing of large datasets. The index generated
+	// is identical to a sequential one. Compare and KeyFunc must then be
+	// safe for concurrent use. Concurrency is ignored with a Framer.
+	Concurrency int
+	// Checksum records a checksum of the dataset (a hash of its size and
+	// first and last blocks) in the index, which LoadIndex verifies, to
+	// detect datasets changed without their modtime changing (e.g. when
+	// restored from a backup). LoadIndex then returns
+	// ErrIndexChecksumMismatch if the dataset no longer matches.
+	Checksum bool
+	// Compression is the index file compression, IndexCompressionZstd
+	// (the default) or IndexCompressionNone, for plain yaml index files
+	// that can be inspected with standard tools. LoadIndex detects the
+	// compression used, so both can always be loaded.
+	Compression string
+	// Format is the index file serialisation, IndexFormatYAML (the
+	// default), IndexFormatJSON, which is much faster to load for indexes
+	// with very many entries, or IndexFormatBinary, which is faster and
+	// smaller again (see binindex.go). LoadIndex detects the format used.
+	Format string
 }
 
 type IndexEntry struct {
-	Key    string `yaml:"k"`
-	Offset int64  `yaml:"o"` // file offset for start-of-block
+	Key       string `yaml:"k" json:"k"`
+	Offset    int64  `yaml:"o" json:"o"`                     // file offset for start-of-block
+	LineCount int64  `yaml:"l,omitempty" json:"l,omitempty"` // lines in block (if Index.LineCounts)
+}
+
+// KeyRange is the range of keys [First, Next) covered by an index block.
+// Next is empty for the final block.
+type KeyRange struct {
+	First  string
+	Next   string
+	Offset int64 // file offset for start-of-block
+}
+
+// IndexStats summarises the distribution of index block lengths (see
+// Index.Stats), e.g. for choosing a blocksize. Block lengths are derived
+// from consecutive entry offsets, so exclude the final block, whose length
+// depends on the dataset size.
+type IndexStats struct {
+	Entries        int     // number of index entries (blocks)
+	MinLength      int64   // minimum block length in bytes
+	MaxLength      int64   // maximum block length in bytes
+	MeanLength     float64 // mean block length in bytes
+	StddevLength   float64 // (population) standard deviation of block lengths
+	ZeroLength     int     // number of zero-length blocks
+	KeysUnique     bool
+	KeysIndexFirst bool
 }
 
 // Index provides index metadata for the Filepath dataset
 type Index struct {
-	Blocksize      int             `yaml:"blocksize"`
-	Delimiter      []byte          `yaml:"delim"`
-	Epoch          int64           `yaml:"epoch"`
-	Filepath       string          `yaml:"filepath"`
-	Header         bool            `yaml:"header"`
-	KeysIndexFirst bool            `yaml:"keys_index_first"`
-	KeysUnique     bool            `yaml:"keys_unique"`
-	Length         int             `yaml:"length"`
-	List           []IndexEntry    `yaml:"list"`
-	Version        int             `yaml:"version"`
+	Blocksize      int             `yaml:"blocksize" json:"blocksize"`
+	Delimiter      []byte          `yaml:"delim" json:"delim"`
+	Epoch          int64           `yaml:"epoch" json:"epoch"`
+	Filepath       string          `yaml:"filepath" json:"filepath"`
+	Header         bool            `yaml:"header" json:"header"`
+	HeaderText     string          `yaml:"header_text,omitempty" json:"header_text,omitempty"`
+	ColumnNames    []string        `yaml:"columns,omitempty" json:"columns,omitempty"`
+	KeysIndexFirst bool            `yaml:"keys_index_first" json:"keys_index_first"`
+	KeysUnique     bool            `yaml:"keys_unique" json:"keys_unique"`
+	TrimKeySpace   bool            `yaml:"trim_key_space,omitempty" json:"trim_key_space,omitempty"`
+	LineCounts     bool            `yaml:"line_counts,omitempty" json:"line_counts,omitempty"`
+	SortKeyColumn  int             `yaml:"sort_key_column,omitempty" json:"sort_key_column,omitempty"`
+	Descending     bool            `yaml:"descending,omitempty" json:"descending,omitempty"`
+	CSVQuoting     bool            `yaml:"csv_quoting,omitempty" json:"csv_quoting,omitempty"`
+	Checksum       uint64          `yaml:"checksum,omitempty" json:"checksum,omitempty"`
+	Length         int             `yaml:"length" json:"length"`
+	List           []IndexEntry    `yaml:"list" json:"list"`
+	Version        int             `yaml:"version" json:"version"`
 	logger         *zerolog.Logger // debug logger
+	dupEntryError  bool            // return an error on duplicate entries
+	requireUnique  bool            // return an error on duplicate keys
+
+	// key comparison function (default bytes.Compare)
+	compare func(a, b []byte) int
+	// cumulative line counts (ordinal of the first line of each block)
+	lineStarts []int64
+	// record framer (default newline-terminated lines)
+	framer RecordFramer
+	// key extraction function (default the key field)
+	keyFunc func(line []byte) []byte
+	// index file compression (default IndexCompressionZstd)
+	compression string
+	// index file format (default IndexFormatYAML)
+	format string
 }
 
 // epoch returns the modtime for path in epoch/unix format
@@ -75,6 +249,39 @@ func epoch(path string) (int64, error) {
 	return stat.ModTime().Unix(), nil
 }
 
+// dataChecksum returns a checksum of the size bytes of dataset read by
+// reader, hashing its size and its first and last blocksize bytes (so is
+// fast, but does not detect changes within the middle of the dataset)
+func dataChecksum(reader io.ReaderAt, size int64, blocksize int) (uint64, error) {
+	h := fnv.New64a()
+	var sizebuf [8]byte
+	binary.BigEndian.PutUint64(sizebuf[:], uint64(size))
+	h.Write(sizebuf[:])
+
+	// Hash the first block, and the last block (if distinct)
+	regions := [][2]int64{{0, int64(blocksize)}}
+	if size > int64(blocksize) {
+		start := size - int64(blocksize)
+		if start < int64(blocksize) {
+			start = int64(blocksize)
+		}
+		regions = append(regions, [2]int64{start, size})
+	}
+	buf := make([]byte, blocksize)
+	for _, region := range regions {
+		end := region[1]
+		if end > size {
+			end = size
+		}
+		n, err := reader.ReadAt(buf[:end-region[0]], region[0])
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		h.Write(buf[:n])
+	}
+	return h.Sum64(), nil
+}
+
 // indexFile returns the index file associated with filename
 func indexFile(filename string) string {
 	reDot := regexp.MustCompile(`\.`)
@@ -82,15 +289,32 @@ func indexFile(filename string) string {
 	return basename + "." + indexSuffix
 }
 
+// IndexPathFunc returns the filepath of the index associated with the
+// dataset at dataPath (an absolute path), and is used by IndexPath, and
+// so by LoadIndex, Index.Write, and searchers. It defaults to
+// DefaultIndexPath, and may be replaced to relocate indexes (e.g. to a
+// writable cache directory mirroring a read-only data tree - note that
+// Index.Write does not create missing directories). Access to it is not
+// synchronised, so it must only be set during initialisation (e.g. in an
+// init function), before any indexes are loaded or written.
+var IndexPathFunc = DefaultIndexPath
+
+// DefaultIndexPath returns the default filepath of the index associated
+// with the dataset at dataPath, which is alongside the dataset
+func DefaultIndexPath(dataPath string) (string, error) {
+	dir, base := filepath.Split(dataPath)
+	return filepath.Join(dir, indexFile(base)), nil
+}
+
 // IndexPath returns the filepath of the index assocated with path
+// (see IndexPathFunc)
 func IndexPath(path string) (string, error) {
 	var err error
 	path, err = filepath.Abs(path)
 	if err != nil {
 		return "", err
 	}
-	dir, base := filepath.Split(path)
-	return filepath.Join(dir, indexFile(base)), nil
+	return IndexPathFunc(path)
 }
 
 // deriveDelimiter tries to guess an appropriate delimiter from filename
@@ -111,6 +335,80 @@ func deriveDelimiter(filename string) ([]byte, error) {
 	return []byte{}, ErrUnknownDelimiter
 }
 
+// checkDelimiter samples the first delimiterSampleLines lines of reader
+// (within the first autoBlocksizeSample bytes), and returns an
+// ErrDelimiterNotFound error if delim occurs in none of them (which
+// usually means the wrong delimiter has been configured)
+func checkDelimiter(reader io.ReaderAt, delim []byte) error {
+	buf := make([]byte, autoBlocksizeSample)
+	n, err := reader.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	buf = buf[:n]
+	if len(buf) == 0 {
+		// Empty datasets are reported by index generation
+		return nil
+	}
+
+	for i := 0; i < delimiterSampleLines && len(buf) > 0; i++ {
+		line := buf
+		if nlidx := bytes.IndexByte(buf, '\n'); nlidx > -1 {
+			line = buf[:nlidx]
+			buf = buf[nlidx+1:]
+		} else {
+			buf = nil
+		}
+		if bytes.Contains(line, delim) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q not found in first %d lines",
+		ErrDelimiterNotFound, delim, delimiterSampleLines)
+}
+
+// autoBlocksize samples the initial lines of reader, and returns a
+// blocksize that should hold approximately linesPerBlock lines, rounded
+// up to a multiple of autoBlocksizeMin, and at least twice the length
+// of the longest sampled line.
+func autoBlocksize(reader io.ReaderAt, linesPerBlock int) (int, error) {
+	if linesPerBlock <= 0 {
+		linesPerBlock = defaultLinesPerBlock
+	}
+	buf := make([]byte, autoBlocksizeSample)
+	n, err := reader.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	buf = buf[:n]
+
+	// Only consider complete lines
+	if nlidx := bytes.LastIndexByte(buf, '\n'); nlidx > -1 {
+		buf = buf[:nlidx+1]
+	}
+	lines := bytes.Count(buf, []byte{'\n'})
+	if lines == 0 {
+		return defaultBlocksize, nil
+	}
+	longest := 0
+	for _, line := range bytes.Split(buf[:len(buf)-1], []byte{'\n'}) {
+		if len(line)+1 > longest {
+			longest = len(line) + 1
+		}
+	}
+
+	blocksize := len(buf) / lines * linesPerBlock
+	if blocksize < 2*longest {
+		blocksize = 2 * longest
+	}
+	// Round up to a multiple of autoBlocksizeMin
+	blocksize = (blocksize + autoBlocksizeMin - 1) / autoBlocksizeMin * autoBlocksizeMin
+	if blocksize > autoBlocksizeMax {
+		blocksize = autoBlocksizeMax
+	}
+	return blocksize, nil
+}
+
 // generateLineIndex processes the input from reader line-by-line,
 // generating index entries for the first full line in each block
 // (or the first instance of that key, if repeating)
@@ -119,100 +417,424 @@ func generateLineIndex(index *Index, reader io.ReaderAt) error {
 	buf := make([]byte, index.Blocksize)
 	scanner := bufio.NewScanner(reader.(io.Reader))
 	scanner.Buffer(buf, index.Blocksize)
-	list := []IndexEntry{}
-	var blockPosition int64 = 0
-	var blockNumber int64 = -1
-	prevKey := []byte{}
-	var firstOffset int64 = -1
-	index.KeysUnique = true
+	// With a custom framer, record positions are set by the split function
+	var recordPosition int64
+	if index.framer != nil {
+		scanner.Split(framerSplit(index.framer, &recordPosition))
+	}
+	li := newLineIndexer(index)
+	var blockPosition, lineIndex int64
 	// If index.Header is set, skip the first line of the dataset,
 	// begin indexing from the second
 	skipHeader := index.Header
 	for scanner.Scan() {
 		line := scanner.Bytes()
+		if index.framer != nil {
+			blockPosition = recordPosition
+		}
 
 		if skipHeader {
 			skipHeader = false
+			index.setHeader(line)
 			blockPosition += int64(len(line) + 1)
 			continue
 		}
+		if blockPosition == 0 {
+			li.firstLine = clonebs(line)
+		}
 
-		elt := bytes.SplitN(line, index.Delimiter, 2)
-		key := elt[0]
-		if index.logger != nil {
-			index.logger.Debug().
-				Int64("blockNumber", blockNumber).
-				Int64("blockPosition", blockPosition).
+		key, hasKey := index.lineKey(line)
+		err := li.add(&lineEvent{
+			line:      line,
+			key:       key,
+			hasKey:    hasKey,
+			pos:       blockPosition,
+			lineIndex: lineIndex,
+			runStart:  -1,
+		})
+		if err != nil {
+			return err
+		}
+		blockPosition += int64(len(line) + 1)
+		lineIndex++
+	}
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			return fmt.Errorf("%w: line at offset %d is longer than blocksize %d",
+				ErrKeyExceedsBlocksize, blockPosition, index.Blocksize)
+		}
+		return err
+	}
+	return li.finish(lineIndex)
+}
+
+// lineKey returns the index key of dataset line, and false if the line
+// has no key field (i.e. no delimiter)
+func (i *Index) lineKey(line []byte) ([]byte, bool) {
+	key, hasKey := line, false
+	if i.CSVQuoting {
+		key, hasKey = csvKeyField(line, i.Delimiter, i.SortKeyColumn)
+	} else if d := bytes.Index(line, i.Delimiter); d > -1 {
+		key, hasKey = line[:d], true
+	}
+	if i.SortKeyColumn > 0 && !i.CSVQuoting {
+		key, hasKey = keyField(line, i.Delimiter, i.SortKeyColumn)
+	}
+	if i.keyFunc != nil {
+		key, hasKey = i.keyFunc(line), true
+	}
+	if i.TrimKeySpace {
+		key = bytes.Trim(key, " ")
+	}
+	return key, hasKey
+}
+
+// numericDisorder returns true if bytewise-ordered keys prevKey and key
+// are out of numeric order (see CompareNumeric), when that is worth
+// warning about (i.e. the index has a logger and no custom comparison)
+func (i *Index) numericDisorder(prevKey, key []byte) bool {
+	if i.compare != nil || i.logger == nil {
+		return false
+	}
+	cmp := CompareNumeric(prevKey, key)
+	if i.Descending {
+		cmp = -cmp
+	}
+	return cmp > 0
+}
+
+// lineEvent is a dataset line processed by lineIndexer.add
+type lineEvent struct {
+	line      []byte // the line (only required if !hasKey)
+	key       []byte
+	hasKey    bool
+	pos       int64 // line offset
+	lineIndex int64 // data line ordinal (excluding any declared header)
+	// If cmpKnown, cmp is the comparison of the key of the previous line
+	// with key (prevKey), and numeric is the result of numericDisorder for
+	// them. Otherwise they are derived from the last key added.
+	cmpKnown bool
+	cmp      int
+	prevKey  []byte
+	numeric  bool
+	// Offset and ordinal of the first line of the run of lines with keys
+	// equal to key, if known (-1 otherwise)
+	runStart      int64
+	runStartIndex int64
+}
+
+// lineIndexer generates index entries from the dataset lines added to it,
+// in order. Lines that cannot affect the index (see generateLineIndexParallel)
+// may be omitted, provided the lines added carry cmp and run details.
+type lineIndexer struct {
+	index       *Index
+	list        []IndexEntry
+	lineNumbers []int64 // data line ordinals of entries, for line counts
+	blockNumber int64
+	prevKey     []byte // nil until the first key (which may be empty)
+	// offset and ordinal of the first line with the current key
+	firstOffset    int64
+	firstLineIndex int64
+	// ordinal of the first data line (which changes if the first line
+	// turns out to be a header)
+	lineBase      int64
+	firstLine     []byte
+	firstLineErr  error
+	numericWarned bool
+}
+
+func newLineIndexer(index *Index) *lineIndexer {
+	index.KeysUnique = true
+	return &lineIndexer{
+		index:       index,
+		list:        []IndexEntry{},
+		lineNumbers: []int64{},
+		blockNumber: -1,
+		firstOffset: -1,
+	}
+}
+
+// add processes the dataset line ev
+func (li *lineIndexer) add(ev *lineEvent) error {
+	index := li.index
+	key := ev.key
+	if !ev.hasKey {
+		// A data line without a delimiter usually means the previous
+		// key contains an embedded newline, which would corrupt lookups
+		err := fmt.Errorf("%w at offset %d (embedded newline in key?): %q",
+			ErrNoDelimiter, ev.pos, ev.line)
+		if ev.pos > 0 {
+			return err
+		}
+		// The first line may turn out to be a header, so defer
+		li.firstLineErr = err
+	}
+	if index.logger != nil {
+		index.logger.Debug().
+			Int64("blockNumber", li.blockNumber).
+			Int64("blockPosition", ev.pos).
+			Bytes("prevKey", li.prevKey).
+			Bytes("key", key).
+			Msg("generateLineIndex loop")
+	}
+
+	// Check key ordering
+	prevKey := li.prevKey
+	cmp := -1
+	numeric := false
+	if ev.cmpKnown {
+		cmp = ev.cmp
+		numeric = ev.numeric
+		if ev.prevKey != nil {
+			prevKey = ev.prevKey
+		}
+	} else if prevKey != nil {
+		cmp = index.compareKeys(prevKey, key)
+		numeric = cmp == -1 && !li.numericWarned && index.numericDisorder(prevKey, key)
+	}
+	dupKeyBlock := false
+	switch cmp {
+	case -1:
+		// Warn (once) if bytewise-sorted keys are out of numeric order
+		// (e.g. unpadded integers, where 10 < 2), which usually means
+		// the dataset should have been sorted with CompareNumeric
+		if numeric && !li.numericWarned {
+			li.numericWarned = true
+			index.logger.Warn().
 				Bytes("prevKey", prevKey).
 				Bytes("key", key).
-				Msg("generateLineIndex loop")
-		}
-
-		// Check key ordering
-		dupKeyBlock := false
-		switch bytes.Compare(prevKey, key) {
-		case 1:
-			// Special case - allow second record out-of-order due to header
-			// FIXME: should we have an option to disallow this?
-			if blockNumber == 0 && !index.Header {
-				index.Header = true
-				// Reset list and blockNumber to restart
-				list = []IndexEntry{}
-				blockNumber = -1
-			} else {
-				// prevKey > key
-				return fmt.Errorf("Error: key sort violation - %q > %q\n",
-					prevKey, key)
-			}
-		case 0:
-			// prevKey == key
-			index.KeysUnique = false
-			dupKeyBlock = true
-		}
-
-		// Add the first line of each block to our index
-		currentBlockNumber := blockPosition / int64(index.Blocksize)
-		if currentBlockNumber > blockNumber {
-			offset := blockPosition
-			if dupKeyBlock {
-				offset = firstOffset
-			}
+				Int64("blockPosition", ev.pos).
+				Msg("keys are sorted bytewise but not numerically - use CompareNumeric for unpadded numeric keys?")
+		}
+	case 1:
+		// Special case - allow second record out-of-order due to header
+		// FIXME: should we have an option to disallow this?
+		if li.blockNumber == 0 && !index.Header {
+			index.Header = true
+			index.setHeader(li.firstLine)
+			li.firstLineErr = nil
+			// Reset list and blockNumber to restart
+			li.list = []IndexEntry{}
+			li.lineNumbers = []int64{}
+			li.lineBase = ev.lineIndex
+			li.blockNumber = -1
+		} else {
+			// prevKey > key
+			return fmt.Errorf("Error: key sort violation - %q > %q\n",
+				prevKey, key)
+		}
+	case 0:
+		// prevKey == key
+		if index.requireUnique {
+			return fmt.Errorf("%w %q at offset %d", ErrDuplicateKey, key, ev.pos)
+		}
+		index.KeysUnique = false
+		dupKeyBlock = true
+		if ev.runStart >= 0 {
+			// The run began with a line that was not added
+			li.firstOffset = ev.runStart
+			li.firstLineIndex = ev.runStartIndex
+			li.prevKey = clonebs(key)
+		}
+	}
+	if li.firstLineErr != nil && ev.pos > 0 {
+		return li.firstLineErr
+	}
+
+	// Add the first line of each block to our index
+	currentBlockNumber := ev.pos / int64(index.Blocksize)
+	if currentBlockNumber > li.blockNumber {
+		offset := ev.pos
+		offsetLineIndex := ev.lineIndex
+		if dupKeyBlock {
+			offset = li.firstOffset
+			offsetLineIndex = li.firstLineIndex
+		}
 
-			var last_offset int64 = -1
-			if len(list) > 0 {
-				last_offset = list[len(list)-1].Offset
+		var last_offset int64 = -1
+		if len(li.list) > 0 {
+			last_offset = li.list[len(li.list)-1].Offset
+		}
+		if last_offset != offset {
+			entry := IndexEntry{
+				Key:    string(key),
+				Offset: offset,
 			}
-			if last_offset != offset {
-				entry := IndexEntry{
-					Key:    string(key),
-					Offset: offset,
-				}
-				list = append(list, entry)
+			li.list = append(li.list, entry)
+			li.lineNumbers = append(li.lineNumbers, offsetLineIndex-li.lineBase)
+		} else {
+			// Key spans multiple blocks - skip the repeated entry
+			if index.dupEntryError {
+				return fmt.Errorf("%w: key %q spans block %d (entry offset %d)",
+					ErrIndexDuplicateEntry, key, currentBlockNumber, offset)
+			}
+			if index.logger != nil {
+				index.logger.Debug().
+					Int64("blockNumber", currentBlockNumber).
+					Int64("offset", offset).
+					Bytes("key", key).
+					Msg("skipping duplicate index entry")
 			}
-
-			blockNumber = currentBlockNumber
 		}
 
-		if !dupKeyBlock {
-			firstOffset = blockPosition
-			prevKey = clonebs(key)
-		}
-		blockPosition += int64(len(line) + 1)
+		li.blockNumber = currentBlockNumber
 	}
-	if err := scanner.Err(); err != nil {
-		return err
+
+	if !dupKeyBlock {
+		li.firstOffset = ev.pos
+		li.firstLineIndex = ev.lineIndex
+		li.prevKey = clonebs(key)
 	}
+	return nil
+}
+
+// finish sets the generated entries on the index, given the total number
+// of data lines processed
+func (li *lineIndexer) finish(lines int64) error {
+	index := li.index
+	if li.firstLineErr != nil {
+		return li.firstLineErr
+	}
+	list := li.list
 	if len(list) == 0 {
 		return ErrIndexEmpty
 	}
 
+	if index.LineCounts {
+		lineNumber := lines - li.lineBase
+		for n := range list {
+			next := lineNumber
+			if n+1 < len(list) {
+				next = li.lineNumbers[n+1]
+			}
+			list[n].LineCount = next - li.lineNumbers[n]
+		}
+	}
+
 	index.KeysIndexFirst = true
 	index.List = list
 	index.Length = len(list)
+	index.setLineStarts()
 
 	return nil
 }
 
+// keyField returns the column'th field (0-based) of line, split on delim,
+// or false if line has too few fields
+func keyField(line, delim []byte, column int) ([]byte, bool) {
+	for ; column > 0; column-- {
+		d := bytes.Index(line, delim)
+		if d == -1 {
+			return nil, false
+		}
+		line = line[d+len(delim):]
+	}
+	if d := bytes.Index(line, delim); d > -1 {
+		line = line[:d]
+	}
+	return line, true
+}
+
+// csvKeyField returns the column'th (0-based) field of line as for
+// keyField, but with fields parsed as CSV fields (see csvField). As for
+// Index.lineKey, a leading field (column 0) is only reported as found if
+// it is followed by the delimiter.
+func csvKeyField(line, delim []byte, column int) ([]byte, bool) {
+	found := column > 0
+	for ; column > 0; column-- {
+		_, rest, ok := csvField(line, delim)
+		if !ok {
+			return nil, false
+		}
+		line = rest
+	}
+	field, _, ok := csvField(line, delim)
+	return field, found || ok
+}
+
+// csvField returns the leading CSV field of line, and the remainder of
+// line after the delimiter following it (and whether there was one). A
+// field beginning with a double quote ends at the closing quote, and is
+// returned without the quotes and with doubled quotes unescaped (the
+// field is only copied if there are doubled quotes). Malformed quoted
+// fields (unterminated, or followed by anything but the delimiter) are
+// treated as unquoted.
+func csvField(line, delim []byte) (field, rest []byte, ok bool) {
+	if len(line) > 0 && line[0] == '"' {
+		var unescaped []byte
+		start := 1
+		for {
+			q := bytes.IndexByte(line[start:], '"')
+			if q == -1 {
+				break
+			}
+			end := start + q
+			if end+1 < len(line) && line[end+1] == '"' {
+				// Doubled quote
+				unescaped = append(unescaped, line[start:end+1]...)
+				start = end + 2
+				continue
+			}
+			field = line[1:end]
+			if unescaped != nil {
+				field = append(unescaped, line[start:end]...)
+			}
+			after := line[end+1:]
+			if len(after) == 0 {
+				return field, nil, false
+			}
+			if bytes.HasPrefix(after, delim) {
+				return field, after[len(delim):], true
+			}
+			break
+		}
+	}
+	if d := bytes.Index(line, delim); d > -1 {
+		return line[:d], line[d+len(delim):], true
+	}
+	return line, nil, false
+}
+
+// setHeader records the header line text and column names on index
+func (i *Index) setHeader(line []byte) {
+	i.HeaderText = string(line)
+	i.ColumnNames = strings.Split(i.HeaderText, string(i.Delimiter))
+}
+
+// Columns returns the dataset column names from the header line, if the
+// dataset has a header and it was recorded by the index (indexes created
+// by older versions of bsearch do not include one).
+func (i *Index) Columns() []string {
+	return i.ColumnNames
+}
+
+// setLineStarts caches blockLineStarts for indexes with line counts. It is
+// called when an index is generated or loaded, so that concurrent lookups
+// only ever read the cache.
+func (i *Index) setLineStarts() {
+	i.lineStarts = nil
+	if i.LineCounts {
+		i.lineStarts = i.countLineStarts()
+	}
+}
+
+// blockLineStarts returns the ordinal of the first data line in each
+// index block (plus a final total), derived from the entry LineCounts
+func (i *Index) blockLineStarts() []int64 {
+	if i.lineStarts != nil {
+		return i.lineStarts
+	}
+	return i.countLineStarts()
+}
+
+func (i *Index) countLineStarts() []int64 {
+	lineStarts := make([]int64, len(i.List)+1)
+	for n, entry := range i.List {
+		lineStarts[n+1] = lineStarts[n] + entry.LineCount
+	}
+	return lineStarts
+}
+
 // NewIndex creates a new Index for the path dataset
 func NewIndex(path string) (*Index, error) {
 	return NewIndexOptions(path, IndexOptions{})
@@ -225,15 +847,37 @@ func NewIndexOptions(path string, opt IndexOptions) (*Index, error) {
 	if err != nil {
 		return nil, err
 	}
-	reader, err := os.Open(path)
+	fh, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
+	defer fh.Close()
 	epoch, err := epoch(path)
 	if err != nil {
 		return nil, err
 	}
+	stat, err := fh.Stat()
+	if err != nil {
+		return nil, err
+	}
+	index, err := newIndexSection(path, epoch, io.NewSectionReader(fh, 0, stat.Size()), opt)
+	if err != nil {
+		return nil, err
+	}
+	if opt.Checksum {
+		index.Checksum, err = dataChecksum(fh, stat.Size(), index.Blocksize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return index, nil
+}
 
+// newIndexSection creates a new Index for path from the dataset section
+// read by reader (the whole dataset, or the region of a live dataset
+// being indexed, see LiveSearcher)
+func newIndexSection(path string, epoch int64, reader *io.SectionReader, opt IndexOptions) (*Index, error) {
+	var err error
 	delim := opt.Delimiter
 	if len(delim) == 0 {
 		delim, err = deriveDelimiter(path)
@@ -242,9 +886,28 @@ func NewIndexOptions(path string, opt IndexOptions) (*Index, error) {
 		}
 	}
 
+	// With a KeyFunc, keys are not delimited fields, so the delimiter
+	// need not occur
+	if opt.KeyFunc == nil {
+		err = checkDelimiter(reader, delim)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = checkIndexEncoding(opt)
+	if err != nil {
+		return nil, err
+	}
+
 	index := Index{}
 	if opt.Blocksize > 0 {
 		index.Blocksize = opt.Blocksize
+	} else if opt.AutoBlocksize {
+		index.Blocksize, err = autoBlocksize(reader, opt.LinesPerBlock)
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		index.Blocksize = defaultBlocksize
 	}
@@ -257,19 +920,200 @@ func NewIndexOptions(path string, opt IndexOptions) (*Index, error) {
 	if opt.Logger != nil {
 		index.logger = opt.Logger
 	}
+	index.dupEntryError = opt.DuplicateEntryError
+	index.requireUnique = opt.RequireUnique
+	index.TrimKeySpace = opt.TrimKeySpace
+	index.compare = opt.Compare
+	index.LineCounts = opt.LineCounts
+	index.SortKeyColumn = opt.SortKeyColumn
+	index.framer = opt.Framer
+	index.keyFunc = opt.KeyFunc
+	index.Descending = opt.Descending
+	index.CSVQuoting = opt.CSVQuoting
+	index.compression = opt.Compression
+	index.format = opt.Format
 
-	err = generateLineIndex(&index, reader)
+	if opt.Concurrency > 1 && index.framer == nil {
+		err = generateLineIndexParallel(&index, reader, opt.Concurrency)
+	} else {
+		err = generateLineIndex(&index, reader)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if opt.CompactKeys {
+		index.compactKeys()
+	}
+
+	// Sanity check the generated index
+	err = index.validate(reader, reader.Size(), opt.StrictValidate)
+	if err != nil {
+		if opt.StrictValidate {
+			return nil, err
+		}
+		if index.logger != nil {
+			index.logger.Warn().
+				Str("path", path).
+				Err(err).
+				Msg("index validation failed")
+		}
+	}
 
 	return &index, nil
 }
 
+// validate checks that index entries are ordered, that their offsets are
+// increasing and within the dataset, and that the first entry is at the
+// start of the dataset. If checkLines is set, it also reads the dataset to
+// check that each entry offset is the start of a line beginning with the
+// entry key, and that only the header line (if any) precedes the first
+// entry. Returns an ErrIndexInvalid error describing the first failure
+// found.
+func (i *Index) validate(reader io.ReaderAt, filesize int64, checkLines bool) error {
+	if len(i.List) == 0 {
+		return ErrIndexEmpty
+	}
+	if !i.Header && i.List[0].Offset != 0 {
+		return fmt.Errorf("%w: first entry (%q) offset %d is not at start of dataset",
+			ErrIndexInvalid, i.List[0].Key, i.List[0].Offset)
+	}
+
+	for n, entry := range i.List {
+		// Each block must end after it begins (at the next offset, or EOF)
+		end := filesize
+		if n+1 < len(i.List) {
+			end = i.List[n+1].Offset
+		}
+		if entry.Offset < 0 || entry.Offset >= end {
+			return fmt.Errorf("%w: entry %d (%q) offset %d not before block end %d",
+				ErrIndexInvalid, n, entry.Key, entry.Offset, end)
+		}
+		if n > 0 && i.compareKeys([]byte(entry.Key), []byte(i.List[n-1].Key)) < 0 {
+			return fmt.Errorf("%w: entry %d key %q < previous key %q",
+				ErrIndexInvalid, n, entry.Key, i.List[n-1].Key)
+		}
+
+		// Line checks do not apply to records with custom framing
+		if !checkLines || i.framer != nil {
+			continue
+		}
+
+		// Check the header is a single line
+		if n == 0 && i.Header {
+			hdr := make([]byte, entry.Offset)
+			_, err := reader.ReadAt(hdr, 0)
+			if err != nil {
+				return err
+			}
+			if bytes.IndexByte(hdr, '\n') != len(hdr)-1 {
+				return fmt.Errorf("%w: first entry (%q) offset %d does not follow the header line",
+					ErrIndexInvalid, entry.Key, entry.Offset)
+			}
+		}
+
+		// Check entry offset is at the start of a line
+		if entry.Offset > 0 {
+			nl := make([]byte, 1)
+			_, err := reader.ReadAt(nl, entry.Offset-1)
+			if err != nil {
+				return err
+			}
+			if nl[0] != '\n' {
+				return fmt.Errorf("%w: entry %d (%q) offset %d is not at start of line",
+					ErrIndexInvalid, n, entry.Key, entry.Offset)
+			}
+		}
+
+		// Check the line begins with the entry key (trimmed keys may
+		// be preceded by spaces, sort key column and KeyFunc keys may
+		// not be at the start of the line, and CSV keys may be quoted,
+		// so we skip those)
+		if !i.TrimKeySpace && i.SortKeyColumn == 0 && i.keyFunc == nil && !i.CSVQuoting {
+			buf := make([]byte, len(entry.Key))
+			_, err := reader.ReadAt(buf, entry.Offset)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if string(buf) != entry.Key {
+				return fmt.Errorf("%w: entry %d line at offset %d does not begin with key %q",
+					ErrIndexInvalid, n, entry.Offset, entry.Key)
+			}
+		}
+	}
+	return nil
+}
+
+// VerifySortedSample checks the ordering of the dataset at path by
+// comparing the keys of every sampleEvery'th line (using opt.Delimiter,
+// Header, TrimKeySpace, Compare, SortKeyColumn, KeyFunc and Blocksize, as
+// for index generation).
+// This is a cheap pre-flight check for gross sort errors in very large
+// datasets, but note that it may miss local ordering violations between
+// sampled lines - use a sampleEvery of 1 to check every line.
+// Returns an ErrUnsorted error describing the first violation found.
+func VerifySortedSample(path string, opt IndexOptions, sampleEvery int) error {
+	if sampleEvery < 1 {
+		sampleEvery = 1
+	}
+	delim := opt.Delimiter
+	if len(delim) == 0 {
+		var err error
+		delim, err = deriveDelimiter(path)
+		if err != nil {
+			return err
+		}
+	}
+	keyIndex := optionsKeyIndex(opt, delim)
+	blocksize := opt.Blocksize
+	if blocksize <= 0 {
+		blocksize = defaultBlocksize
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, blocksize), blocksize)
+	skipHeader := opt.Header
+	var prevKey []byte
+	var lineNumber, prevLineNumber, dataLines int
+	for scanner.Scan() {
+		lineNumber++
+		if skipHeader {
+			skipHeader = false
+			continue
+		}
+		dataLines++
+		if (dataLines-1)%sampleEvery != 0 {
+			continue
+		}
+
+		key, _ := keyIndex.lineKey(scanner.Bytes())
+		if prevKey != nil && keyIndex.compareKeys(prevKey, key) > 0 {
+			// As with generateLineIndex, allow the first line to be an
+			// undeclared header
+			if prevLineNumber != 1 || opt.Header {
+				return fmt.Errorf("%w: line %d key %q < line %d key %q",
+					ErrUnsorted, lineNumber, key, prevLineNumber, prevKey)
+			}
+		}
+		prevKey = clonebs(key)
+		prevLineNumber = lineNumber
+	}
+	return scanner.Err()
+}
+
 // LoadIndex loads Index from the associated index file for path.
 // Returns ErrIndexNotFound if no index file exists.
+// Returns ErrIndexVersionUnsupported if the index was written by a newer
+// version of bsearch.
 // Returns ErrIndexExpired if path is newer than the index file.
 // Returns ErrIndexPathMismatch if index filepath does not equal path.
+// Returns ErrIndexChecksumMismatch if the index records a Checksum (see
+// IndexOptions.Checksum) which path no longer matches.
 func LoadIndex(path string) (*Index, error) {
 	path, err := filepath.Abs(path)
 	if err != nil {
@@ -289,21 +1133,15 @@ func LoadIndex(path string) (*Index, error) {
 		}
 	}
 
-	var reader io.ReadCloser
 	fh, err := os.Open(idxpath)
 	if err != nil {
 		return nil, err
 	}
 	defer fh.Close()
-	reader = zstd.NewReader(fh)
-	defer reader.Close()
-
-	data, err := ioutil.ReadAll(reader)
+	index, err := decodeIndex(fh)
 	if err != nil {
 		return nil, err
 	}
-	index := Index{List: []IndexEntry{}}
-	yaml.Unmarshal(data, &index)
 
 	// Check index.Filepath == path
 	if index.Filepath != path {
@@ -323,12 +1161,175 @@ func LoadIndex(path string) (*Index, error) {
 		return nil, ErrIndexExpired
 	}
 
+	// Verify the dataset checksum, if recorded
+	if index.Checksum != 0 {
+		err = index.verifyChecksum()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return index, nil
+}
+
+// verifyChecksum checks the index Checksum against the dataset, returning
+// ErrIndexChecksumMismatch if they differ
+func (i *Index) verifyChecksum() error {
+	fh, err := os.Open(i.Filepath)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	stat, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+	sum, err := dataChecksum(fh, stat.Size(), i.Blocksize)
+	if err != nil {
+		return err
+	}
+	if sum != i.Checksum {
+		return ErrIndexChecksumMismatch
+	}
+	return nil
+}
+
+// decodeIndex reads a yaml, json or binary Index from r, which may be
+// zstd-compressed (detected via the zstd magic number)
+func decodeIndex(r io.Reader) (*Index, error) {
+	br := bufio.NewReader(r)
+	compression := IndexCompressionNone
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	var reader io.Reader = br
+	if bytes.Equal(magic, zstdMagic) {
+		compression = IndexCompressionZstd
+		zreader := zstd.NewReader(br)
+		defer zreader.Close()
+		reader = zreader
+	}
+
+	index := Index{List: []IndexEntry{}, compression: compression}
+	// Binary indexes are decoded as they are read
+	breader := bufio.NewReader(reader)
+	magic, err = breader.Peek(len(binaryIndexMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if bytes.Equal(magic, binaryIndexMagic) {
+		index.format = IndexFormatBinary
+		err = decodeBinaryIndex(breader, &index)
+		if err != nil {
+			return nil, err
+		}
+		return checkIndexVersion(&index)
+	}
+
+	data, err := ioutil.ReadAll(breader)
+	if err != nil {
+		return nil, err
+	}
+	// json indexes are objects, and yaml indexes are block mappings
+	if trimmed := bytes.TrimLeft(data, " \t\r\n"); len(trimmed) > 0 && trimmed[0] == '{' {
+		index.format = IndexFormatJSON
+		err = json.Unmarshal(data, &index)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrIndexCorrupt, err)
+		}
+	} else {
+		yaml.Unmarshal(data, &index)
+	}
+	return checkIndexVersion(&index)
+}
+
+// checkIndexVersion defaults the version of a decoded index, and rejects
+// indexes from newer versions
+func checkIndexVersion(index *Index) (*Index, error) {
 	// Set index.Version to 1 if unset
 	if index.Version == 0 {
 		index.Version = 1
 	}
+	// Refuse to use indexes from newer versions, which we may misinterpret
+	if index.Version > indexVersion {
+		return nil, fmt.Errorf("%w: version %d (maximum supported %d)",
+			ErrIndexVersionUnsupported, index.Version, indexVersion)
+	}
+	index.setLineStarts()
 
-	return &index, nil
+	return index, nil
+}
+
+// compactKeys rebuilds the index entry keys as substrings of a single
+// contiguous string, so that they share one allocation instead of having
+// one each
+func (i *Index) compactKeys() {
+	size := 0
+	for _, entry := range i.List {
+		size += len(entry.Key)
+	}
+	var sb strings.Builder
+	sb.Grow(size)
+	for _, entry := range i.List {
+		sb.WriteString(entry.Key)
+	}
+	blob := sb.String()
+
+	offset := 0
+	for n := range i.List {
+		length := len(i.List[n].Key)
+		i.List[n].Key = blob[offset : offset+length]
+		offset += length
+	}
+}
+
+// optionsKeyIndex returns an (entryless) Index for extracting and
+// comparing keys as index generation with opt and delim would, via lineKey
+// and compareKeys
+func optionsKeyIndex(opt IndexOptions, delim []byte) *Index {
+	return &Index{
+		Delimiter:     delim,
+		TrimKeySpace:  opt.TrimKeySpace,
+		SortKeyColumn: opt.SortKeyColumn,
+		Descending:    opt.Descending,
+		CSVQuoting:    opt.CSVQuoting,
+		compare:       opt.Compare,
+		keyFunc:       opt.KeyFunc,
+	}
+}
+
+// compareKeys compares keys a and b using the index compare function,
+// or bytes.Compare if none is set (reversed for Descending indexes)
+func (i *Index) compareKeys(a, b []byte) int {
+	if i.Descending {
+		a, b = b, a
+	}
+	if i.compare != nil {
+		return i.compare(a, b)
+	}
+	return bytes.Compare(a, b)
+}
+
+// compareEntryKey compares index entry key entryKey with key. With the
+// default comparison this does not allocate, since the compiler does not
+// copy key for string(key) conversions used only in comparisons, so
+// binary searches of the index are allocation-free.
+func (i *Index) compareEntryKey(entryKey string, key []byte) int {
+	if i.compare != nil {
+		return i.compareKeys([]byte(entryKey), key)
+	}
+	cmp := 0
+	switch {
+	case entryKey < string(key):
+		cmp = -1
+	case entryKey > string(key):
+		cmp = 1
+	}
+	if i.Descending {
+		return -cmp
+	}
+	return cmp
 }
 
 // blockEntryLE does a binary search on the block entries in the index
@@ -337,8 +1338,8 @@ func LoadIndex(path string) (*Index, error) {
 // If no matching entry is found (i.e. the first index entry Key is
 // greater than key), returns ErrNotFound.
 func (i *Index) blockEntryLE(key []byte) (int, IndexEntry, error) {
-	keystr := string(key)
-	if i.List[0].Key > keystr { // index List cannot be empty
+	// index List cannot be empty
+	if i.compareEntryKey(i.List[0].Key, key) > 0 {
 		return 0, IndexEntry{}, ErrNotFound
 	}
 
@@ -356,7 +1357,7 @@ func (i *Index) blockEntryLE(key []byte) (int, IndexEntry, error) {
 		//fmt.Fprintf(os.Stderr, "+ %s: begin %d, end %d, mid %d\n",
 		// string(b), begin, end, mid)
 
-		cmp := strings.Compare(list[mid].Key, keystr)
+		cmp := i.compareEntryKey(list[mid].Key, key)
 		//fmt.Fprintf(os.Stderr, "+ %s: [%d] comparing vs. %q, cmp %d\n",
 		// string(b), mid, list[mid].Key, cmp)
 		if cmp <= 0 {
@@ -399,7 +1400,12 @@ func (i *Index) blockEntryLT(key []byte) (int, IndexEntry) {
 		}
 		//fmt.Fprintf(os.Stderr, "+ %s: begin %d, end %d, mid %d\n", string(b), begin, end, mid)
 
-		cmp := prefixCompare([]byte(list[mid].Key), key)
+		var cmp int
+		if i.compare != nil || i.Descending {
+			cmp = i.compareKeys([]byte(list[mid].Key), key)
+		} else {
+			cmp = prefixCompare([]byte(list[mid].Key), key)
+		}
 		//fmt.Fprintf(os.Stderr, "+ %s: [%d] comparing vs. %q, cmp %d\n", string(b), mid, list[mid].Key, cmp)
 		if cmp == -1 {
 			begin = mid
@@ -423,23 +1429,199 @@ func (i *Index) blockEntryN(n int) (IndexEntry, bool) {
 	return i.List[n], true
 }
 
+// KeyRanges returns the KeyRange covered by each block in the index,
+// in order. Comparing the Next key of each range with the keys actually
+// present in the dataset allows callers to detect gaps in datasets that
+// are expected to be contiguous (e.g. IP ranges).
+func (i *Index) KeyRanges() []KeyRange {
+	ranges := make([]KeyRange, len(i.List))
+	for n, entry := range i.List {
+		ranges[n] = KeyRange{First: entry.Key, Offset: entry.Offset}
+		if n+1 < len(i.List) {
+			ranges[n].Next = i.List[n+1].Key
+		}
+	}
+	return ranges
+}
+
+// Stats returns statistics on the index entries and block lengths
+func (i *Index) Stats() IndexStats {
+	stats := IndexStats{
+		Entries:        len(i.List),
+		KeysUnique:     i.KeysUnique,
+		KeysIndexFirst: i.KeysIndexFirst,
+	}
+	blocks := len(i.List) - 1
+	if blocks < 1 {
+		return stats
+	}
+
+	var sum float64
+	for n := 0; n < blocks; n++ {
+		length := i.List[n+1].Offset - i.List[n].Offset
+		if n == 0 || length < stats.MinLength {
+			stats.MinLength = length
+		}
+		if length > stats.MaxLength {
+			stats.MaxLength = length
+		}
+		if length == 0 {
+			stats.ZeroLength++
+		}
+		sum += float64(length)
+	}
+	stats.MeanLength = sum / float64(blocks)
+	var variance float64
+	for n := 0; n < blocks; n++ {
+		d := float64(i.List[n+1].Offset-i.List[n].Offset) - stats.MeanLength
+		variance += d * d
+	}
+	stats.StddevLength = math.Sqrt(variance / float64(blocks))
+	return stats
+}
+
 // Write writes the index to disk
 func (i *Index) Write() error {
-	data, err := yaml.Marshal(i)
+	idxpath, err := IndexPath(i.Filepath)
 	if err != nil {
 		return err
 	}
-
-	filedir, filename := filepath.Split(i.Filepath)
-	idxpath := filepath.Join(filedir, indexFile(filename))
-	var writer io.WriteCloser
 	fh, err := os.OpenFile(idxpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
-	writer = zstd.NewWriter(fh)
 	defer fh.Close()
 
+	return i.encode(fh)
+}
+
+// checkIndexEncoding returns an error if the opt Compression or Format
+// are set but unknown
+func checkIndexEncoding(opt IndexOptions) error {
+	switch opt.Compression {
+	case "", IndexCompressionZstd, IndexCompressionNone:
+	default:
+		return fmt.Errorf("%w %q", ErrIndexCompressionUnknown, opt.Compression)
+	}
+	switch opt.Format {
+	case "", IndexFormatYAML, IndexFormatJSON, IndexFormatBinary:
+	default:
+		return fmt.Errorf("%w %q", ErrIndexFormatUnknown, opt.Format)
+	}
+	return nil
+}
+
+// ConvertIndex converts the index file at inPath to index version
+// targetVersion, and writes it to outPath (which may equal inPath).
+// Conversions that only change the serialisation are done without reading
+// the dataset, but upgrades from version 1 (whose entries need not hold
+// the first instance of each key) regenerate the index from the dataset
+// at the index Filepath, using opt, with unset Blocksize, Delimiter,
+// Header, TrimKeySpace and SortKeyColumn options taken from the index.
+// The output uses the opt Format and Compression if set (e.g. Format
+// IndexFormatBinary to convert a yaml index to binary), and otherwise
+// those of the input index.
+// Returns ErrIndexVersionUnsupported if targetVersion is not supported.
+func ConvertIndex(inPath, outPath string, targetVersion int, opt IndexOptions) error {
+	if targetVersion < 1 || targetVersion > indexVersion {
+		return fmt.Errorf("%w: target version %d (supported 1-%d)",
+			ErrIndexVersionUnsupported, targetVersion, indexVersion)
+	}
+	err := checkIndexEncoding(opt)
+	if err != nil {
+		return err
+	}
+
+	fh, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	index, err := decodeIndex(fh)
+	fh.Close()
+	if err != nil {
+		return err
+	}
+
+	if index.Version == 1 && targetVersion > 1 {
+		if opt.Blocksize <= 0 && !opt.AutoBlocksize {
+			opt.Blocksize = index.Blocksize
+		}
+		if len(opt.Delimiter) == 0 {
+			opt.Delimiter = index.Delimiter
+		}
+		if !opt.Header {
+			opt.Header = index.Header
+		}
+		if !opt.TrimKeySpace {
+			opt.TrimKeySpace = index.TrimKeySpace
+		}
+		if opt.SortKeyColumn == 0 {
+			opt.SortKeyColumn = index.SortKeyColumn
+		}
+		if !opt.Descending {
+			opt.Descending = index.Descending
+		}
+		if !opt.CSVQuoting {
+			opt.CSVQuoting = index.CSVQuoting
+		}
+		if !opt.Checksum {
+			opt.Checksum = index.Checksum != 0
+		}
+		if opt.Compression == "" {
+			opt.Compression = index.compression
+		}
+		if opt.Format == "" {
+			opt.Format = index.format
+		}
+		index, err = NewIndexOptions(index.Filepath, opt)
+		if err != nil {
+			return err
+		}
+	}
+	if opt.Compression != "" {
+		index.compression = opt.Compression
+	}
+	if opt.Format != "" {
+		index.format = opt.Format
+	}
+	index.Version = targetVersion
+
+	out, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	err = index.encode(out)
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// encode writes the index to w as yaml (or json or binary, per the index
+// format), zstd-compressed unless the index compression is
+// IndexCompressionNone
+func (i *Index) encode(w io.Writer) error {
+	var data []byte
+	var err error
+	switch i.format {
+	case IndexFormatJSON:
+		data, err = json.Marshal(i)
+	case IndexFormatBinary:
+		data = i.marshalBinary()
+	default:
+		data, err = yaml.Marshal(i)
+	}
+	if err != nil {
+		return err
+	}
+
+	if i.compression == IndexCompressionNone {
+		_, err = w.Write(data)
+		return err
+	}
+
+	writer := zstd.NewWriter(w)
 	_, err = writer.Write(data)
 	if err != nil {
 		return err
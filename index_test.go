@@ -1,11 +1,18 @@
 package bsearch
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	yaml "gopkg.in/yaml.v3"
 )
 
 // ensureNoIndex removes any existing index, when we don't want to load
@@ -27,6 +34,23 @@ func ensureNoIndex(t *testing.T, filename string) {
 	}
 }
 
+// ensureIndex generates and writes an index if no valid one exists
+func ensureIndex(t testing.TB, filename string) {
+	path := filepath.Join("testdata", filename)
+	_, err := LoadIndex(path)
+	if err == nil {
+		return
+	}
+	idx, err := NewIndex(path)
+	if err != nil {
+		t.Fatalf("%s: %s\n", filename, err.Error())
+	}
+	err = idx.Write()
+	if err != nil {
+		t.Fatalf("%s: %s\n", filename, err.Error())
+	}
+}
+
 // Test LoadIndex()
 func TestIndexLoad(t *testing.T) {
 	var tests = []struct {
@@ -112,6 +136,266 @@ func TestIndexNewDelimiter(t *testing.T) {
 	}
 }
 
+// Test NewIndexOptions() with a multi-byte delimiter
+func TestIndexNewMultiByteDelimiter(t *testing.T) {
+	filename := "colons.txt"
+	ensureNoIndex(t, filename)
+
+	o := IndexOptions{Delimiter: []byte("::"), Blocksize: 16}
+	idx, err := NewIndexOptions(filepath.Join("testdata", filename), o)
+	if err != nil {
+		t.Fatalf("%s: %s\n", filename, err.Error())
+	}
+	assert.Equal(t, "::", string(idx.Delimiter), filename+" delimiter")
+	assert.Equal(t, false, idx.KeysUnique, filename+" KeysUnique")
+	assert.Greater(t, len(idx.List), 1, filename+" listlen")
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevKey := ""
+	for _, e := range idx.List {
+		// Entry blocks should begin with the full key followed by the
+		// delimiter, and at the start of a line
+		block := data[e.Offset:]
+		assert.Equal(t, e.Key+"::", string(block[:len(e.Key)+2]), e.Key)
+		assert.NotEqual(t, "::", string(block[len(e.Key)+2:len(e.Key)+4]), e.Key)
+		if e.Offset > 0 {
+			assert.Equal(t, byte('\n'), data[e.Offset-1], e.Key)
+		}
+		// Keys should be the first instance in the file
+		first := int64(bytes.Index(append([]byte{'\n'}, data...), []byte("\n"+e.Key+"::")))
+		assert.Equal(t, first, e.Offset, e.Key)
+		assert.Greater(t, e.Key, prevKey, e.Key)
+		prevKey = e.Key
+	}
+}
+
+// Test NewIndexOptions() with DuplicateEntryError on testdata/foo.csv
+// (where the "foo" key spans multiple blocks)
+func TestIndexNewDuplicateEntryError(t *testing.T) {
+	path := filepath.Join("testdata", "foo.csv")
+	idx, err := NewIndexOptions(path, IndexOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(idx.List))
+
+	// foo spans multiple blocks, so its later blocks would duplicate the
+	// foo entry
+	for _, concurrency := range []int{0, 4} {
+		_, err = NewIndexOptions(path, IndexOptions{
+			DuplicateEntryError: true,
+			Blocksize:           512,
+			Concurrency:         concurrency,
+		})
+		assert.True(t, errors.Is(err, ErrIndexDuplicateEntry),
+			"concurrency %d: %v", concurrency, err)
+	}
+
+	// Unique keys should not trigger an error
+	_, err = NewIndexOptions(filepath.Join("testdata", "rdns1.csv"),
+		IndexOptions{DuplicateEntryError: true})
+	assert.Nil(t, err)
+
+	// Nor should keys repeated within a block
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path = filepath.Join(dir, "repeated.csv")
+	err = ioutil.WriteFile(path, []byte("a,1\na,2\nb,1\nb,2\nc,1\nc,2\nd,1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err = NewIndexOptions(path, IndexOptions{DuplicateEntryError: true, Blocksize: 16})
+	if assert.Nil(t, err) {
+		assert.Equal(t, 2, len(idx.List))
+	}
+}
+
+// Test Index.Columns() and HeaderText
+func TestIndexColumns(t *testing.T) {
+	var tests = []struct {
+		filename string
+		header   bool
+		text     string
+		columns  []string
+	}{
+		{"domains2.csv", true, "domain,dr", []string{"domain", "dr"}},
+		{"foo.csv", false, "label,lineno", []string{"label", "lineno"}}, // autodetected
+		{"indexme.csv", false, "", nil},
+	}
+
+	for _, tc := range tests {
+		o := IndexOptions{Header: tc.header}
+		idx, err := NewIndexOptions(filepath.Join("testdata", tc.filename), o)
+		if err != nil {
+			t.Fatalf("%s: %s\n", tc.filename, err.Error())
+		}
+		assert.Equal(t, tc.text, idx.HeaderText, tc.filename+" HeaderText")
+		assert.Equal(t, tc.columns, idx.Columns(), tc.filename+" Columns")
+
+		// Check columns survive a yaml round trip
+		data, err := yaml.Marshal(idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx2 := Index{}
+		err = yaml.Unmarshal(data, &idx2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.columns, idx2.Columns(), tc.filename+" Columns (yaml)")
+	}
+}
+
+// Test Index.KeyRanges()
+func TestIndexKeyRanges(t *testing.T) {
+	idx, err := NewIndexOptions(filepath.Join("testdata", "foo.csv"), IndexOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges := idx.KeyRanges()
+	expect := []KeyRange{
+		{First: "bar", Next: "foo", Offset: idx.List[0].Offset},
+		{First: "foo", Next: "", Offset: idx.List[1].Offset},
+	}
+	assert.Equal(t, expect, ranges)
+
+	idx, err = NewIndexOptions(filepath.Join("testdata", "rdns1.csv"),
+		IndexOptions{Blocksize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges = idx.KeyRanges()
+	assert.Equal(t, len(idx.List), len(ranges))
+	for i := 0; i+1 < len(ranges); i++ {
+		assert.Equal(t, ranges[i+1].First, ranges[i].Next)
+		assert.Less(t, ranges[i].First, ranges[i].Next)
+	}
+	assert.Equal(t, "", ranges[len(ranges)-1].Next)
+}
+
+// Test Index.Stats()
+func TestIndexStats(t *testing.T) {
+	idx := &Index{List: []IndexEntry{{Key: "a", Offset: 0}}, KeysUnique: true}
+	stats := idx.Stats()
+	assert.Equal(t, IndexStats{Entries: 1, KeysUnique: true}, stats)
+
+	idx.List = []IndexEntry{
+		{Key: "a", Offset: 0},
+		{Key: "b", Offset: 10},
+		{Key: "c", Offset: 30},
+		{Key: "d", Offset: 30},
+		{Key: "e", Offset: 70},
+	}
+	stats = idx.Stats()
+	assert.Equal(t, 5, stats.Entries)
+	assert.Equal(t, int64(0), stats.MinLength)
+	assert.Equal(t, int64(40), stats.MaxLength)
+	assert.Equal(t, 17.5, stats.MeanLength)
+	assert.InDelta(t, 14.79, stats.StddevLength, 0.01)
+	assert.Equal(t, 1, stats.ZeroLength)
+
+	idx, err := NewIndexOptions(filepath.Join("testdata", "rdns1.csv"),
+		IndexOptions{Blocksize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats = idx.Stats()
+	last := len(idx.List) - 1
+	assert.Equal(t, len(idx.List), stats.Entries)
+	assert.Equal(t, idx.KeysUnique, stats.KeysUnique)
+	assert.InDelta(t, float64(idx.List[last].Offset-idx.List[0].Offset),
+		stats.MeanLength*float64(last), 0.001)
+	assert.LessOrEqual(t, stats.MinLength, stats.MaxLength)
+	assert.Greater(t, stats.MinLength, int64(0))
+}
+
+// Test index validation
+func TestIndexValidate(t *testing.T) {
+	path := filepath.Join("testdata", "foo.csv")
+	idx, err := NewIndexOptions(path, IndexOptions{StrictValidate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	stat, err := fh.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, idx.validate(fh, stat.Size(), true))
+
+	list := idx.List
+	var tests = []struct {
+		name string
+		list []IndexEntry
+	}{
+		{"offset past EOF", []IndexEntry{list[0], {Key: "foo", Offset: stat.Size()}}},
+		{"offsets out of order", []IndexEntry{list[1], list[0]}},
+		{"keys out of order", []IndexEntry{{Key: "foo", Offset: list[0].Offset}, {Key: "bar", Offset: list[1].Offset}}},
+		{"first offset after header", []IndexEntry{list[1]}},
+		{"offset mid-line", []IndexEntry{list[0], {Key: "foo", Offset: list[1].Offset + 1}}},
+		{"wrong key", []IndexEntry{list[0], {Key: "fop", Offset: list[1].Offset}}},
+	}
+	for _, tc := range tests {
+		idx.List = tc.list
+		err = idx.validate(fh, stat.Size(), true)
+		assert.True(t, errors.Is(err, ErrIndexInvalid), tc.name)
+	}
+
+	// Line checks (which read the dataset) are skipped without checkLines
+	idx.List = []IndexEntry{list[0], {Key: "fop", Offset: list[1].Offset + 1}}
+	assert.Nil(t, idx.validate(fh, stat.Size(), false))
+
+	// Without a header, the first entry must be at offset 0
+	idx.Header = false
+	idx.List = list
+	err = idx.validate(fh, stat.Size(), false)
+	assert.True(t, errors.Is(err, ErrIndexInvalid), "first offset after dataset start")
+}
+
+// Test NewIndexOptions() with AutoBlocksize
+func TestIndexNewAutoBlocksize(t *testing.T) {
+	var tests = []struct {
+		filename      string
+		linesPerBlock int
+		min           int
+		max           int
+	}{
+		{"rdns1.csv", 0, 512, 2048}, // ~70 byte lines
+		{"rdns1.csv", 64, 4096, 8192},
+		{"foo.csv", 0, 256, 256}, // ~9 byte lines
+	}
+
+	for _, tc := range tests {
+		o := IndexOptions{AutoBlocksize: true, LinesPerBlock: tc.linesPerBlock}
+		idx, err := NewIndexOptions(filepath.Join("testdata", tc.filename), o)
+		if err != nil {
+			t.Fatalf("%s: %s\n", tc.filename, err.Error())
+		}
+		assert.GreaterOrEqual(t, idx.Blocksize, tc.min, tc.filename+" blocksize")
+		assert.LessOrEqual(t, idx.Blocksize, tc.max, tc.filename+" blocksize")
+		assert.Equal(t, 0, idx.Blocksize%autoBlocksizeMin, tc.filename+" blocksize")
+	}
+
+	// An explicit Blocksize takes precedence
+	o := IndexOptions{AutoBlocksize: true, Blocksize: 4096}
+	idx, err := NewIndexOptions(filepath.Join("testdata", "rdns1.csv"), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 4096, idx.Blocksize)
+}
+
 // Test blockEntryLE() on rir_clc_ipv_range.csv
 func TestIndexBlockEntryLE(t *testing.T) {
 	var tests = []struct {
@@ -150,3 +434,922 @@ func TestIndexBlockEntryLE(t *testing.T) {
 		assert.Equal(t, tc.entryOffset, entry.Offset, tc.key+" entryOffset")
 	}
 }
+
+// Test blockEntryLE() binary searches do not allocate with the default
+// comparison
+func TestIndexBlockEntryLEAllocs(t *testing.T) {
+	idx, err := NewIndexOptions("testdata/rdns1.csv", IndexOptions{Blocksize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("202.047.145.000")
+
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _, err := idx.blockEntryLE(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.Equal(t, float64(0), allocs, "blockEntryLE() allocations")
+}
+
+// Benchmark blockEntryLE() binary searches, with the default comparison
+// and a custom one, reporting allocations per lookup
+func BenchmarkIndexBlockEntryLE(b *testing.B) {
+	// Use a small blocksize for a deeper search
+	idx, err := NewIndexOptions("testdata/rdns1.csv", IndexOptions{Blocksize: 256})
+	if err != nil {
+		b.Fatal(err)
+	}
+	key := []byte("202.047.145.000")
+
+	b.Run("default", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _, err := idx.blockEntryLE(key)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	cidx := *idx
+	cidx.compare = bytes.Compare
+	b.Run("compare", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _, err := cidx.blockEntryLE(key)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// Test NewIndexOptions() and NewSearcherOptions() with CompactKeys
+func TestIndexCompactKeys(t *testing.T) {
+	expect, err := NewIndexOptions("testdata/rdns1.csv", IndexOptions{Blocksize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := NewIndexOptions("testdata/rdns1.csv", IndexOptions{Blocksize: 256, CompactKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expect.List, idx.List)
+
+	ensureIndex(t, "rdns1.csv")
+	s, err := NewSearcherOptions("testdata/rdns1.csv", SearcherOptions{CompactKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	lines, err := s.Lines([]byte("032.176.184.000"))
+	assert.Nil(t, err)
+	assert.Equal(t, 6, len(lines))
+}
+
+// heapUsage returns the bytes and number of objects allocated on the heap
+// (after a GC)
+func heapUsage() (uint64, uint64) {
+	var m runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc, m.HeapObjects
+}
+
+// Benchmark the heap memory retained by a large index (1M entries), with
+// and without compactKeys
+func BenchmarkIndexCompactKeys(b *testing.B) {
+	const entries = 1000000
+	for _, compact := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compact=%v", compact), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				bytesBefore, objectsBefore := heapUsage()
+				idx := &Index{List: make([]IndexEntry, entries)}
+				for n := range idx.List {
+					idx.List[n] = IndexEntry{Key: fmt.Sprintf("key%012d", n), Offset: int64(n)}
+				}
+				if compact {
+					idx.compactKeys()
+				}
+				bytesAfter, objectsAfter := heapUsage()
+				b.ReportMetric(float64(bytesAfter-bytesBefore)/entries, "heapB/entry")
+				b.ReportMetric(float64(objectsAfter-objectsBefore)/entries, "objects/entry")
+				runtime.KeepAlive(idx)
+			}
+		})
+	}
+}
+
+// Test VerifySortedSample() on sorted and unsorted datasets
+func TestVerifySortedSample(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%04d", i)
+	}
+	writeDataset := func(name string, keys []string) string {
+		var buf bytes.Buffer
+		for _, key := range keys {
+			buf.WriteString(key + ",x\n")
+		}
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, buf.Bytes(), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// Local violation - swap two adjacent lines
+	local := append([]string{}, keys...)
+	local[500], local[501] = local[501], local[500]
+	// Gross violation - move a chunk of lines to the end
+	gross := append(append([]string{}, keys[:300]...), keys[400:]...)
+	gross = append(gross, keys[300:400]...)
+
+	var tests = []struct {
+		path        string
+		sampleEvery int
+		sorted      bool
+	}{
+		{writeDataset("sorted.csv", keys), 1, true},
+		{writeDataset("sorted.csv", keys), 10, true},
+		{writeDataset("header.csv", append([]string{"name"}, keys...)), 1, true},
+		{writeDataset("local.csv", local), 1, false},
+		{writeDataset("local.csv", local), 10, true}, // missed
+		{writeDataset("gross.csv", gross), 1, false},
+		{writeDataset("gross.csv", gross), 50, false},
+		{"testdata/rdns1.csv", 1, true},
+		{"testdata/rdns1.csv", 100, true},
+	}
+
+	for _, tc := range tests {
+		err := VerifySortedSample(tc.path, IndexOptions{}, tc.sampleEvery)
+		desc := fmt.Sprintf("%s every %d", filepath.Base(tc.path), tc.sampleEvery)
+		if tc.sorted {
+			assert.Nil(t, err, desc)
+		} else {
+			assert.True(t, errors.Is(err, ErrUnsorted), desc)
+		}
+	}
+}
+
+// Test NewIndexOptions() with testdata/newline.txt, which has a key with
+// an embedded newline (using a unit separator delimiter)
+func TestIndexNewEmbeddedNewline(t *testing.T) {
+	_, err := NewIndexOptions("testdata/newline.txt", IndexOptions{Delimiter: []byte{0x1f}})
+	assert.True(t, errors.Is(err, ErrNoDelimiter), "embedded newline returns ErrNoDelimiter")
+	if err != nil {
+		assert.Contains(t, err.Error(), "offset 8")
+	}
+
+	// A header line without a delimiter is okay
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "header.csv")
+	err = ioutil.WriteFile(path, []byte("name\nalpha,1\nbeta,2\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := NewIndex(path)
+	if assert.Nil(t, err) {
+		assert.Equal(t, true, idx.Header)
+	}
+
+	// But a first data line without a delimiter is not
+	err = ioutil.WriteFile(path, []byte("alpha\nbeta,2\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewIndex(path)
+	assert.True(t, errors.Is(err, ErrNoDelimiter), "first line without delimiter")
+}
+
+// Test LoadIndex() with an index from a future version
+func TestIndexLoadFutureVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "future.csv")
+	err = ioutil.WriteFile(path, []byte("alpha,1\nbeta,2\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := NewIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Version = indexVersion + 1
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadIndex(path)
+	assert.True(t, errors.Is(err, ErrIndexVersionUnsupported), "LoadIndex returns ErrIndexVersionUnsupported")
+	_, err = NewSearcher(path)
+	assert.True(t, errors.Is(err, ErrIndexVersionUnsupported), "NewSearcher returns ErrIndexVersionUnsupported")
+
+	// The current version is fine
+	idx.Version = indexVersion
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadIndex(path)
+	assert.Nil(t, err)
+}
+
+// Test NewIndexOptions() with RequireUnique using testdata/dupkey.csv
+func TestIndexNewRequireUnique(t *testing.T) {
+	idx, err := NewIndex("testdata/dupkey.csv")
+	if assert.Nil(t, err) {
+		assert.Equal(t, false, idx.KeysUnique)
+	}
+
+	_, err = NewIndexOptions("testdata/dupkey.csv", IndexOptions{RequireUnique: true})
+	assert.True(t, errors.Is(err, ErrDuplicateKey), "duplicate key returns ErrDuplicateKey")
+	if err != nil {
+		assert.Contains(t, err.Error(), `"gamma" at offset 23`)
+	}
+
+	idx, err = NewIndexOptions("testdata/hashed.csv", IndexOptions{RequireUnique: true})
+	if assert.Nil(t, err) {
+		assert.Equal(t, true, idx.KeysUnique)
+	}
+}
+
+// Test NewIndexOptions() with a delimiter that does not occur in the data
+func TestIndexNewDelimiterNotFound(t *testing.T) {
+	_, err := NewIndexOptions("testdata/rdns1.csv", IndexOptions{Delimiter: []byte{'\t'}})
+	assert.True(t, errors.Is(err, ErrDelimiterNotFound), "wrong delimiter returns ErrDelimiterNotFound")
+
+	_, err = NewIndexOptions("testdata/rdns1.csv", IndexOptions{Delimiter: []byte{','}})
+	assert.Nil(t, err)
+}
+
+// Test NewIndexOptions() with a KeyFunc using testdata/fixedwidth.txt,
+// which is sorted on the fixed-width keys at line[10:20]
+func TestIndexKeyFunc(t *testing.T) {
+	var tests = []struct {
+		key    string
+		expect string
+	}{
+		{"key0000000", "0000000000key0000000 value00"},
+		{"key0000009", "0000000011key0000009 value03"},
+		{"key0000117", "0000000043key0000117 value39"},
+		{"key0000004", ""},
+		{"key", ""},
+	}
+
+	keyFunc := func(line []byte) []byte {
+		if len(line) < 20 {
+			return nil
+		}
+		return line[10:20]
+	}
+	data, err := ioutil.ReadFile("testdata/fixedwidth.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fixedwidth.txt")
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The leading field is not sorted
+	_, err = NewIndexOptions(path, IndexOptions{Delimiter: []byte(" "), Blocksize: 128})
+	assert.NotNil(t, err)
+
+	idx, err := NewIndexOptions(path, IndexOptions{
+		Delimiter: []byte(" "),
+		Blocksize: 128,
+		KeyFunc:   keyFunc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, len(idx.List) > 1, "multiple blocks")
+	for _, entry := range idx.List {
+		assert.Equal(t, "key", entry.Key[:3], "entry keys are KeyFunc keys")
+	}
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSearcherOptions(path, SearcherOptions{KeyFunc: keyFunc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, tc := range tests {
+		line, err := s.Line([]byte(tc.key))
+		if tc.expect == "" {
+			assert.Equal(t, ErrNotFound, err, tc.key)
+			continue
+		}
+		assert.Nil(t, err, tc.key)
+		assert.Equal(t, tc.expect, string(line), tc.key)
+	}
+}
+
+// Test csvField() parsing of quoted and unquoted fields
+func TestCSVField(t *testing.T) {
+	var tests = []struct {
+		line  string
+		delim string
+		field string
+		rest  string
+		ok    bool
+	}{
+		{"alpha,1,2", ",", "alpha", "1,2", true},
+		{"alpha", ",", "alpha", "", false},
+		{`"a,b",1`, ",", "a,b", "1", true},
+		{`"a,b"`, ",", "a,b", "", false},
+		{`"say ""hi""",1`, ",", `say "hi"`, "1", true},
+		{`"",1`, ",", "", "1", true},
+		{`"a::b"::1`, "::", "a::b", "1", true},
+		// Malformed quoted fields are unquoted
+		{`"a,b`, ",", `"a`, "b", true},
+		{`"a"b,1`, ",", `"a"b`, "1", true},
+	}
+
+	for _, tc := range tests {
+		field, rest, ok := csvField([]byte(tc.line), []byte(tc.delim))
+		assert.Equal(t, tc.field, string(field), tc.line)
+		assert.Equal(t, tc.rest, string(rest), tc.line)
+		assert.Equal(t, tc.ok, ok, tc.line)
+	}
+
+	key, ok := csvKeyField([]byte(`"a,b","c,d",e`), []byte(","), 1)
+	assert.True(t, ok)
+	assert.Equal(t, "c,d", string(key))
+}
+
+// Test IndexOptions.CSVQuoting indexes and searches quoted keys
+func TestIndexCSVQuoting(t *testing.T) {
+	var tests = []struct {
+		key    string
+		expect string
+	}{
+		{`a"q`, `"a""q",2`},
+		{"a,b", `"a,b",1`},
+		{"b", "b,3"},
+		{"c", `"c",4`},
+		{"a", ""},
+		{`"c"`, ""},
+	}
+
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "quoted.csv")
+	data := "\"a\"\"q\",2\n\"a,b\",1\nb,3\n\"c\",4\n"
+	err = ioutil.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := NewIndexOptions(path, IndexOptions{CSVQuoting: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `a"q`, idx.List[0].Key)
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSearcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	assert.True(t, s.Index.CSVQuoting)
+	for _, tc := range tests {
+		line, err := s.Line([]byte(tc.key))
+		if tc.expect == "" {
+			assert.Equal(t, ErrNotFound, err, tc.key)
+			continue
+		}
+		assert.Nil(t, err, tc.key)
+		assert.Equal(t, tc.expect, string(line), tc.key)
+	}
+	value, err := s.LineValue([]byte("a,b"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1", string(value))
+}
+
+// Test IndexOptions.Compression index round-trips
+func TestIndexCompression(t *testing.T) {
+	var tests = []struct {
+		compression string
+		zstd        bool
+	}{
+		{"", true},
+		{IndexCompressionZstd, true},
+		{IndexCompressionNone, false},
+	}
+
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "compression.csv")
+	var buf bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&buf, "key%04d,%d\n", i, i%10)
+	}
+	err = ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idxpath, err := IndexPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range tests {
+		idx, err := NewIndexOptions(path, IndexOptions{
+			Blocksize:   256,
+			Compression: tc.compression,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = idx.Write()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(idxpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.zstd, bytes.HasPrefix(data, zstdMagic), tc.compression)
+		if !tc.zstd {
+			assert.True(t, bytes.Contains(data, []byte("k: key0000")), tc.compression)
+		}
+
+		loaded, err := LoadIndex(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, idx.Blocksize, loaded.Blocksize, tc.compression)
+		assert.Equal(t, idx.List, loaded.List, tc.compression)
+	}
+
+	_, err = NewIndexOptions(path, IndexOptions{Compression: "gzip"})
+	assert.True(t, errors.Is(err, ErrIndexCompressionUnknown))
+}
+
+// Test IndexOptions.Format index round-trips
+func TestIndexFormat(t *testing.T) {
+	var tests = []struct {
+		format      string
+		compression string
+		json        bool
+	}{
+		{"", IndexCompressionNone, false},
+		{IndexFormatYAML, IndexCompressionNone, false},
+		{IndexFormatJSON, IndexCompressionNone, true},
+		{IndexFormatJSON, IndexCompressionZstd, true},
+		{IndexFormatBinary, IndexCompressionNone, false},
+		{IndexFormatBinary, IndexCompressionZstd, false},
+	}
+
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "format.csv")
+	var buf bytes.Buffer
+	buf.WriteString("key,value\n")
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&buf, "key%04d,%d\n", i, i%10)
+	}
+	err = ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idxpath, err := IndexPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range tests {
+		desc := tc.format + "/" + tc.compression
+		idx, err := NewIndexOptions(path, IndexOptions{
+			Blocksize:   256,
+			Header:      true,
+			LineCounts:  true,
+			Format:      tc.format,
+			Compression: tc.compression,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = idx.Write()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.compression == IndexCompressionNone {
+			data, err := ioutil.ReadFile(idxpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tc.json, bytes.HasPrefix(data, []byte("{")), desc)
+		}
+
+		loaded, err := LoadIndex(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, idx.Delimiter, loaded.Delimiter, desc)
+		assert.Equal(t, idx.ColumnNames, loaded.ColumnNames, desc)
+		assert.Equal(t, idx.Epoch, loaded.Epoch, desc)
+		assert.Equal(t, idx.Filepath, loaded.Filepath, desc)
+		assert.Equal(t, idx.Header, loaded.Header, desc)
+		assert.Equal(t, idx.LineCounts, loaded.LineCounts, desc)
+		assert.Equal(t, idx.Version, loaded.Version, desc)
+		assert.Equal(t, idx.List, loaded.List, desc)
+
+		s, err := NewSearcher(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := s.Line([]byte("key0500"))
+		assert.Nil(t, err, desc)
+		assert.Equal(t, "key0500,0", string(line), desc)
+		s.Close()
+	}
+
+	_, err = NewIndexOptions(path, IndexOptions{Format: "toml"})
+	assert.True(t, errors.Is(err, ErrIndexFormatUnknown))
+}
+
+// Test binary index round-trips and corruption detection
+func TestIndexBinary(t *testing.T) {
+	idx := Index{
+		Blocksize:      256,
+		Delimiter:      []byte("|"),
+		Epoch:          1600000000,
+		Filepath:       "/data/binary.psv",
+		Header:         true,
+		KeysIndexFirst: true,
+		LineCounts:     true,
+		SortKeyColumn:  1,
+		Descending:     true,
+		Checksum:       0xdeadbeef,
+		Version:        indexVersion,
+		format:         IndexFormatBinary,
+		compression:    IndexCompressionNone,
+	}
+	idx.setHeader([]byte("a|b|c"))
+	for i := 0; i < 100; i++ {
+		idx.List = append(idx.List, IndexEntry{
+			Key:       fmt.Sprintf("key%03d", 999-i*3),
+			Offset:    int64(i)*200 + 6,
+			LineCount: int64(i % 7),
+		})
+	}
+	idx.Length = len(idx.List)
+	idx.setLineStarts() // cached on load
+
+	var buf bytes.Buffer
+	err := idx.encode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	loaded, err := decodeIndex(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, &idx, loaded)
+
+	// Prefix compression makes binary indexes smaller than yaml ones
+	idx.format = IndexFormatYAML
+	buf.Reset()
+	err = idx.encode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, len(data) < buf.Len()/2, "binary %d, yaml %d", len(data), buf.Len())
+
+	// Corrupted and truncated indexes are detected
+	for _, pos := range []int{10, len(data) / 2, len(data) - 1} {
+		corrupt := append([]byte{}, data...)
+		corrupt[pos] ^= 0x40
+		_, err = decodeIndex(bytes.NewReader(corrupt))
+		assert.True(t, errors.Is(err, ErrIndexCorrupt), "corrupt at %d: %v", pos, err)
+	}
+	for _, length := range []int{len(binaryIndexMagic), 20, len(data) - 1} {
+		_, err = decodeIndex(bytes.NewReader(data[:length]))
+		assert.True(t, errors.Is(err, ErrIndexCorrupt), "truncated to %d: %v", length, err)
+	}
+	_, err = decodeIndex(bytes.NewReader(append(append([]byte{}, data...), '\n')))
+	assert.True(t, errors.Is(err, ErrIndexCorrupt), "trailing data")
+}
+
+// Test IndexOptions.Checksum detects datasets changed without a modtime
+// change
+func TestIndexChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checksum.csv")
+	var buf bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&buf, "key%04d,%d\n", i, i%10)
+	}
+	data := buf.Bytes()
+	mtime := time.Now().Add(-time.Hour)
+	writeDataset := func(data []byte) {
+		err := ioutil.WriteFile(path, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(path, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeDataset(data)
+
+	idx, err := NewIndexOptions(path, IndexOptions{Blocksize: 256, Checksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, uint64(0), idx.Checksum)
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadIndex(path)
+	if assert.Nil(t, err) {
+		assert.Equal(t, idx.Checksum, loaded.Checksum)
+	}
+
+	// Change the last line, keeping the size and modtime
+	changed := append([]byte{}, data...)
+	changed[len(changed)-2] = '0'
+	writeDataset(changed)
+	_, err = LoadIndex(path)
+	assert.Equal(t, ErrIndexChecksumMismatch, err)
+
+	// Searchers regenerate the index
+	s, err := NewSearcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := s.Line([]byte("key0999"))
+	assert.Nil(t, err)
+	assert.Equal(t, "key0999,0", string(line))
+	s.Close()
+	loaded, err = LoadIndex(path)
+	if assert.Nil(t, err) {
+		assert.NotEqual(t, uint64(0), loaded.Checksum, "checksum retained")
+		assert.NotEqual(t, idx.Checksum, loaded.Checksum)
+	}
+
+	// Indexes without a checksum are not verified
+	idx, err = NewIndexOptions(path, IndexOptions{Blocksize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(0), idx.Checksum)
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeDataset(data)
+	_, err = LoadIndex(path)
+	assert.Nil(t, err)
+}
+
+// Test ConvertIndex() upgrading and downgrading index versions
+func TestIndexConvert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "convert.csv")
+	err = ioutil.WriteFile(path, []byte("alpha,1\nbeta,1\nbeta,2\nbeta,3\ngamma,1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect, err := NewIndexOptions(path, IndexOptions{Blocksize: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fake a version 1 index, without KeysIndexFirst
+	idx, err := NewIndexOptions(path, IndexOptions{Blocksize: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Version = 1
+	idx.KeysIndexFirst = false
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idxpath, err := IndexPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Upgrade v1 -> v2 in place (regenerating with the index blocksize)
+	err = ConvertIndex(idxpath, idxpath, 2, IndexOptions{})
+	assert.Nil(t, err)
+	idx, err = LoadIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, idx.Version)
+	assert.True(t, idx.KeysIndexFirst)
+	assert.Equal(t, 8, idx.Blocksize)
+	assert.Equal(t, expect.List, idx.List)
+
+	// Downgrade v2 -> v1 (reserialising only)
+	v1path := filepath.Join(dir, "convert_v1.bsx")
+	err = ConvertIndex(idxpath, v1path, 1, IndexOptions{})
+	assert.Nil(t, err)
+	fh, err := os.Open(v1path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	idx, err = decodeIndex(fh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, idx.Version)
+	assert.Equal(t, expect.List, idx.List)
+
+	// Convert the v2 yaml index to binary, and back to uncompressed json
+	// (reserialising only)
+	binpath := filepath.Join(dir, "convert_bin.bsx")
+	err = ConvertIndex(idxpath, binpath, 2, IndexOptions{Format: IndexFormatBinary})
+	assert.Nil(t, err)
+	jsonpath := filepath.Join(dir, "convert_json.bsx")
+	err = ConvertIndex(binpath, jsonpath, 2,
+		IndexOptions{Format: IndexFormatJSON, Compression: IndexCompressionNone})
+	assert.Nil(t, err)
+	for _, tc := range []struct {
+		path        string
+		format      string
+		compression string
+	}{
+		{binpath, IndexFormatBinary, IndexCompressionZstd},
+		{jsonpath, IndexFormatJSON, IndexCompressionNone},
+	} {
+		fh, err := os.Open(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx, err = decodeIndex(fh)
+		fh.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.format, idx.format, tc.path)
+		assert.Equal(t, tc.compression, idx.compression, tc.path)
+		assert.Equal(t, 2, idx.Version, tc.path)
+		assert.True(t, idx.KeysIndexFirst, tc.path)
+		assert.Equal(t, expect.List, idx.List, tc.path)
+	}
+	err = ConvertIndex(idxpath, binpath, 2, IndexOptions{Format: "xml"})
+	assert.True(t, errors.Is(err, ErrIndexFormatUnknown), "ConvertIndex returns ErrIndexFormatUnknown")
+
+	// Unsupported target versions
+	err = ConvertIndex(idxpath, v1path, indexVersion+1, IndexOptions{})
+	assert.True(t, errors.Is(err, ErrIndexVersionUnsupported), "ConvertIndex returns ErrIndexVersionUnsupported")
+	err = ConvertIndex(idxpath, v1path, 0, IndexOptions{})
+	assert.True(t, errors.Is(err, ErrIndexVersionUnsupported), "ConvertIndex returns ErrIndexVersionUnsupported")
+}
+
+// Test overriding IndexPathFunc to keep indexes in a separate directory
+func TestIndexPathFunc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dataDir := filepath.Join(dir, "data")
+	cacheDir := filepath.Join(dir, "cache")
+	for _, d := range []string{dataDir, cacheDir} {
+		err = os.Mkdir(d, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dataDir, "cached.csv")
+	err = ioutil.WriteFile(path, []byte("alpha,1\nbeta,2\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { IndexPathFunc = DefaultIndexPath }()
+	IndexPathFunc = func(dataPath string) (string, error) {
+		rel, err := filepath.Rel(dir, dataPath)
+		if err != nil {
+			return "", err
+		}
+		return DefaultIndexPath(filepath.Join(cacheDir, rel))
+	}
+	err = os.Mkdir(filepath.Join(cacheDir, "data"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := NewIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idxpath, err := IndexPath(path)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(cacheDir, "data", "cached_csv.bsx"), idxpath)
+	_, err = os.Stat(idxpath)
+	assert.Nil(t, err, "index written to cache dir")
+	_, err = os.Stat(filepath.Join(dataDir, "cached_csv.bsx"))
+	assert.True(t, os.IsNotExist(err), "no index written alongside dataset")
+
+	_, err = LoadIndex(path)
+	assert.Nil(t, err)
+	s, err := NewSearcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	assert.NotNil(t, s.Index, "searcher loads index from cache dir")
+	line, err := s.Line([]byte("beta"))
+	assert.Nil(t, err)
+	assert.Equal(t, "beta,2", string(line))
+}
+
+// Benchmark decoding a large index in each format
+func BenchmarkIndexDecode(b *testing.B) {
+	idx := Index{
+		Blocksize: defaultBlocksize,
+		Delimiter: []byte(","),
+		Filepath:  "/data/large.csv",
+		Version:   indexVersion,
+	}
+	for i := 0; i < 100000; i++ {
+		idx.List = append(idx.List, IndexEntry{
+			Key:    fmt.Sprintf("key%08d", i),
+			Offset: int64(i) * defaultBlocksize,
+		})
+	}
+	idx.Length = len(idx.List)
+
+	for _, format := range []string{IndexFormatYAML, IndexFormatJSON, IndexFormatBinary} {
+		idx.format = format
+		var buf bytes.Buffer
+		err := idx.encode(&buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+		data := buf.Bytes()
+		b.Run(format, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := decodeIndex(bytes.NewReader(data))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
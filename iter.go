@@ -0,0 +1,135 @@
+/*
+bsearch line iterator, for streaming matches without materializing them
+*/
+
+package bsearch
+
+// LineIter is an iterator over the lines in a dataset beginning with a
+// key (or key prefix), as returned by Searcher.LinesIter and
+// Searcher.LinesPrefixIter. Lines are scanned lazily as Next is called, so
+// memory use is independent of the number of matches.
+type LineIter struct {
+	s       *Searcher
+	buf     []byte
+	key     []byte
+	pos     int
+	fullKey bool
+	prefix  bool // match key prefixes, rather than whole keys
+	line    []byte
+	found   bool
+	done    bool
+	err     error
+}
+
+// LinesIter returns an iterator over all lines in the reader that begin
+// with key, in dataset order, using a binary search to locate the first
+// match (as for Lines). The iterator holds a reference on the searcher's
+// current dataset mapping until Next returns false or Close is called,
+// so callers that stop iterating early must call Close. If there are no
+// matches, the first call to Next returns false and Err returns ErrNotFound.
+// SortBy and MaxMatches are not applied, since they require all matches
+// to be materialized.
+func (s *Searcher) LinesIter(key []byte) (*LineIter, error) {
+	return s.linesIter(key, false)
+}
+
+// LinesPrefixIter returns an iterator over all lines in the reader whose
+// key begins with prefix (i.e. the lines LinesPrefixSuffix returns for an
+// empty suffix), in dataset order. As for LinesIter, callers that stop
+// iterating early must call Close.
+func (s *Searcher) LinesPrefixIter(prefix []byte) (*LineIter, error) {
+	return s.linesIter(prefix, true)
+}
+
+// linesIter returns an iterator over the lines beginning with key, or
+// whose key begins with key if prefix is set
+func (s *Searcher) linesIter(key []byte, prefix bool) (*LineIter, error) {
+	s = s.acquire()
+	if err := s.requireIndex(); err != nil {
+		s.release()
+		return nil, err
+	}
+	key = s.normaliseKey(key)
+	if len(key) < s.minKeyLen {
+		s.release()
+		return nil, ErrKeyTooShort
+	}
+	_, entry, err := s.blockEntry(key)
+	if err == ErrNotFound && prefix {
+		// Keys beginning with prefix may still sort after the first key
+		entry, err = s.Index.List[0], nil
+	}
+	if err == ErrNotFound {
+		// key sorts before the first index entry, so there are no matches
+		s.release()
+		return &LineIter{done: true, err: ErrNotFound}, nil
+	}
+	if err != nil {
+		s.release()
+		return nil, err
+	}
+
+	buf := s.mmap[entry.Offset:]
+	return &LineIter{
+		s:       s,
+		buf:     buf,
+		key:     key,
+		pos:     s.skipLinesBefore(buf, key),
+		fullKey: s.fullKeyCompare(),
+		prefix:  prefix,
+	}, nil
+}
+
+// Next advances the iterator to the next matching line, returning false
+// when there are no more matches (or the iterator has been closed)
+func (it *LineIter) Next() bool {
+	if it.done {
+		return false
+	}
+	start, end, ok := it.s.framer().NextRecord(it.buf, it.pos)
+	if !ok || !it.matches(it.buf[start:end]) {
+		if !it.found {
+			it.err = ErrNotFound
+		}
+		it.Close()
+		return false
+	}
+	it.line = it.buf[start:end]
+	it.pos = end
+	it.found = true
+	return true
+}
+
+// matches returns true if line matches the iterator key
+func (it *LineIter) matches(line []byte) bool {
+	if it.prefix {
+		return it.s.hasKeyPrefix(it.s.lineKey(line), it.key)
+	}
+	return it.s.lineHasKey(line, it.key, it.fullKey)
+}
+
+// Bytes returns the current line. The line refers to the mapped dataset
+// rather than being a copy, so must be cloned if it is retained beyond the
+// next call to Next or Close.
+func (it *LineIter) Bytes() []byte {
+	return it.line
+}
+
+// Err returns the error that ended the iteration, if any - ErrNotFound if
+// there were no matching lines
+func (it *LineIter) Err() error {
+	return it.err
+}
+
+// Close releases the iterator's reference on the dataset mapping. It is
+// called automatically when Next returns false, and may be called more
+// than once.
+func (it *LineIter) Close() {
+	if it.done {
+		return
+	}
+	it.done = true
+	it.line = nil
+	it.buf = nil
+	it.s.release()
+}
@@ -0,0 +1,163 @@
+package bsearch
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test Searcher.LinesIter() against Searcher.Lines()
+func TestLinesIter(t *testing.T) {
+	var tests = []struct {
+		filename string
+		key      string
+	}{
+		{"foo.csv", "bar"},
+		{"foo.csv", "foo"},
+		{"domains1.csv", "adyen.com"},
+		{"domains1.csv", "zend.com"},
+	}
+
+	for _, tc := range tests {
+		s, err := NewSearcher(filepath.Join("testdata", tc.filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect, err := s.Lines([]byte(tc.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		it, err := s.LinesIter([]byte(tc.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got [][]byte
+		for it.Next() {
+			got = append(got, clonebs(it.Bytes()))
+		}
+		assert.Nil(t, it.Err(), tc.key)
+		assert.Equal(t, expect, got, tc.key)
+		assert.False(t, it.Next(), tc.key)
+		s.Close()
+	}
+}
+
+// Test Searcher.LinesIter() on a multi-block dataset, with early Close
+// and no matches
+func TestLinesIterBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "iter.csv")
+	var buf bytes.Buffer
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 100; j++ {
+			fmt.Fprintf(&buf, "key%d,%03d\n", i, j)
+		}
+	}
+	err = ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := NewIndexOptions(path, IndexOptions{Blocksize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSearcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	it, err := s.LinesIter([]byte("key2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for it.Next() {
+		assert.Equal(t, fmt.Sprintf("key2,%03d", count), string(it.Bytes()))
+		count++
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, 100, count)
+
+	// Early Close releases the dataset reference
+	it, err = s.LinesIter([]byte("key3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, it.Next())
+	assert.Equal(t, "key3,000", string(it.Bytes()))
+	it.Close()
+	it.Close()
+	assert.False(t, it.Next())
+	assert.Equal(t, int64(0), s.snapshot().refs)
+
+	for _, key := range []string{"key", "key5", "aaa"} {
+		it, err = s.LinesIter([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, it.Next(), key)
+		assert.Equal(t, ErrNotFound, it.Err(), key)
+	}
+	assert.Equal(t, int64(0), s.snapshot().refs)
+}
+
+// Test Searcher.LinesPrefixIter() against Searcher.LinesPrefixSuffix()
+func TestLinesPrefixIter(t *testing.T) {
+	var tests = []struct {
+		filename string
+		prefix   string
+	}{
+		{"foo.csv", "ba"},
+		{"foo.csv", "foo"},
+		{"rdns1.csv", "003.12"},
+		{"rdns1.csv", "032.176.184.000"},
+		{"domains1.csv", "a"},
+	}
+
+	for _, tc := range tests {
+		s, err := NewSearcher(filepath.Join("testdata", tc.filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect, err := s.LinesPrefixSuffix([]byte(tc.prefix), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		it, err := s.LinesPrefixIter([]byte(tc.prefix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got [][]byte
+		for it.Next() {
+			got = append(got, clonebs(it.Bytes()))
+		}
+		assert.Nil(t, it.Err(), tc.prefix)
+		assert.Equal(t, expect, got, tc.prefix)
+
+		it, err = s.LinesPrefixIter([]byte("~"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, it.Next(), tc.prefix)
+		assert.Equal(t, ErrNotFound, it.Err(), tc.prefix)
+		assert.Equal(t, int64(0), s.snapshot().refs)
+		s.Close()
+	}
+}
@@ -0,0 +1,308 @@
+/*
+bsearch live searcher, for searching datasets that are being appended to
+(e.g. by a long-running process) while they are being searched
+*/
+
+package bsearch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"launchpad.net/gommap"
+)
+
+const (
+	defaultPollInterval = time.Second
+	// Bytes read at a time when looking for the last complete line
+	liveTailChunk = 4096
+)
+
+var (
+	ErrLiveTruncated = errors.New("live dataset truncated")
+)
+
+// LiveSearcher is a Searcher for a dataset that is being appended to,
+// whose in-memory index is extended as the dataset grows, so that queries
+// see appended lines without a full index rebuild. Only complete
+// (newline-terminated) lines are searchable, so lines being written are
+// not seen until they are complete. Appended lines must keep the dataset
+// sorted.
+//
+// All Searcher methods may be used concurrently with index extension,
+// which replaces the searcher snapshot atomically (as with Reopen).
+type LiveSearcher struct {
+	*Searcher
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewLiveSearcher returns a new LiveSearcher for path using opt, which
+// checks for appended lines every opt.PollInterval (default 1s), and
+// may also be refreshed explicitly via Refresh. The index is generated in
+// memory (any index file is ignored, and none is written), so the dataset
+// must contain at least one complete line. Custom record framers and line
+// counts are not supported. The caller is responsible for calling
+// *LiveSearcher.Close() when finished.
+func NewLiveSearcher(path string, opt SearcherOptions) (*LiveSearcher, error) {
+	if opt.Framer != nil {
+		return nil, ErrFramerUnsupported
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newLiveSnapshot(path, opt, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ls := &LiveSearcher{
+		Searcher: s,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	interval := opt.PollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	go ls.poll(interval)
+	return ls, nil
+}
+
+// poll refreshes the searcher every interval until it is closed
+func (ls *LiveSearcher) poll(interval time.Duration) {
+	defer close(ls.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ls.stop:
+			return
+		case <-ticker.C:
+			err := ls.Refresh()
+			if err != nil && ls.logger != nil {
+				ls.logger.Warn().
+					Str("path", ls.filepath).
+					Err(err).
+					Msg("live searcher refresh failed")
+			}
+		}
+	}
+}
+
+// Refresh extends the searcher index with any complete lines appended to
+// the dataset since the last refresh. If the dataset has been replaced
+// (e.g. by a rename), the index is regenerated instead. Returns an
+// ErrUnsorted error if the appended lines are not sorted (in which case
+// the searcher continues to use the existing data), and ErrLiveTruncated
+// if the dataset is shorter than the searchable data.
+func (ls *LiveSearcher) Refresh() error {
+	ls.reopenMu.Lock()
+	defer ls.reopenMu.Unlock()
+
+	old := ls.snapshot()
+	ns, err := newLiveSnapshot(ls.filepath, ls.opt, old)
+	if err != nil {
+		return err
+	}
+	if ns != old {
+		ls.replace(old, ns)
+	}
+	return nil
+}
+
+// Reopen is equivalent to Refresh for live searchers
+func (ls *LiveSearcher) Reopen() error {
+	return ls.Refresh()
+}
+
+// Close stops checking for appended lines, and closes the searcher
+func (ls *LiveSearcher) Close() {
+	ls.closeOnce.Do(func() {
+		close(ls.stop)
+		<-ls.done
+		ls.Searcher.Close()
+	})
+}
+
+// newLiveSnapshot returns a searcher snapshot for the complete lines of
+// the dataset at path, extending the index of prev (if set) for lines
+// appended since prev was created. Returns prev if there are no new
+// complete lines.
+func newLiveSnapshot(path string, opt SearcherOptions, prev *Searcher) (*Searcher, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrFileNotFound
+		}
+		return nil, err
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			fh.Close()
+		}
+	}()
+	stat, err := fh.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// Extend prev only if the dataset has been appended to, rather than
+	// replaced
+	var start int64
+	if prev != nil && os.SameFile(stat, prev.stat) {
+		if stat.Size() < prev.l {
+			return nil, fmt.Errorf("%w: length %d < searchable length %d",
+				ErrLiveTruncated, stat.Size(), prev.l)
+		}
+		start = prev.l
+	} else {
+		prev = nil
+	}
+	end, err := lastLineEnd(fh, start, stat.Size())
+	if err != nil {
+		return nil, err
+	}
+	if end == start {
+		if prev != nil {
+			return prev, nil
+		}
+		return nil, ErrIndexEmpty
+	}
+
+	mmap, err := gommap.MapRegion(fh.Fd(), 0, end, gommap.PROT_READ, gommap.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+	section := io.NewSectionReader(fh, start, end-start)
+	var index *Index
+	if prev == nil {
+		index, err = newIndexSection(path, stat.ModTime().Unix(), section, IndexOptions{
+			Delimiter:     opt.Delimiter,
+			Header:        opt.Header,
+			TrimKeySpace:  opt.TrimKeySpace,
+			Compare:       opt.Compare,
+			SortKeyColumn: opt.SortKeyColumn,
+			KeyFunc:       opt.KeyFunc,
+			Descending:    opt.Descending,
+			CompactKeys:   opt.CompactKeys,
+			Logger:        opt.Logger,
+		})
+	} else {
+		index, err = prev.Index.extend(section, start, mmap[:start])
+	}
+	if err != nil {
+		gommap.MMap(mmap).UnsafeUnmap()
+		return nil, err
+	}
+
+	s := &Searcher{
+		r:        fh,
+		l:        end,
+		mmap:     mmap,
+		mapped:   true,
+		filepath: path,
+		opt:      opt,
+		stat:     stat,
+		Index:    index,
+	}
+	s.setOptions(opt)
+	ok = true
+	return s, nil
+}
+
+// lastLineEnd returns the offset just past the last newline in the
+// region [start, end) of reader, or start if the region has none
+func lastLineEnd(reader io.ReaderAt, start, end int64) (int64, error) {
+	buf := make([]byte, liveTailChunk)
+	for end > start {
+		offset := end - liveTailChunk
+		if offset < start {
+			offset = start
+		}
+		chunk := buf[:end-offset]
+		_, err := reader.ReadAt(chunk, offset)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if nlidx := bytes.LastIndexByte(chunk, '\n'); nlidx > -1 {
+			return offset + int64(nlidx) + 1, nil
+		}
+		end = offset
+	}
+	return start, nil
+}
+
+// extend returns a copy of the index extended with entries for the lines
+// appended to the dataset read by section (from offset start), where data
+// is the dataset before section (ending with a complete line). Returns an
+// ErrUnsorted error if the appended lines are not sorted, or sort before
+// the last line of data.
+func (i *Index) extend(section *io.SectionReader, start int64, data []byte) (*Index, error) {
+	ext, err := newIndexSection(i.Filepath, i.Epoch, section, IndexOptions{
+		Blocksize:     i.Blocksize,
+		Delimiter:     i.Delimiter,
+		TrimKeySpace:  i.TrimKeySpace,
+		Compare:       i.compare,
+		SortKeyColumn: i.SortKeyColumn,
+		KeyFunc:       i.keyFunc,
+		Descending:    i.Descending,
+		CSVQuoting:    i.CSVQuoting,
+		Logger:        i.logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// An out-of-order second line is treated as a header by index
+	// generation, but appended lines cannot have a header
+	if ext.Header {
+		return nil, fmt.Errorf("%w: appended lines at offset %d are not sorted",
+			ErrUnsorted, start)
+	}
+
+	// Check the appended keys sort after the last existing key
+	lastLine := bytes.TrimSuffix(data, []byte{'\n'})
+	lastLine = lastLine[bytes.LastIndexByte(lastLine, '\n')+1:]
+	lastKey, _ := keyField(lastLine, i.Delimiter, i.SortKeyColumn)
+	if i.CSVQuoting {
+		lastKey, _ = csvKeyField(lastLine, i.Delimiter, i.SortKeyColumn)
+	}
+	if i.keyFunc != nil {
+		lastKey = i.keyFunc(lastLine)
+	}
+	if i.TrimKeySpace {
+		lastKey = bytes.Trim(lastKey, " ")
+	}
+	list := ext.List
+	cmp := i.compareKeys(lastKey, []byte(list[0].Key))
+	if cmp > 0 {
+		return nil, fmt.Errorf("%w: appended key %q at offset %d < previous key %q",
+			ErrUnsorted, list[0].Key, start, lastKey)
+	}
+	if cmp == 0 {
+		// The first appended key continues the last existing one, which
+		// must keep its existing (first) entry
+		list = list[1:]
+	}
+
+	index := *i
+	index.List = make([]IndexEntry, len(i.List), len(i.List)+len(list))
+	copy(index.List, i.List)
+	for _, entry := range list {
+		entry.Offset += start
+		index.List = append(index.List, entry)
+	}
+	index.Length = len(index.List)
+	index.KeysUnique = i.KeysUnique && ext.KeysUnique && cmp != 0
+	index.setLineStarts()
+	return &index, nil
+}
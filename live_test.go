@@ -0,0 +1,149 @@
+package bsearch
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// appendFile appends data to the file at path
+func appendFile(t *testing.T, path, data string) {
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	_, err = fh.WriteString(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test LiveSearcher.Refresh() after appending lines, including partial,
+// duplicate-key, and unsorted lines
+func TestLiveSearcherRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "live.csv")
+	err = ioutil.WriteFile(path, []byte("alpha,1\nbravo,1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls, err := NewLiveSearcher(path, SearcherOptions{PollInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+	line, err := ls.Line([]byte("bravo"))
+	assert.Nil(t, err)
+	assert.Equal(t, "bravo,1", string(line))
+
+	// Appended lines are only visible once complete and refreshed
+	appendFile(t, path, "bravo,2\ncharlie,1\ndel")
+	_, err = ls.Line([]byte("charlie"))
+	assert.Equal(t, ErrNotFound, err)
+	assert.Nil(t, ls.Refresh())
+	lines, err := ls.Lines([]byte("bravo"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("bravo,1"), []byte("bravo,2")}, lines)
+	line, err = ls.Line([]byte("charlie"))
+	assert.Nil(t, err)
+	assert.Equal(t, "charlie,1", string(line))
+	_, err = ls.Line([]byte("delta"))
+	assert.Equal(t, ErrNotFound, err)
+	assert.False(t, ls.CurrentIndex().KeysUnique)
+
+	appendFile(t, path, "ta,1\n")
+	assert.Nil(t, ls.Refresh())
+	line, err = ls.Line([]byte("delta"))
+	assert.Nil(t, err)
+	assert.Equal(t, "delta,1", string(line))
+
+	// Unsorted appended lines are rejected, leaving existing data usable
+	appendFile(t, path, "bravo,3\n")
+	err = ls.Refresh()
+	assert.True(t, errors.Is(err, ErrUnsorted), "unsorted append returns ErrUnsorted")
+	line, err = ls.Line([]byte("delta"))
+	assert.Nil(t, err)
+	assert.Equal(t, "delta,1", string(line))
+}
+
+// Test querying a LiveSearcher concurrently with appends and polling
+func TestLiveSearcherConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "live.csv")
+	err = ioutil.WriteFile(path, []byte("k00000,0\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls, err := NewLiveSearcher(path, SearcherOptions{PollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+
+	// Append lines in pieces, while readers query the first key
+	const count = 500
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				line, err := ls.Line([]byte("k00000"))
+				if err != nil || string(line) != "k00000,0" {
+					t.Errorf("Line(k00000) returned %q, %v", line, err)
+					return
+				}
+			}
+		}()
+	}
+	for n := 1; n <= count; n++ {
+		data := fmt.Sprintf("k%05d,%d\n", n, n)
+		appendFile(t, path, data[:4])
+		appendFile(t, path, data[4:])
+	}
+
+	// Wait for the last line to be indexed
+	last := []byte(fmt.Sprintf("k%05d", count))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err = ls.Line(last)
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+	assert.Nil(t, err, "last appended line found")
+
+	for n := 0; n <= count; n++ {
+		key := fmt.Sprintf("k%05d", n)
+		line, err := ls.Line([]byte(key))
+		assert.Nil(t, err, key)
+		assert.Equal(t, fmt.Sprintf("%s,%d", key, n), string(line))
+	}
+}
@@ -0,0 +1,157 @@
+/*
+SearchMany provides simple fan-out lookups across multiple independent
+sorted datasets.
+*/
+
+package bsearch
+
+// ManySearcher searches multiple independent sorted datasets, keeping a
+// Searcher (and so a loaded index) open for each across lookups.
+// ManySearcher is safe for concurrent use.
+type ManySearcher struct {
+	paths     []string
+	searchers []*Searcher
+}
+
+// NewManySearcher returns a ManySearcher for paths, opening a Searcher for
+// each (using opt). Repeated paths are only searched once.
+func NewManySearcher(paths []string, opt SearcherOptions) (*ManySearcher, error) {
+	m := ManySearcher{}
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		s, err := NewSearcherOptions(path, opt)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.paths = append(m.paths, path)
+		m.searchers = append(m.searchers, s)
+	}
+	return &m, nil
+}
+
+// SearchMany opens a Searcher for each of paths (using opt), and returns
+// a map of path to the lines in that dataset that begin with key.
+// Paths without matches are omitted from the map. Returns ErrNotFound
+// if no dataset has any matches. Use a ManySearcher for repeated lookups.
+func SearchMany(paths []string, key []byte, opt SearcherOptions) (map[string][][]byte, error) {
+	m, err := NewManySearcher(paths, opt)
+	if err != nil {
+		return nil, err
+	}
+	defer m.Close()
+	return m.Search(key)
+}
+
+// SearchManyMerged opens a Searcher for each of paths (using opt), and
+// returns the merged lines from all datasets that begin with key (see
+// ManySearcher.SearchMerged). Use a ManySearcher for repeated lookups.
+func SearchManyMerged(paths []string, key []byte, opt SearcherOptions) ([][]byte, error) {
+	m, err := NewManySearcher(paths, opt)
+	if err != nil {
+		return [][]byte{}, err
+	}
+	defer m.Close()
+	return m.SearchMerged(key)
+}
+
+// search returns the lines in each dataset that begin with key, in paths
+// order
+func (m *ManySearcher) search(key []byte) ([][][]byte, error) {
+	sets := make([][][]byte, len(m.searchers))
+	found := false
+	for i, s := range m.searchers {
+		lines, err := s.Lines(key)
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		if len(lines) > 0 {
+			sets[i] = lines
+			found = true
+		}
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	return sets, nil
+}
+
+// Search returns a map of path to the lines in that dataset that begin
+// with key. Paths without matches are omitted from the map. Returns
+// ErrNotFound if no dataset has any matches.
+func (m *ManySearcher) Search(key []byte) (map[string][][]byte, error) {
+	results := make(map[string][][]byte)
+	sets, err := m.search(key)
+	if err != nil {
+		return results, err
+	}
+	for i, lines := range sets {
+		if len(lines) > 0 {
+			results[m.paths[i]] = lines
+		}
+	}
+	return results, nil
+}
+
+// SearchMerged returns the lines from all datasets that begin with key,
+// as a single slice merged in key order i.e. comparing the line keys as
+// the searchers do (opt.Compare if set, or byte order, reversed for
+// Descending datasets). Lines with equal keys are returned in paths order,
+// and then in dataset order. Returns ErrNotFound if no dataset has any
+// matches.
+func (m *ManySearcher) SearchMerged(key []byte) ([][]byte, error) {
+	sets, err := m.search(key)
+	if err != nil {
+		return [][]byte{}, err
+	}
+
+	// Extract the line keys using each dataset's index
+	var compare func(a, b []byte) int
+	keys := make([][][]byte, len(sets))
+	for i, lines := range sets {
+		if len(lines) == 0 {
+			continue
+		}
+		idx := m.searchers[i].CurrentIndex()
+		if compare == nil {
+			compare = idx.compareKeys
+		}
+		keys[i] = make([][]byte, len(lines))
+		for j, line := range lines {
+			keys[i][j], _ = idx.lineKey(line)
+		}
+	}
+
+	// Merge the (ordered) sets, taking the earliest set on equal keys
+	var merged [][]byte
+	pos := make([]int, len(sets))
+	for {
+		next := -1
+		for i, lines := range sets {
+			if pos[i] >= len(lines) {
+				continue
+			}
+			if next == -1 || compare(keys[i][pos[i]], keys[next][pos[next]]) < 0 {
+				next = i
+			}
+		}
+		if next == -1 {
+			break
+		}
+		merged = append(merged, sets[next][pos[next]])
+		pos[next]++
+	}
+
+	return merged, nil
+}
+
+// Close closes the ManySearcher's searchers
+func (m *ManySearcher) Close() {
+	for _, s := range m.searchers {
+		s.Close()
+	}
+}
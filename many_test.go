@@ -0,0 +1,155 @@
+package bsearch
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test SearchMany() and SearchManyMerged() using testdata/alstom1.csv
+// and testdata/owners.csv
+func TestSearchMany(t *testing.T) {
+	ensureIndex(t, "owners.csv")
+	alstom := filepath.Join("testdata", "alstom1.csv")
+	owners := filepath.Join("testdata", "owners.csv")
+	paths := []string{alstom, owners}
+
+	results, err := SearchMany(paths, []byte("alstom.com"), SearcherOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, 2, len(results[alstom]))
+	assert.Equal(t, "alstom.com,alstom.com,SOA", string(results[alstom][0]))
+	assert.Equal(t, 2, len(results[owners]))
+	assert.Equal(t, "alstom.com,2020-01-01,Alstom SA", string(results[owners][0]))
+
+	// Keys in only one dataset
+	results, err = SearchMany(paths, []byte("zenfolio.com"), SearcherOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, 1, len(results[owners]))
+
+	// Missing keys
+	_, err = SearchMany(paths, []byte("zzz.com"), SearcherOptions{})
+	assert.Equal(t, ErrNotFound, err)
+
+	// Merged results with equal keys should be in paths order
+	lines, err := SearchManyMerged([]string{owners, alstom}, []byte("alstom.com"), SearcherOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{
+		"alstom.com,2020-01-01,Alstom SA",
+		"alstom.com,2021-01-01,Alstom Holdings",
+		"alstom.com,alstom.com,SOA",
+		"alstom.com,alstom.com,ULT",
+	}
+	got := []string{}
+	for _, line := range lines {
+		got = append(got, string(line))
+	}
+	assert.Equal(t, expect, got)
+
+	lines, err = SearchManyMerged(paths, []byte("alstom.com"), SearcherOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = []string{
+		"alstom.com,alstom.com,SOA",
+		"alstom.com,alstom.com,ULT",
+		"alstom.com,2020-01-01,Alstom SA",
+		"alstom.com,2021-01-01,Alstom Holdings",
+	}
+	got = []string{}
+	for _, line := range lines {
+		got = append(got, string(line))
+	}
+	assert.Equal(t, expect, got)
+}
+
+// Test SearchManyMerged() on reverse-sorted datasets, where lines with
+// equal keys stay in paths and then dataset order (rather than being
+// ordered as whole lines)
+func TestSearchManyMergedDescending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var paths []string
+	for i, data := range []string{"zed,1\nkey,5\nkey,3\nkey,1\n", "zed,2\nkey,4\nkey,2\nabc,1\n"} {
+		path := filepath.Join(dir, fmt.Sprintf("desc%d.csv", i))
+		err = ioutil.WriteFile(path, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	lines, err := SearchManyMerged(paths, []byte("key"), SearcherOptions{Descending: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, line := range lines {
+		got = append(got, string(line))
+	}
+	assert.Equal(t, []string{"key,5", "key,3", "key,1", "key,4", "key,2"}, got)
+}
+
+// Test ManySearcher merges on line keys rather than whole lines (so lines
+// with equal keys are in paths order), and can be reused across lookups
+func TestManySearcherMerged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var paths []string
+	for i, data := range []string{"a,2\na,3\nb,1\n", "a,1\nc,1\n"} {
+		path := filepath.Join(dir, fmt.Sprintf("many%d.csv", i))
+		err = ioutil.WriteFile(path, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	m, err := NewManySearcher(paths, SearcherOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	var tests = []struct {
+		key    string
+		expect []string
+	}{
+		{"a", []string{"a,2", "a,3", "a,1"}},
+		{"b", []string{"b,1"}},
+		{"c", []string{"c,1"}},
+	}
+	for _, tc := range tests {
+		lines, err := m.SearchMerged([]byte(tc.key))
+		if err != nil {
+			t.Fatalf("%s: %s\n", tc.key, err.Error())
+		}
+		got := []string{}
+		for _, line := range lines {
+			got = append(got, string(line))
+		}
+		assert.Equal(t, tc.expect, got, tc.key)
+	}
+
+	results, err := m.Search([]byte("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][][]byte{paths[0]: {[]byte("b,1")}}, results)
+
+	_, err = m.SearchMerged([]byte("d"))
+	assert.Equal(t, ErrNotFound, err)
+}
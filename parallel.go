@@ -0,0 +1,234 @@
+/*
+bsearch parallel index generation, for indexing large datasets using
+multiple goroutines
+*/
+
+package bsearch
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// indexChunk is a line-aligned region of a dataset scanned by a worker
+// for generateLineIndexParallel
+type indexChunk struct {
+	start, end int64
+	first      bool // chunk begins the dataset
+	// The lines that may affect the index (see scanIndexChunk), with
+	// lineIndex ordinals relative to the chunk
+	events    []lineEvent
+	lines     int64  // number of data lines scanned
+	dups      bool   // a line has a key equal to the previous line
+	header    []byte // declared header line (first chunk only)
+	firstLine []byte // first line of the dataset (first chunk only)
+	err       error  // scanner error, at offset errPos
+	errPos    int64
+}
+
+// generateLineIndexParallel generates the same index as generateLineIndex
+// for the newline-terminated lines read by reader, using up to workers
+// goroutines. The dataset is split into line-aligned chunks (of at least
+// a block each) which are scanned concurrently, with each worker only
+// keeping the lines that can affect the index - the first line of each
+// block, the first and last lines of the chunk, and lines that break key
+// ordering. These are then added to a single lineIndexer in order, so
+// header detection, duplicate key handling and errors are all as for a
+// sequential scan.
+func generateLineIndexParallel(index *Index, reader *io.SectionReader, workers int) error {
+	size := reader.Size()
+	n := workers
+	if blocks := size / int64(index.Blocksize); blocks < int64(n) {
+		n = int(blocks)
+	}
+	if n <= 1 {
+		return generateLineIndex(index, reader)
+	}
+
+	bounds, err := chunkBounds(reader, size, n, index.Blocksize)
+	if err != nil {
+		return err
+	}
+	chunks := make([]*indexChunk, len(bounds)-1)
+	var wg sync.WaitGroup
+	for c := range chunks {
+		chunks[c] = &indexChunk{start: bounds[c], end: bounds[c+1], first: c == 0}
+		wg.Add(1)
+		go func(chunk *indexChunk) {
+			defer wg.Done()
+			scanIndexChunk(index, reader, chunk)
+		}(chunks[c])
+	}
+	wg.Wait()
+
+	li := newLineIndexer(index)
+	var base int64
+	for _, chunk := range chunks {
+		if chunk.header != nil {
+			index.setHeader(chunk.header)
+		}
+		if chunk.first {
+			li.firstLine = chunk.firstLine
+		}
+		for e := range chunk.events {
+			ev := &chunk.events[e]
+			ev.lineIndex += base
+			if ev.runStart >= 0 {
+				ev.runStartIndex += base
+			}
+			err = li.add(ev)
+			if err != nil {
+				return err
+			}
+		}
+		if chunk.err != nil {
+			if chunk.err == bufio.ErrTooLong {
+				return fmt.Errorf("%w: line at offset %d is longer than blocksize %d",
+					ErrKeyExceedsBlocksize, chunk.errPos, index.Blocksize)
+			}
+			return chunk.err
+		}
+		if chunk.dups {
+			index.KeysUnique = false
+		}
+		base += chunk.lines
+	}
+	return li.finish(base)
+}
+
+// chunkBounds returns the offsets splitting the size bytes of reader into
+// (up to) n chunks of roughly equal size, each beginning at the start of a
+// line, including 0 and size
+func chunkBounds(reader io.ReaderAt, size int64, n int, blocksize int) ([]int64, error) {
+	bounds := []int64{0}
+	buf := make([]byte, blocksize+1)
+	for c := 1; c < n; c++ {
+		b := size * int64(c) / int64(n)
+		// Align b to the start of the next line (lines are at most
+		// blocksize bytes, so the newline must be within buf)
+		read, err := reader.ReadAt(buf, b-1)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		nlidx := bytes.IndexByte(buf[:read], '\n')
+		if nlidx == -1 {
+			// Leave overlong lines to be reported by the chunk scan
+			continue
+		}
+		b += int64(nlidx)
+		if b >= size || b <= bounds[len(bounds)-1] {
+			continue
+		}
+		bounds = append(bounds, b)
+	}
+	return append(bounds, size), nil
+}
+
+// scanIndexChunk scans the lines of chunk from reader, recording those
+// that may affect the index as chunk events, and stopping at the first
+// line that must be an indexing error
+func scanIndexChunk(index *Index, reader io.ReaderAt, chunk *indexChunk) {
+	scanner := bufio.NewScanner(io.NewSectionReader(reader, chunk.start, chunk.end-chunk.start))
+	scanner.Buffer(make([]byte, index.Blocksize), index.Blocksize)
+	blocksize := int64(index.Blocksize)
+	pos := chunk.start
+	skipHeader := chunk.first && index.Header
+	// The first line of the dataset may be an undeclared header
+	headerPossible := chunk.first && !index.Header
+	numericSeen := false
+	var prevKey []byte
+	var prevPos int64
+	var runStart, runStartIndex int64 = -1, -1
+	var last lineEvent
+	lastEmitted := false
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if skipHeader {
+			skipHeader = false
+			chunk.header = clonebs(line)
+			pos += int64(len(line) + 1)
+			continue
+		}
+		if pos == 0 {
+			chunk.firstLine = clonebs(line)
+		}
+
+		key, hasKey := index.lineKey(line)
+		ev := lineEvent{
+			key:       key,
+			hasKey:    hasKey,
+			pos:       pos,
+			lineIndex: chunk.lines,
+			runStart:  -1,
+		}
+		// The second line of the dataset is needed to report (or clear)
+		// a first line error
+		emit := chunk.lines == 0 || (chunk.first && chunk.lines == 1)
+		stop := false
+		if chunk.lines > 0 {
+			cmp := index.compareKeys(prevKey, key)
+			ev.cmpKnown = true
+			ev.cmp = cmp
+			switch cmp {
+			case -1:
+				if !numericSeen && index.numericDisorder(prevKey, key) {
+					ev.numeric = true
+					numericSeen = true
+					emit = true
+				}
+			case 1:
+				ev.prevKey = clonebs(prevKey)
+				emit = true
+				// Only the first out-of-order line in the first block may
+				// be allowed (as following a header)
+				stop = !headerPossible || prevPos >= blocksize
+				headerPossible = false
+			case 0:
+				chunk.dups = true
+				if index.requireUnique {
+					emit = true
+					stop = true
+				}
+			}
+			if cmp != 0 {
+				runStart, runStartIndex = pos, chunk.lines
+			}
+			ev.runStart, ev.runStartIndex = runStart, runStartIndex
+			if pos/blocksize != prevPos/blocksize {
+				emit = true
+			}
+		}
+		if !hasKey {
+			ev.line = clonebs(line)
+			emit = true
+			stop = stop || pos > 0
+		}
+
+		if emit {
+			ev.key = clonebs(key)
+			chunk.events = append(chunk.events, ev)
+		}
+		chunk.lines++
+		if stop {
+			return
+		}
+		last = ev
+		lastEmitted = emit
+		prevKey = append(prevKey[:0], key...)
+		prevPos = pos
+		pos += int64(len(line) + 1)
+	}
+	if err := scanner.Err(); err != nil {
+		chunk.err = err
+		chunk.errPos = pos
+	}
+
+	// The last line carries the key ordering state to the next chunk
+	if chunk.lines > 0 && !lastEmitted {
+		last.key = prevKey
+		chunk.events = append(chunk.events, last)
+	}
+}
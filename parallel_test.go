@@ -0,0 +1,179 @@
+package bsearch
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+// compareConcurrentIndex checks that indexing path with opt using
+// Concurrency returns the same index (or error) as a sequential index
+func compareConcurrentIndex(t *testing.T, path string, opt IndexOptions, desc string) {
+	expect, expectErr := NewIndexOptions(path, opt)
+	for _, concurrency := range []int{2, 3, 8} {
+		copt := opt
+		copt.Concurrency = concurrency
+		idx, err := NewIndexOptions(path, copt)
+		cdesc := fmt.Sprintf("%s concurrency %d", desc, concurrency)
+		if expectErr != nil {
+			if assert.NotNil(t, err, cdesc) {
+				assert.Equal(t, expectErr.Error(), err.Error(), cdesc)
+			}
+			continue
+		}
+		if assert.Nil(t, err, cdesc) {
+			assert.Equal(t, expect, idx, cdesc)
+		}
+	}
+}
+
+// Test indexing testdata datasets with Concurrency
+func TestIndexConcurrency(t *testing.T) {
+	var tests = []struct {
+		filename string
+		header   bool
+	}{
+		{"rdns1.csv", false},
+		{"foo.csv", false},
+		{"foo.csv", true},
+		{"alstom3.csv", true},
+		{"alstom4.csv", false},
+		{"domains1.csv", false},
+		{"longvalues.csv", false},
+	}
+
+	for _, tc := range tests {
+		for _, blocksize := range []int{0, 64, 256} {
+			for _, lineCounts := range []bool{false, true} {
+				opt := IndexOptions{
+					Header:     tc.header,
+					Blocksize:  blocksize,
+					LineCounts: lineCounts,
+				}
+				desc := fmt.Sprintf("%s header %v blocksize %d lineCounts %v",
+					tc.filename, tc.header, blocksize, lineCounts)
+				compareConcurrentIndex(t, filepath.Join("testdata", tc.filename), opt, desc)
+			}
+		}
+	}
+}
+
+// Test indexing synthetic datasets with Concurrency, including duplicate
+// keys spanning chunks, headers, and indexing errors
+func TestIndexConcurrencySynthetic(t *testing.T) {
+	dups := func() string {
+		var buf bytes.Buffer
+		for i := 0; i < 40; i++ {
+			n := 1
+			if i%5 == 0 {
+				n = 60
+			}
+			for j := 0; j < n; j++ {
+				fmt.Fprintf(&buf, "key%03d,%d\n", i, j)
+			}
+		}
+		return buf.String()
+	}()
+	var tests = []struct {
+		desc string
+		data string
+		opt  IndexOptions
+	}{
+		{"dups", dups, IndexOptions{Blocksize: 64}},
+		{"dups line counts", dups, IndexOptions{Blocksize: 64, LineCounts: true}},
+		{"dups require unique", dups, IndexOptions{Blocksize: 64, RequireUnique: true}},
+		{"dups duplicate entry error", dups, IndexOptions{Blocksize: 64, DuplicateEntryError: true}},
+		{"undeclared header", "zzz,header\n" + dups, IndexOptions{Blocksize: 64, LineCounts: true}},
+		{"declared header", "zzz,header\n" + dups, IndexOptions{Blocksize: 64, Header: true}},
+		{"no delimiter header", "header\n" + dups, IndexOptions{Blocksize: 64}},
+		{"no delimiter", dups + "nodelim\n" + dups, IndexOptions{Blocksize: 64}},
+		{"unsorted", dups + dups, IndexOptions{Blocksize: 64}},
+		{"unsorted header", "zzz,header\nyyy,1\n" + dups, IndexOptions{Blocksize: 64}},
+		{"long line", dups + "key999," + strings.Repeat("x", 100) + "\n", IndexOptions{Blocksize: 64}},
+		{"no trailing newline", strings.TrimSuffix(dups, "\n"), IndexOptions{Blocksize: 64}},
+		{"empty", "", IndexOptions{Blocksize: 64}},
+	}
+
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "concurrency.csv")
+
+	for _, tc := range tests {
+		err = ioutil.WriteFile(path, []byte(tc.data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareConcurrentIndex(t, path, tc.opt, tc.desc)
+	}
+}
+
+// Test the numeric order warning with Concurrency
+func TestIndexConcurrencyNumericWarning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "numeric.csv")
+	var data bytes.Buffer
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&data, "%d,%d\n", i, i)
+	}
+	lines := strings.SplitAfter(data.String(), "\n")
+	lines = lines[:len(lines)-1]
+	for i := 0; i < len(lines); i++ {
+		for j := i + 1; j < len(lines); j++ {
+			if lines[j] < lines[i] {
+				lines[i], lines[j] = lines[j], lines[i]
+			}
+		}
+	}
+	err = ioutil.WriteFile(path, []byte(strings.Join(lines, "")), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	logger := zerolog.New(&buf).Level(zerolog.WarnLevel)
+	_, err = NewIndexOptions(path, IndexOptions{Blocksize: 64, Concurrency: 4, Logger: &logger})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, strings.Count(buf.String(), "CompareNumeric"))
+}
+
+func BenchmarkIndexConcurrency(b *testing.B) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bench.csv")
+	var data bytes.Buffer
+	for i := 0; i < 1000000; i++ {
+		fmt.Fprintf(&data, "%010d,value%d\n", i, i)
+	}
+	err = ioutil.WriteFile(path, data.Bytes(), 0644)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, concurrency := range []int{1, 4} {
+		b.Run(fmt.Sprintf("concurrency-%d", concurrency), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				_, err := NewIndexOptions(path, IndexOptions{Concurrency: concurrency})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
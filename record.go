@@ -0,0 +1,167 @@
+/*
+LineInto provides simple unmarshalling of a single matching dataset line
+into a struct, using `bsearch:"colN"` field tags, and Records provides
+matching lines split into fields.
+*/
+
+package bsearch
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	ErrInvalidDest  = errors.New("dest must be a non-nil pointer to a struct")
+	ErrCSVDelimiter = errors.New("CSVQuoting requires a single character delimiter")
+)
+
+// LineInto finds the first line beginning with key, splits it into fields
+// as Records does (so quoted fields are unquoted with CSVQuoting), and
+// sets the fields of the struct pointed to by dest that have a
+// `bsearch:"colN"` tag to the value of column N (0-based, so col0 is the
+// key). Supported field types are strings, byte slices, bools, and
+// integer and float types.
+// Returns ErrNotFound if there is no matching line.
+func (s *Searcher) LineInto(key []byte, dest interface{}) error {
+	rv := reflect.ValueOf(dest)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return ErrInvalidDest
+	}
+	s = s.acquire()
+	defer s.release()
+
+	line, err := s.Line(key)
+	if err != nil {
+		return err
+	}
+	fields, err := s.parseRecord(line)
+	if err != nil {
+		return err
+	}
+
+	rv = rv.Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		tag, ok := sf.Tag.Lookup("bsearch")
+		if !ok {
+			continue
+		}
+		if !strings.HasPrefix(tag, "col") {
+			return fmt.Errorf("field %s: invalid bsearch tag %q", sf.Name, tag)
+		}
+		col, err := strconv.Atoi(strings.TrimPrefix(tag, "col"))
+		if err != nil || col < 0 {
+			return fmt.Errorf("field %s: invalid bsearch tag %q", sf.Name, tag)
+		}
+		if col >= len(fields) {
+			return fmt.Errorf("field %s: column %d not found in line for %q (%d columns)",
+				sf.Name, col, key, len(fields))
+		}
+		if sf.PkgPath != "" {
+			return fmt.Errorf("field %s: cannot set unexported field", sf.Name)
+		}
+		err = setField(rv.Field(i), []byte(fields[col]))
+		if err != nil {
+			return fmt.Errorf("field %s: %s", sf.Name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// setField sets v to the value parsed from val, based on the kind of v
+func setField(v reflect.Value, val []byte) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(val))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("unsupported field type %s", v.Type())
+		}
+		v.SetBytes(clonebs(val))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(string(val))
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(string(val), 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(string(val), 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(string(val), v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported field type %s", v.Type())
+	}
+	return nil
+}
+
+// Records returns all lines beginning with key, each split into fields on
+// the index delimiter, or parsed using encoding/csv if the CSVQuoting
+// option is set, or the index was generated with it (handling quoted
+// fields containing delimiters or quotes).
+// Returns ErrNotFound if there are no matching lines.
+func (s *Searcher) Records(key []byte) ([][]string, error) {
+	s = s.acquire()
+	defer s.release()
+
+	lines, err := s.Lines(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, ErrNotFound
+	}
+
+	records := make([][]string, 0, len(lines))
+	for _, line := range lines {
+		record, err := s.parseRecord(line)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// parseRecord splits line into fields
+func (s *Searcher) parseRecord(line []byte) ([]string, error) {
+	if !s.csvQuote && !s.Index.CSVQuoting {
+		fields := bytes.Split(line, s.Index.Delimiter)
+		record := make([]string, len(fields))
+		for i, field := range fields {
+			record[i] = string(field)
+		}
+		return record, nil
+	}
+
+	comma, size := utf8.DecodeRune(s.Index.Delimiter)
+	if size != len(s.Index.Delimiter) || comma == utf8.RuneError {
+		return nil, fmt.Errorf("%w: %q", ErrCSVDelimiter, s.Index.Delimiter)
+	}
+	r := csv.NewReader(bytes.NewReader(line))
+	r.Comma = comma
+	r.FieldsPerRecord = -1
+	return r.Read()
+}
@@ -0,0 +1,108 @@
+package bsearch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test Searcher.LineInto() using testdata/rdns1.csv
+func TestSearcherLineInto(t *testing.T) {
+	type rdns struct {
+		IP       string `bsearch:"col0"`
+		Hostname string `bsearch:"col1"`
+		Month    int    `bsearch:"col2"`
+		Domain   []byte `bsearch:"col3"`
+		Ignored  string
+	}
+
+	s, err := NewSearcher("testdata/rdns1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var r rdns
+	err = s.LineInto([]byte("024.066.017.000"), &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "024.066.017.000", r.IP)
+	assert.Equal(t, "S0106905851b9f0e0.rd.shawcable.net", r.Hostname)
+	assert.Equal(t, 202003, r.Month)
+	assert.Equal(t, "shawcable.net", string(r.Domain))
+	assert.Equal(t, "", r.Ignored)
+
+	// Missing key
+	err = s.LineInto([]byte("999.999.999.999"), &r)
+	assert.Equal(t, ErrNotFound, err)
+
+	// Invalid dest
+	err = s.LineInto([]byte("024.066.017.000"), r)
+	assert.Equal(t, ErrInvalidDest, err)
+
+	// Tag/field mismatches
+	var badTag struct {
+		IP string `bsearch:"column0"`
+	}
+	assert.NotNil(t, s.LineInto([]byte("024.066.017.000"), &badTag))
+	var badCol struct {
+		IP string `bsearch:"col9"`
+	}
+	assert.NotNil(t, s.LineInto([]byte("024.066.017.000"), &badCol))
+	var badType struct {
+		Hostname int `bsearch:"col1"`
+	}
+	assert.NotNil(t, s.LineInto([]byte("024.066.017.000"), &badType))
+
+	// Quoted fields containing the delimiter, with CSVQuoting
+	type person struct {
+		Name string `bsearch:"col1"`
+		Note string `bsearch:"col2"`
+	}
+	s2, err := NewSearcherOptions("testdata/quoted.csv", SearcherOptions{
+		Header:     true,
+		CSVQuoting: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	var p person
+	err = s2.LineInto([]byte("alpha"), &p)
+	assert.Nil(t, err)
+	assert.Equal(t, person{Name: "Smith, John", Note: `said "hi"`}, p)
+}
+
+// Test Searcher.Records() using testdata/quoted.csv, with and without
+// CSVQuoting
+func TestSearcherRecords(t *testing.T) {
+	var tests = []struct {
+		key    string
+		quoted bool
+		expect [][]string
+	}{
+		{"alpha", false, [][]string{{"alpha", `"Smith`, ` John"`, `"said ""hi"""`}}},
+		{"alpha", true, [][]string{{"alpha", "Smith, John", `said "hi"`}}},
+		{"beta", false, [][]string{{"beta", "plain", "text"}, {"beta", `"x`, `y"`, "z"}}},
+		{"beta", true, [][]string{{"beta", "plain", "text"}, {"beta", "x,y", "z"}}},
+		{"gamma", true, [][]string{{"gamma", "plain", "text"}}},
+	}
+
+	for _, tc := range tests {
+		s, err := NewSearcherOptions("testdata/quoted.csv", SearcherOptions{
+			Header:     true,
+			CSVQuoting: tc.quoted,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := s.Records([]byte(tc.key))
+		assert.Nil(t, err, tc.key)
+		assert.Equal(t, tc.expect, records, tc.key)
+
+		_, err = s.Records([]byte("delta"))
+		assert.Equal(t, ErrNotFound, err)
+		s.Close()
+	}
+}
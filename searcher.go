@@ -10,11 +10,19 @@ package bsearch
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"github.com/rs/zerolog"
 	"golang.org/x/sys/unix"
@@ -28,29 +36,200 @@ var (
 	ErrNotFound            = errors.New("key not found")
 	ErrKeyExceedsBlocksize = errors.New("key length exceeds blocksize")
 	ErrUnknownDelimiter    = errors.New("cannot guess delimiter from filename")
+	ErrDelimiterMismatch   = errors.New("index delimiter does not match filename delimiter")
+	ErrNoColumns           = errors.New("index has no column names")
+	ErrUnknownColumn       = errors.New("unknown column name")
+	ErrKeyTooShort         = errors.New("key is shorter than minimum key length")
+	ErrNoLineCounts        = errors.New("index has no line counts")
+	ErrFirstBlock          = errors.New("key is in the first block")
+	ErrNoSortKeyColumn     = errors.New("index has no sort key column")
+	ErrTooManyMatches      = errors.New("too many matching lines")
+	ErrValueMismatch       = errors.New("value mismatch")
+	ErrNoFilepath          = errors.New("searcher has no dataset filepath")
 
 	reCompressedUnsupported = regexp.MustCompile(`\.(zst|gz|bz2|xz|zip)$`)
 )
 
 // SearcherOptions struct for use with NewSearcherOptions
 type SearcherOptions struct {
-	MatchLE bool            // use less-than-or-equal-to match semantics
+	// MatchLE makes Line (and LinesN with n = 1) return the last line with
+	// a key less than the search key if no line begins with it (e.g. for
+	// range lookups on range start keys), instead of ErrNotFound
+	MatchLE bool
 	Logger  *zerolog.Logger // debug logger
 	// Index options (used to check index or build new one)
 	Delimiter []byte // delimiter separating fields in dataset
 	Header    bool   // first line of dataset is header and should be ignored
+	// Return errors on index sanity check failures, instead of logging warnings
+	Strict bool
+	// Trim leading and trailing ASCII spaces from both search keys and
+	// dataset keys before comparing them. Note that the dataset must have
+	// been sorted on the trimmed keys, or lookups will fail.
+	TrimKeySpace bool
+	// SortBy, if set, is used to re-sort matching lines before they are
+	// returned (e.g. by a secondary timestamp field). Note that this
+	// requires all matches to be materialized before sorting, even if
+	// only the first n are returned.
+	SortBy func(a, b []byte) bool
+	// OnNotFound, if set, is called by Line/Lines/LinesN when there are
+	// no lines matching key, and its results are returned instead of
+	// ErrNotFound (e.g. to return a default record)
+	OnNotFound func(key []byte) ([][]byte, error)
+	// Return ErrKeyTooShort for search keys shorter than MinKeyLen bytes
+	// (e.g. to avoid very broad searches from user input)
+	MinKeyLen int
+	// Compare, if set, is used to compare keys instead of bytes.Compare
+	// (e.g. a collation comparison from NewCollationCompare). The dataset
+	// must be sorted using the same comparison, and note that a Compare
+	// function is not recorded in the index, so an existing index must
+	// also have been generated with it.
+	Compare func(a, b []byte) int
+	// KeyPad, if set, is applied to search keys before comparison, to
+	// convert them to the format used by dataset keys (e.g. NormalizeIPKey
+	// to zero-pad IPv4 addresses). The padding scheme must match the one
+	// used in the dataset.
+	KeyPad func(k []byte) []byte
+	// LowercaseKey lowercases (ASCII) search keys before comparison, for
+	// searching lowercase-sorted datasets with mixed-case keys. This is
+	// cheaper than a case-insensitive Compare, since dataset keys are
+	// compared as-is.
+	LowercaseKey bool
+	// If building an index fails because a line exceeds the blocksize,
+	// retry with doubled blocksizes up to MaxBlocksize (default 1MB)
+	MaxBlocksize int
+	// If no index exists when the searcher is created, a temporary index is
+	// generated on first use. PersistTempIndex writes it to disk as well,
+	// for reuse by future searchers.
+	PersistTempIndex bool
+	// RebuildIndex generates and writes the index when the searcher is
+	// created if it is missing or stale (instead of deferring generation
+	// of a missing index to first use), so that the index file is kept
+	// up to date. Any error writing the index is returned (rather than
+	// the original LoadIndex error, if the index is not writable).
+	RebuildIndex bool
+	// SortKeyColumn, if set, is the (0-based) column the dataset is sorted
+	// on and indexed by, instead of the first column (see LookupBySortKey)
+	SortKeyColumn int
+	// KeyHash, if set, is applied to search keys (after KeyPad) for
+	// datasets sorted on a hash of their keys (e.g. to distribute hot
+	// keys). The dataset key column must hold the same hash of the
+	// original key, either alone (with the original key in another
+	// column, in which case lines with colliding hashes also match), or
+	// as a prefix of the original key (e.g. "<hash>:<key>", in which case
+	// KeyHash must return the hash and key in the same format).
+	KeyHash func(k []byte) []byte
+	// CSVQuoting parses matching lines with encoding/csv in Records,
+	// handling quoted fields (the delimiter must be a single character)
+	CSVQuoting bool
+	// CacheLastResult caches the results of the last successful
+	// Line/Lines/LinesN query, and returns them directly for an identical
+	// repeat query (key and n), e.g. for UIs re-requesting the same key.
+	// Cached results are shared, so must not be modified by callers. The
+	// cache is invalidated when the searcher is reopened.
+	CacheLastResult bool
+	// Framer, if set, frames dataset records instead of newline-terminated
+	// lines (e.g. LengthPrefixFramer for length-prefixed binary records).
+	// The index must also have been generated with it. Line-oriented
+	// methods (EstimateCount, LinesWithLineNo, LineRange, and secondary
+	// indexes) return ErrFramerUnsupported with custom framers.
+	Framer RecordFramer
+	// Return ErrTooManyMatches from Lines/LinesN if more than MaxMatches
+	// lines match (rather than truncating, as LinesN does), e.g. to reject
+	// accidentally broad queries. Matches are only scanned up to the limit.
+	MaxMatches int
+	// FullKeyMatch compares search keys with the full key field of each
+	// line, rather than as a line prefix. Note that this does not change
+	// results with the default key extraction: prefix matches already
+	// require the delimiter after the key (so "k" does not match a line
+	// "kv,x"), and search keys containing the delimiter match nothing
+	// either way. It only selects the full key comparison, which other
+	// options (e.g. Compare) also imply.
+	FullKeyMatch bool
+	// VerifySorted checks the key ordering of the index block each lookup
+	// begins in, returning an ErrUnsorted error (with the offsets of the
+	// out-of-order lines) if a line key sorts before the one preceding it,
+	// e.g. to validate a new dataset before trusting lookups. The whole
+	// block is scanned on every lookup, so lookups are slower.
+	VerifySorted bool
+	// CompactKeys stores index entry keys in a single allocation (see
+	// IndexOptions.CompactKeys), for both loaded and generated indexes
+	CompactKeys bool
+	// PollInterval is the interval at which a LiveSearcher checks its
+	// dataset for appended lines (default 1s)
+	PollInterval time.Duration
+	// KeyFunc, if set, extracts line keys instead of the key field (see
+	// IndexOptions.KeyFunc). The index must also have been generated with
+	// it.
+	KeyFunc func(line []byte) []byte
+	// Descending is set for datasets sorted in descending key order (see
+	// IndexOptions.Descending). Key lookups return the same lines as for
+	// the equivalent ascending dataset (in dataset order), but prefix
+	// matching methods (LinesPrefixSuffix, Glob) assume ascending order.
+	Descending bool
+	// Index, if set, is used by NewSearcherReader as the dataset index,
+	// instead of generating one. It must have been generated from the
+	// same data (e.g. loaded with LoadIndex for a copy of the dataset).
+	Index *Index
+}
+
+// LineNo is a matching line and its 1-based line number in the dataset
+type LineNo struct {
+	Line   []byte
+	Number int64
 }
 
 // Searcher provides binary search functionality on byte-ordered CSV-style
 // delimited text files.
 type Searcher struct {
-	r        io.ReaderAt     // data reader
-	l        int64           // data length
-	mmap     []byte          // data mmap
-	filepath string          // filename path
-	Index    *Index          // bsearch index
-	matchLE  bool            // LinePosition uses less-than-or-equal-to match semantics
-	logger   *zerolog.Logger // debug logger
+	r        io.ReaderAt            // data reader
+	borrowed bool                   // r is owned by the caller (not closed)
+	l        int64                  // data length
+	mmap     []byte                 // data mmap
+	mapped   bool                   // mmap is a file mapping (not read into memory)
+	filepath string                 // filename path
+	Index    *Index                 // bsearch index
+	matchLE  bool                   // Line falls back to the last line before key
+	strict   bool                   // return errors on index sanity check failures
+	sortBy   func(a, b []byte) bool // optional secondary sort for matching lines
+	keyPad   func(k []byte) []byte  // optional search key padding
+	keyHash  func(k []byte) []byte  // optional search key hashing
+	csvQuote bool                   // parse records using encoding/csv
+	fullKey  bool                   // match search keys against full key fields
+	// optional fallback when no lines match
+	onNotFound func(key []byte) ([][]byte, error)
+	minKeyLen  int             // minimum search key length
+	maxMatches int             // maximum matching lines
+	lowercase  bool            // lowercase (ASCII) search keys
+	opt        SearcherOptions // options used to create searcher (for Reopen)
+	stat       os.FileInfo     // data file stat when opened (for Reopen)
+	logger     *zerolog.Logger // debug logger
+
+	// attached secondary indexes, by column (guarded by secondaryMu)
+	secondary   map[int]*Searcher
+	secondaryMu sync.RWMutex
+	// columns whose secondary indexes were detached by Reopen (set before
+	// the snapshot is published, and read-only thereafter)
+	detached map[int]bool
+
+	// Deferred index generation state (see requireIndex) - indexMu guards
+	// generation, and indexed is set once Index may be read without it
+	indexMu sync.Mutex
+	indexed int32
+
+	// Reopen state - the current snapshot (if reopened), and the snapshot
+	// reader reference count, less one once the snapshot is retired (so
+	// that it falls to -1 when a retired snapshot has no readers)
+	current  atomic.Value // *Searcher
+	reopenMu sync.Mutex
+	refs     int64
+	retired  int32
+	unmapped sync.Once
+
+	// last query result cache (if CacheLastResult)
+	lastMu    sync.Mutex
+	lastKey   []byte
+	lastN     int
+	lastLines [][]byte
 }
 
 //buf      []byte          // data buffer
@@ -63,11 +242,67 @@ func (s *Searcher) setOptions(options SearcherOptions) {
 	if options.MatchLE {
 		s.matchLE = true
 	}
+	if options.Strict {
+		s.strict = true
+	}
+	if options.SortBy != nil {
+		s.sortBy = options.SortBy
+	}
+	if options.OnNotFound != nil {
+		s.onNotFound = options.OnNotFound
+	}
+	if options.MinKeyLen > 0 {
+		s.minKeyLen = options.MinKeyLen
+	}
+	if options.MaxMatches > 0 {
+		s.maxMatches = options.MaxMatches
+	}
+	if options.LowercaseKey {
+		s.lowercase = true
+	}
+	if options.KeyHash != nil {
+		s.keyHash = options.KeyHash
+	}
+	if options.CSVQuoting {
+		s.csvQuote = true
+	}
+	if options.FullKeyMatch {
+		s.fullKey = true
+	}
+	if options.KeyPad != nil {
+		s.keyPad = options.KeyPad
+	}
 	if options.Logger != nil {
 		s.logger = options.Logger
 	}
 }
 
+// checkIndexDelimiter checks that the index delimiter matches the one
+// derived from the searcher filename (if the filename has a known
+// extension). On mismatch it logs a warning, or returns
+// ErrDelimiterMismatch if s.strict is set.
+func (s *Searcher) checkIndexDelimiter() error {
+	delim, err := deriveDelimiter(s.filepath)
+	if err != nil {
+		// Unknown extension - nothing to check
+		return nil
+	}
+	if bytes.Equal(delim, s.Index.Delimiter) {
+		return nil
+	}
+	if s.strict {
+		return ErrDelimiterMismatch
+	}
+	if s.logger != nil {
+		s.logger.Warn().
+			Str("path", s.filepath).
+			Bytes("index_delimiter", s.Index.Delimiter).
+			Bytes("filename_delimiter", delim).
+			Msg("index delimiter does not match filename delimiter")
+	}
+	return nil
+}
+
 // NewSearcher returns a new Searcher for path using default options.
 // The caller is responsible for calling *Searcher.Close() when finished.
 func NewSearcher(path string) (*Searcher, error) {
@@ -75,6 +310,8 @@ func NewSearcher(path string) (*Searcher, error) {
 }
 
 // NewSearcherOptions returns a new Searcher for path using opt.
+// If no index exists for path, a temporary index is generated on first
+// use (see SearcherOptions.PersistTempIndex).
 // The caller is responsible for calling *Searcher.Close() when finished.
 func NewSearcherOptions(path string, opt SearcherOptions) (*Searcher, error) {
 	path, err := filepath.Abs(path)
@@ -93,7 +330,6 @@ func NewSearcherOptions(path string, opt SearcherOptions) (*Searcher, error) {
 	if stat.IsDir() {
 		return nil, ErrNotFile
 	}
-	filesize := stat.Size()
 
 	// Open file
 	rdr, err := os.Open(path)
@@ -101,27 +337,123 @@ func NewSearcherOptions(path string, opt SearcherOptions) (*Searcher, error) {
 		return nil, err
 	}
 
-	// Mmap file
-	mmap, err := gommap.Map(rdr.Fd(), gommap.PROT_READ, gommap.MAP_PRIVATE)
+	s, err := newSearcherFile(path, rdr, opt)
+	if err != nil {
+		rdr.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewSearcherFile returns a new Searcher for the open file fh using opt,
+// for callers managing their own file handles. fh is borrowed rather than
+// owned - *Searcher.Close() does not close it, and the caller must keep it
+// open until the searcher is closed. The index is located via fh.Name()
+// (as for NewSearcherOptions). Note that Reopen opens the file by name,
+// so a reopened searcher owns (and closes) its new file handle.
+// The caller is responsible for calling *Searcher.Close() when finished.
+func NewSearcherFile(fh *os.File, opt SearcherOptions) (*Searcher, error) {
+	path, err := filepath.Abs(fh.Name())
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSearcherFile(path, fh, opt)
+	if err != nil {
+		return nil, err
+	}
+	s.borrowed = true
+	return s, nil
+}
+
+// NewSearcherReader returns a new Searcher for the length bytes of sorted
+// data read from r using opt, for datasets that are not files (e.g. held
+// in memory, or received over the network). The data is read into memory
+// up front. Since there is no filename, opt.Index is used as the index if
+// set, and otherwise an index is generated on first use (which requires
+// opt.Delimiter, and is never written to disk). Close closes r if it is
+// an io.Closer, and Reopen returns ErrNoFilepath.
+// The caller is responsible for calling *Searcher.Close() when finished.
+func NewSearcherReader(r io.ReaderAt, length int64, opt SearcherOptions) (*Searcher, error) {
+	data, err := readData(r, length)
+	if err != nil {
+		return nil, err
+	}
+
+	s := Searcher{
+		r:    r,
+		l:    length,
+		mmap: data,
+		opt:  opt,
+	}
+	s.setOptions(opt)
+	if opt.Index != nil {
+		// Copy the index, so the options below don't modify the caller's
+		idx := *opt.Index
+		s.Index = &idx
+		if opt.Compare != nil {
+			s.Index.compare = opt.Compare
+		}
+		if opt.Framer != nil {
+			s.Index.framer = opt.Framer
+		}
+		if opt.KeyFunc != nil {
+			s.Index.keyFunc = opt.KeyFunc
+		}
+	}
+	return &s, nil
+}
+
+// newSearcherFile returns a new Searcher for path using opt, reading
+// from the open file rdr
+func newSearcherFile(path string, rdr *os.File, opt SearcherOptions) (*Searcher, error) {
+	// Stat the opened file (for length, and for Reopen)
+	fstat, err := rdr.Stat()
 	if err != nil {
 		return nil, err
 	}
+	if fstat.IsDir() {
+		return nil, ErrNotFile
+	}
+
+	// Mmap file, falling back to reading it into memory if it cannot be
+	// mapped (e.g. on filesystems without mmap support)
+	mmap, mapErr := gommap.Map(rdr.Fd(), gommap.PROT_READ, gommap.MAP_PRIVATE)
+	if mapErr != nil {
+		mmap, err = readData(rdr, fstat.Size())
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	s := Searcher{
 		r:        rdr,
-		l:        filesize,
+		l:        fstat.Size(),
 		mmap:     mmap,
+		mapped:   mapErr == nil,
 		filepath: path,
+		opt:      opt,
+		stat:     fstat,
 	}
 	//buf:  nil,
 	//bufOffset: -1,
 	//dbufOffset: -1,
 	s.setOptions(opt)
+	if mapErr != nil && s.logger != nil {
+		s.logger.Debug().
+			Str("path", path).
+			Err(mapErr).
+			Msg("mmap failed, dataset read into memory")
+	}
 
 	// Load index
 	s.Index, err = LoadIndex(path)
-	if err != nil && err != ErrNotFound &&
-		err != ErrIndexExpired && err != ErrIndexPathMismatch {
+	if err == ErrIndexNotFound && !opt.RebuildIndex {
+		// Defer index generation to first use (see requireIndex)
+		s.Index = nil
+		return &s, nil
+	}
+	if err != nil && err != ErrIndexNotFound && err != ErrIndexExpired &&
+		err != ErrIndexPathMismatch && err != ErrIndexChecksumMismatch {
 		return nil, err
 	}
 	if err == nil {
@@ -129,15 +461,30 @@ func NewSearcherOptions(path string, opt SearcherOptions) (*Searcher, error) {
 		// (or we fallthrough and re-create the index below)
 		if (len(opt.Delimiter) == 0 ||
 			bytes.Compare(opt.Delimiter, s.Index.Delimiter) == 0) &&
-			(opt.Header == false || opt.Header == s.Index.Header) {
+			(opt.Header == false || opt.Header == s.Index.Header) &&
+			opt.TrimKeySpace == s.Index.TrimKeySpace &&
+			opt.SortKeyColumn == s.Index.SortKeyColumn &&
+			opt.Descending == s.Index.Descending {
+			s.Index.compare = opt.Compare
+			s.Index.framer = opt.Framer
+			s.Index.keyFunc = opt.KeyFunc
+			if opt.CompactKeys {
+				s.Index.compactKeys()
+			}
+			err = s.checkIndexDelimiter()
+			if err != nil {
+				return nil, err
+			}
 			return &s, nil
 		}
 	}
 
-	// ErrNotFound, or an expired/mismatched index of some kind
+	// A missing (with RebuildIndex), or expired/mismatched index of some kind
 	if s.logger != nil {
 		s.logger.Debug().
+			Bool("not_found", err == ErrIndexNotFound).
 			Bool("expired", err == ErrIndexExpired).
+			Bool("checksum_mismatch", err == ErrIndexChecksumMismatch).
 			Bool("path_mismatch", err == ErrIndexPathMismatch).
 			Str("path", path).
 			Msg("expired/mismatched index")
@@ -149,16 +496,29 @@ func NewSearcherOptions(path string, opt SearcherOptions) (*Searcher, error) {
 		return nil, err
 	}
 	err = unix.Access(idxpath, unix.W_OK)
-	if err != nil {
+	if err != nil && !opt.RebuildIndex {
 		// If we cannot write to the index, return the original idxErr
 		return nil, idxErr
 	}
 
 	idxopt := IndexOptions{
-		Delimiter: opt.Delimiter,
-		Header:    opt.Header,
+		Delimiter:     opt.Delimiter,
+		Header:        opt.Header,
+		TrimKeySpace:  opt.TrimKeySpace,
+		Compare:       opt.Compare,
+		SortKeyColumn: opt.SortKeyColumn,
+		Framer:        opt.Framer,
+		KeyFunc:       opt.KeyFunc,
+		Descending:    opt.Descending,
+		CompactKeys:   opt.CompactKeys,
+		// Retain the checksum of a mismatched index
+		Checksum: idxErr == ErrIndexChecksumMismatch,
+	}
+	s.Index, err = s.newIndex(idxopt)
+	if err != nil {
+		return nil, err
 	}
-	s.Index, err = NewIndexOptions(path, idxopt)
+	err = s.checkIndexDelimiter()
 	if err != nil {
 		return nil, err
 	}
@@ -170,6 +530,88 @@ func NewSearcherOptions(path string, opt SearcherOptions) (*Searcher, error) {
 	return &s, nil
 }
 
+// requireIndex generates a temporary index for the searcher if it has none
+// (i.e. no index existed when it was created), and writes it to disk if
+// the PersistTempIndex option is set. It is safe for concurrent use: the
+// index is generated once, by the first caller, and other callers wait
+// for it. Methods must call requireIndex before reading s.Index.
+func (s *Searcher) requireIndex() error {
+	if atomic.LoadInt32(&s.indexed) == 1 {
+		return nil
+	}
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	if s.Index != nil {
+		atomic.StoreInt32(&s.indexed, 1)
+		return nil
+	}
+	index, err := s.newIndex(IndexOptions{
+		Delimiter:     s.opt.Delimiter,
+		Header:        s.opt.Header,
+		TrimKeySpace:  s.opt.TrimKeySpace,
+		Compare:       s.opt.Compare,
+		SortKeyColumn: s.opt.SortKeyColumn,
+		Framer:        s.opt.Framer,
+		KeyFunc:       s.opt.KeyFunc,
+		Descending:    s.opt.Descending,
+		CompactKeys:   s.opt.CompactKeys,
+	})
+	if err != nil {
+		return err
+	}
+	s.Index = index
+	if s.filepath != "" {
+		err = s.checkIndexDelimiter()
+		if err == nil && s.opt.PersistTempIndex {
+			err = index.Write()
+		}
+		if err != nil {
+			s.Index = nil
+			return err
+		}
+	}
+	atomic.StoreInt32(&s.indexed, 1)
+	return nil
+}
+
+// newIndex returns a new index for the searcher dataset using idxopt. If
+// that fails because a line exceeds the blocksize, it retries with doubled
+// blocksizes, up to the MaxBlocksize option (default autoBlocksizeMax).
+func (s *Searcher) newIndex(idxopt IndexOptions) (*Index, error) {
+	maxBlocksize := s.opt.MaxBlocksize
+	if maxBlocksize <= 0 {
+		maxBlocksize = autoBlocksizeMax
+	}
+	if idxopt.Blocksize <= 0 {
+		idxopt.Blocksize = defaultBlocksize
+	}
+	for {
+		var index *Index
+		var err error
+		if s.filepath == "" {
+			// In-memory dataset (see NewSearcherReader)
+			index, err = newIndexSection("", 0,
+				io.NewSectionReader(bytes.NewReader(s.mmap), 0, s.l), idxopt)
+		} else {
+			index, err = NewIndexOptions(s.filepath, idxopt)
+		}
+		if err == nil || !errors.Is(err, ErrKeyExceedsBlocksize) ||
+			idxopt.Blocksize >= maxBlocksize {
+			return index, err
+		}
+		idxopt.Blocksize *= 2
+		if idxopt.Blocksize > maxBlocksize {
+			idxopt.Blocksize = maxBlocksize
+		}
+		if s.logger != nil {
+			s.logger.Debug().
+				Str("path", s.filepath).
+				Int("blocksize", idxopt.Blocksize).
+				Msg("line exceeds blocksize, retrying index with larger blocksize")
+		}
+	}
+}
+
 func getNBytesFrom(buf []byte, length int, delim []byte) []byte {
 	segment := buf[:length]
 
@@ -181,67 +623,238 @@ func getNBytesFrom(buf []byte, length int, delim []byte) []byte {
 	return segment
 }
 
-// scanLinesWithKey returns the first n lines beginning with key from buf.
-func (s *Searcher) scanLinesWithKey(buf, key []byte, n int) [][]byte {
+// lineKey returns the key from line (the sort key column field if the
+// index uses SortKeyColumn, or as extracted by KeyFunc, unquoted if it
+// uses CSVQuoting, and trimmed of spaces if it uses TrimKeySpace)
+func (s *Searcher) lineKey(line []byte) []byte {
+	if s.Index.keyFunc != nil {
+		line = s.Index.keyFunc(line)
+	} else if s.Index.CSVQuoting {
+		line, _ = csvKeyField(line, s.Index.Delimiter, s.Index.SortKeyColumn)
+	} else {
+		line, _ = keyField(line, s.Index.Delimiter, s.Index.SortKeyColumn)
+	}
+	if s.Index.TrimKeySpace {
+		return bytes.Trim(line, " ")
+	}
+	return line
+}
+
+// fullKeyCompare returns true if line keys must be extracted in full
+// for comparison (rather than compared bytewise against a key prefix)
+func (s *Searcher) fullKeyCompare() bool {
+	return s.fullKey || s.Index.TrimKeySpace || s.Index.compare != nil ||
+		s.Index.SortKeyColumn > 0 || s.Index.keyFunc != nil || s.Index.Descending ||
+		s.Index.CSVQuoting
+}
+
+// skipLinesBefore returns the position of the first record in buf with
+// a key greater-than-or-equal-to key (i.e. the position the record framer
+// frames it from), or len(buf) if there is none.
+func (s *Searcher) skipLinesBefore(buf, key []byte) int {
+	framer := s.framer()
+	fullKey := s.fullKeyCompare()
+	pos := 0
+	for {
+		start, end, ok := framer.NextRecord(buf, pos)
+		if !ok {
+			return len(buf)
+		}
+		line := buf[start:end]
+		if fullKey {
+			if s.Index.compareKeys(s.lineKey(line), key) > -1 {
+				return pos
+			}
+		} else {
+			n := len(key)
+			if len(line) < n {
+				n = len(line)
+			}
+			k := getNBytesFrom(line, n, s.Index.Delimiter)
+			if bytes.Compare(k, key) > -1 {
+				return pos
+			}
+		}
+		pos = end
+	}
+}
+
+// scanLinesWithKeyFunc calls fn for each line in buf beginning with key,
+// in order, until fn returns false. The line passed to fn is a subslice
+// of buf, so must be cloned if it is retained.
+func (s *Searcher) scanLinesWithKeyFunc(buf, key []byte, fn func(line []byte) bool) {
 	// This differs from the old scanLinesMatching in that it assumes
 	// that buf contains *all* lines we might need, rather than just
 	// an initial block.
-	var lines [][]byte
 
 	// Skip lines with a key < ours
-	keyde := append(key, s.Index.Delimiter...)
-	offset := 0
-	for offset < len(buf) {
-		// If buf is out of space, we're done
-		if len(buf)-offset < len(key) {
-			return lines
+	pos := s.skipLinesBefore(buf, key)
+
+	// Process lines beginning with key
+	keyde := keyDelim(key, s.Index.Delimiter)
+	fullKey := s.fullKeyCompare()
+	framer := s.framer()
+	for {
+		start, end, ok := framer.NextRecord(buf, pos)
+		if !ok {
+			return
 		}
-		k := getNBytesFrom(buf[offset:], len(key), s.Index.Delimiter)
-		if bytes.Compare(k, key) > -1 {
-			break
+		line := buf[start:end]
+		if fullKey {
+			if s.Index.compareKeys(s.lineKey(line), key) != 0 {
+				return
+			}
+		} else if !bytes.HasPrefix(line, keyde) {
+			return
 		}
-		nlidx := bytes.IndexByte(buf[offset:], '\n')
-		if nlidx == -1 {
-			// If no new newline is found, there are no more lines to check
-			return lines
+		if !fn(line) {
+			return
 		}
-		offset += nlidx + 1
+		pos = end
 	}
+}
 
-	// Collate up to n lines beginning with keyde
-	for offset < len(buf) && bytes.HasPrefix(buf[offset:], keyde) {
-		nlidx := bytes.IndexByte(buf[offset:], '\n')
-		if nlidx == -1 {
-			// If no newline found, read to end of buf
-			nlidx = len(buf) - offset
-		}
-		lines = append(lines, clonebs(buf[offset:offset+nlidx]))
-		if n > 0 && len(lines) >= n {
-			break
-		}
-		offset += nlidx + 1
+// lineHasKey returns true if line begins with key (followed by the
+// delimiter, or as a full key when comparing full keys)
+func (s *Searcher) lineHasKey(line, key []byte, fullKey bool) bool {
+	if fullKey {
+		return s.Index.compareKeys(s.lineKey(line), key) == 0
 	}
+	return bytes.HasPrefix(line, key) &&
+		bytes.HasPrefix(line[len(key):], s.Index.Delimiter)
+}
 
-	return lines
+// firstLineWithKey returns the first line beginning with key from buf,
+// or nil if there is none (with fullKey, the line key must compare equal
+// to key, as for lineHasKey). This is a fast path for single line lookups,
+// avoiding the callback and result slice bookkeeping of scanLinesWithKey.
+// The returned line is a subslice of buf.
+func (s *Searcher) firstLineWithKey(buf, key []byte, fullKey bool) []byte {
+	pos := s.skipLinesBefore(buf, key)
+	start, end, ok := s.framer().NextRecord(buf, pos)
+	if !ok {
+		return nil
+	}
+	line := buf[start:end]
+	if !s.lineHasKey(line, key, fullKey) {
+		return nil
+	}
+	return line
 }
 
-// scanIndexedLines returns the first n lines from reader that begin with key.
-// Returns a slice of byte slices on success.
-func (s *Searcher) scanIndexedLines(key []byte, n int) ([][]byte, error) {
+// scanLinesWithKey returns the first n lines beginning with key from buf.
+func (s *Searcher) scanLinesWithKey(buf, key []byte, n int) [][]byte {
 	var lines [][]byte
-	var entry IndexEntry
+	s.scanLinesWithKeyFunc(buf, key, func(line []byte) bool {
+		lines = append(lines, clonebs(line))
+		return n <= 0 || len(lines) < n
+	})
+	return lines
+}
+
+// normaliseKey returns key normalised for comparison with dataset keys
+// (i.e. trimmed of spaces if the index uses TrimKeySpace, lowercased if
+// LowercaseKey is set, padded if a KeyPad function is set, and hashed if
+// a KeyHash function is set)
+func (s *Searcher) normaliseKey(key []byte) []byte {
+	if s.Index != nil && s.Index.TrimKeySpace {
+		key = bytes.Trim(key, " ")
+	}
+	if s.lowercase {
+		key = asciiLower(key)
+	}
+	if s.keyPad != nil {
+		key = s.keyPad(key)
+	}
+	if s.keyHash != nil {
+		key = s.keyHash(key)
+	}
+	return key
+}
+
+// asciiLower returns key with ASCII uppercase letters lowercased (key is
+// returned as-is if it has none)
+func asciiLower(key []byte) []byte {
+	var lower []byte
+	for i, c := range key {
+		if c >= 'A' && c <= 'Z' {
+			if lower == nil {
+				lower = clonebs(key)
+			}
+			lower[i] = c + ('a' - 'A')
+		}
+	}
+	if lower == nil {
+		return key
+	}
+	return lower
+}
+
+// blockEntry returns the index entry (and its position in the index List)
+// for the first block that may contain key.
+// Returns ErrIndexCorrupt if the entry offset lies outside the dataset.
+func (s *Searcher) blockEntry(key []byte) (int, IndexEntry, error) {
 	var e int
+	var entry IndexEntry
 	var err error
 	if s.Index.KeysIndexFirst {
 		// If index entries always have the first instance of a key, we
 		// can use the more efficient less-than-or-equal-to block lookup
 		e, entry, err = s.Index.blockEntryLE(key)
 		if err != nil {
-			return lines, err
+			return e, entry, err
 		}
 	} else {
 		e, entry = s.Index.blockEntryLT(key)
 	}
+	if entry.Offset < 0 || entry.Offset > s.l {
+		return e, entry, fmt.Errorf("%w: entry %d offset %d outside dataset (length %d)",
+			ErrIndexCorrupt, e, entry.Offset, s.l)
+	}
+	if s.opt.VerifySorted {
+		if err := s.verifyBlockSorted(e, entry); err != nil {
+			return e, entry, err
+		}
+	}
+	return e, entry, nil
+}
+
+// verifyBlockSorted checks that the keys of the lines in block e (with
+// index entry entry) are in order, returning an ErrUnsorted error
+// describing the first out-of-order pair otherwise
+func (s *Searcher) verifyBlockSorted(e int, entry IndexEntry) error {
+	end := s.l
+	if next, ok := s.Index.blockEntryN(e + 1); ok && next.Offset >= entry.Offset && next.Offset <= s.l {
+		end = next.Offset
+	}
+	buf := s.mmap[entry.Offset:end]
+	framer := s.framer()
+	var prevKey []byte
+	prevStart := -1
+	for pos := 0; ; {
+		start, rend, ok := framer.NextRecord(buf, pos)
+		if !ok {
+			return nil
+		}
+		key := s.lineKey(buf[start:rend])
+		if prevStart > -1 && s.Index.compareKeys(prevKey, key) > 0 {
+			return fmt.Errorf("%w: key %q at offset %d < key %q at offset %d (block %d)",
+				ErrUnsorted, key, entry.Offset+int64(start),
+				prevKey, entry.Offset+int64(prevStart), e)
+		}
+		prevKey, prevStart = key, start
+		pos = rend
+	}
+}
+
+// scanIndexedLines returns the first n lines from reader that begin with key.
+// Returns a slice of byte slices on success.
+func (s *Searcher) scanIndexedLines(key []byte, n int) ([][]byte, error) {
+	var lines [][]byte
+	e, entry, err := s.blockEntry(key)
+	if err != nil {
+		return lines, err
+	}
 	if s.logger != nil {
 		blockEntry := "blockEntryLT"
 		if s.Index.KeysIndexFirst {
@@ -257,6 +870,15 @@ func (s *Searcher) scanIndexedLines(key []byte, n int) ([][]byte, error) {
 			Msg("scanIndexedLines blockEntryXX returned")
 	}
 
+	if n == 1 {
+		// Fast path for single line lookups
+		line := s.firstLineWithKey(s.mmap[entry.Offset:], key, s.fullKeyCompare())
+		if line == nil {
+			return lines, ErrNotFound
+		}
+		return [][]byte{clonebs(line)}, nil
+	}
+
 	lines = s.scanLinesWithKey(s.mmap[entry.Offset:], key, n)
 	if len(lines) == 0 {
 		return lines, ErrNotFound
@@ -264,6 +886,27 @@ func (s *Searcher) scanIndexedLines(key []byte, n int) ([][]byte, error) {
 	return lines, nil
 }
 
+// lineLE returns the last line with a key less than key, for MatchLE
+// lookups where no line begins with key. This is usually in the block
+// located for key, but is the last line of the preceding block if the
+// located block begins after key. Returns ErrNotFound if no line sorts
+// before key.
+func (s *Searcher) lineLE(key []byte) ([]byte, error) {
+	if err := s.requireLineFramer(); err != nil {
+		return nil, err
+	}
+	_, entry, err := s.blockEntry(key)
+	if err != nil {
+		return nil, err
+	}
+	end := entry.Offset + int64(s.skipLinesBefore(s.mmap[entry.Offset:], key))
+	buf := bytes.TrimRight(s.mmap[s.Index.List[0].Offset:end], "\n")
+	if len(buf) == 0 {
+		return nil, ErrNotFound
+	}
+	return clonebs(buf[bytes.LastIndexByte(buf, '\n')+1:]), nil
+}
+
 // Line returns the first line in the reader that begins with key,
 // using a binary search (data must be bytewise-ordered).
 func (s *Searcher) Line(key []byte) ([]byte, error) {
@@ -274,6 +917,76 @@ func (s *Searcher) Line(key []byte) ([]byte, error) {
 	return lines[0], nil
 }
 
+// LineExact returns the first line in the reader whose key field equals
+// key exactly (i.e. the field up to the index delimiter, or the sort key
+// column if the index uses SortKeyColumn), so e.g. "alstom.com" never
+// matches "alstom.com.au". Unlike Line, the OnNotFound fallback and the
+// result cache are not used. Returns ErrNotFound if there is no such line.
+func (s *Searcher) LineExact(key []byte) ([]byte, error) {
+	s = s.acquire()
+	defer s.release()
+	if err := s.requireIndex(); err != nil {
+		return nil, err
+	}
+	key = s.normaliseKey(key)
+	if len(key) < s.minKeyLen {
+		return nil, ErrKeyTooShort
+	}
+	_, entry, err := s.blockEntry(key)
+	if err != nil {
+		return nil, err
+	}
+	line := s.firstLineWithKey(s.mmap[entry.Offset:], key, true)
+	if line == nil {
+		return nil, ErrNotFound
+	}
+	return clonebs(line), nil
+}
+
+// LineEntry returns the first line in the reader that begins with key (as
+// for Line), and the index entry for the block containing it, e.g. for
+// checking the distribution of keys across blocks. This is normally the
+// block entry the lookup began from, but may be a following block (if the
+// index is not KeysIndexFirst, or matching lines begin at a block
+// boundary). The length of the block is given by BlockKey. Unlike Line,
+// the OnNotFound fallback and the result cache are not used.
+func (s *Searcher) LineEntry(key []byte) ([]byte, IndexEntry, error) {
+	s = s.acquire()
+	defer s.release()
+	if err := s.requireIndex(); err != nil {
+		return nil, IndexEntry{}, err
+	}
+	if err := s.requireLineFramer(); err != nil {
+		return nil, IndexEntry{}, err
+	}
+	key = s.normaliseKey(key)
+	if len(key) < s.minKeyLen {
+		return nil, IndexEntry{}, ErrKeyTooShort
+	}
+	e, entry, err := s.blockEntry(key)
+	if err != nil {
+		return nil, IndexEntry{}, err
+	}
+
+	buf := s.mmap[entry.Offset:]
+	pos := s.skipLinesBefore(buf, key)
+	start, end, ok := s.framer().NextRecord(buf, pos)
+	if !ok || !s.lineHasKey(buf[start:end], key, s.fullKeyCompare()) {
+		return nil, IndexEntry{}, ErrNotFound
+	}
+
+	// Advance to the last block beginning at or before the line
+	offset := entry.Offset + int64(start)
+	for {
+		next, ok := s.Index.blockEntryN(e + 1)
+		if !ok || next.Offset > offset {
+			break
+		}
+		e, entry = e+1, next
+	}
+	return clonebs(buf[start:end]), entry, nil
+}
+
 // Lines returns all lines in the reader that begin with the byte
 // slice b, using a binary search (data must be bytewise-ordered).
 func (s *Searcher) Lines(b []byte) ([][]byte, error) {
@@ -282,12 +995,36 @@ func (s *Searcher) Lines(b []byte) ([][]byte, error) {
 
 // LinesN returns the first n lines in the reader that begin with key,
 // using a binary search (data must be bytewise-ordered).
+// An empty key matches lines with an empty key field (i.e. lines that
+// begin with the delimiter), not all lines.
 func (s *Searcher) LinesN(key []byte, n int) ([][]byte, error) {
+	s = s.acquire()
+	defer s.release()
+
+	// If no index exists, build and use a temporary one
+	err := s.requireIndex()
+	if err != nil {
+		return [][]byte{}, err
+	}
+	key = s.normaliseKey(key)
+	if len(key) < s.minKeyLen {
+		return [][]byte{}, ErrKeyTooShort
+	}
+
+	// MatchLE applies to single line lookups
+	le := s.matchLE && n == 1
+
 	// If keys are unique max(n) is 1
 	if n == 0 && s.Index.KeysUnique {
 		n = 1
 	}
 
+	if s.opt.CacheLastResult {
+		if lines, ok := s.lastResult(key, n); ok {
+			return lines, nil
+		}
+	}
+
 	/*
 		// FIXME: revisit compression
 		if s.isCompressed() {
@@ -298,44 +1035,1183 @@ func (s *Searcher) LinesN(key []byte, n int) ([][]byte, error) {
 		}
 	*/
 
-	// If no index exists, build and use a temporary one (but don't write)
-	if s.Index == nil {
-		index, err := NewIndex(s.filepath)
-		if err != nil {
-			return [][]byte{}, err
+	// With maxMatches, we only need to scan one more line than the limit
+	// to know if it is exceeded
+	limit := n
+	all := 0
+	if s.maxMatches > 0 && (n == 0 || n > s.maxMatches) {
+		limit = s.maxMatches + 1
+		all = limit
+	}
+
+	var lines [][]byte
+	if s.sortBy != nil {
+		// If sortBy is set, we need all matches, then sort and truncate
+		lines, err = s.scanIndexedLines(key, all)
+		if err == nil {
+			sort.SliceStable(lines, func(i, j int) bool {
+				return s.sortBy(lines[i], lines[j])
+			})
+			if n > 0 && len(lines) > n {
+				lines = lines[:n]
+			}
+		}
+	} else {
+		lines, err = s.scanIndexedLines(key, limit)
+	}
+	if s.maxMatches > 0 && len(lines) > s.maxMatches {
+		return [][]byte{}, fmt.Errorf("%w: more than %d lines match %q",
+			ErrTooManyMatches, s.maxMatches, key)
+	}
+	if err == ErrNotFound && le {
+		var line []byte
+		line, err = s.lineLE(key)
+		if err == nil {
+			lines = [][]byte{line}
 		}
-		s.Index = index
+	}
+	if err == nil && s.opt.CacheLastResult {
+		s.setLastResult(key, n, lines)
 	}
 
-	return s.scanIndexedLines(key, n)
+	// If nothing was found and we have an onNotFound fallback, use that
+	if err == ErrNotFound && s.onNotFound != nil {
+		return s.onNotFound(key)
+	}
+	return lines, err
 }
 
-// Close closes the searcher's reader (if applicable)
-func (s *Searcher) Close() {
-	if closer, ok := s.r.(io.Closer); ok {
-		closer.Close()
+// ValuePrefix returns at most maxValueBytes bytes of the value of the
+// first line beginning with key i.e. of the portion of the line after the
+// first delimiter (or after the first field, which may be quoted, if the
+// index uses CSVQuoting). Only the returned bytes are copied, so this
+// avoids copying very large values when only a prefix is required. A
+// negative maxValueBytes returns the whole value.
+func (s *Searcher) ValuePrefix(key []byte, maxValueBytes int) ([]byte, error) {
+	s = s.acquire()
+	defer s.release()
+	if err := s.requireIndex(); err != nil {
+		return nil, err
+	}
+	key = s.normaliseKey(key)
+	if len(key) < s.minKeyLen {
+		return nil, ErrKeyTooShort
+	}
+	_, entry, err := s.blockEntry(key)
+	if err != nil {
+		return nil, err
+	}
+	line := s.firstLineWithKey(s.mmap[entry.Offset:], key, s.fullKeyCompare())
+	if line == nil {
+		return nil, ErrNotFound
+	}
+
+	var value []byte
+	if s.Index.CSVQuoting {
+		_, value, _ = csvField(line, s.Index.Delimiter)
+	} else if d := bytes.Index(line, s.Index.Delimiter); d > -1 {
+		value = line[d+len(s.Index.Delimiter):]
 	}
+	if maxValueBytes >= 0 && len(value) > maxValueBytes {
+		value = value[:maxValueBytes]
+	}
+	return clonebs(value), nil
 }
 
-// prefixCompare compares the initial sequence of bufa matches b
-// (up to len(b) only).
-func prefixCompare(bufa, b []byte) int {
-	// If len(bufa) < len(b) we compare up to len(bufa), but disallow equality
-	if len(bufa) < len(b) {
-		cmp := bytes.Compare(bufa, b[:len(bufa)])
-		if cmp == 0 {
-			// An equal match here is short, so actually a less than
-			return -1
-		}
-		return cmp
+// LineValue returns the value of the first line beginning with key i.e.
+// the portion of the line after the first index delimiter, saving callers
+// from trimming the key and delimiter from Line results themselves. The
+// value is empty if the line has no delimiter. Like ValuePrefix, the
+// LinesN result cache and OnNotFound fallback are not used.
+func (s *Searcher) LineValue(key []byte) ([]byte, error) {
+	return s.ValuePrefix(key, -1)
+}
+
+// Has returns true if the dataset contains a line with key, without
+// copying the line. Like Line, it uses the index (generating a temporary
+// one if required) and the key is normalised, but the LinesN result cache
+// and OnNotFound fallback are not used.
+func (s *Searcher) Has(key []byte) (bool, error) {
+	s = s.acquire()
+	defer s.release()
+	if err := s.requireIndex(); err != nil {
+		return false, err
+	}
+	key = s.normaliseKey(key)
+	if len(key) < s.minKeyLen {
+		return false, ErrKeyTooShort
+	}
+	_, entry, err := s.blockEntry(key)
+	if err == ErrNotFound {
+		return false, nil
 	}
+	if err != nil {
+		return false, err
+	}
+	return s.firstLineWithKey(s.mmap[entry.Offset:], key, s.fullKeyCompare()) != nil, nil
+}
 
-	return bytes.Compare(bufa[:len(b)], b)
+// lastResult returns the cached results of the last query, if it was
+// for key and n
+func (s *Searcher) lastResult(key []byte, n int) ([][]byte, bool) {
+	s.lastMu.Lock()
+	defer s.lastMu.Unlock()
+	if s.lastLines == nil || n != s.lastN || !bytes.Equal(key, s.lastKey) {
+		return nil, false
+	}
+	return s.lastLines, true
 }
 
-// clonebs returns a copy of the given byte slice
-func clonebs(b []byte) []byte {
-	c := make([]byte, len(b))
-	copy(c, b)
-	return c
+// setLastResult caches lines as the results of the last query (for key
+// and n)
+func (s *Searcher) setLastResult(key []byte, n int, lines [][]byte) {
+	s.lastMu.Lock()
+	defer s.lastMu.Unlock()
+	s.lastKey = clonebs(key)
+	s.lastN = n
+	s.lastLines = lines
+}
+
+// LinesReverse returns all lines in the dataset that begin with key, in
+// reverse order (e.g. for the last n matches of an ascending dataset).
+// Rather than scanning forward from the first match, it starts from the
+// last index block that may contain key, and walks blocks backward while
+// the matching region continues into the previous block.
+func (s *Searcher) LinesReverse(key []byte) ([][]byte, error) {
+	s = s.acquire()
+	defer s.release()
+	if err := s.requireIndex(); err != nil {
+		return nil, err
+	}
+	key = s.normaliseKey(key)
+	if len(key) < s.minKeyLen {
+		return nil, ErrKeyTooShort
+	}
+
+	// Find the last block whose first key is <= key
+	list := s.Index.List
+	e := sort.Search(len(list), func(i int) bool {
+		return s.Index.compareKeys([]byte(list[i].Key), key) > 0
+	}) - 1
+	if e < 0 {
+		return nil, ErrNotFound
+	}
+
+	var lines [][]byte
+	framer := s.framer()
+	fullKey := s.fullKeyCompare()
+	for ; e >= 0; e-- {
+		start := list[e].Offset
+		end := s.l
+		if e+1 < len(list) {
+			end = list[e+1].Offset
+		}
+		if start < 0 || start > end || end > s.l {
+			return nil, fmt.Errorf("%w: entry %d offset %d outside dataset (length %d)",
+				ErrIndexCorrupt, e, start, s.l)
+		}
+
+		// Collect the block matches, and add them in reverse
+		buf := s.mmap[start:end]
+		var block [][]byte
+		continues := false
+		for pos := s.skipLinesBefore(buf, key); ; {
+			rstart, rend, ok := framer.NextRecord(buf, pos)
+			if !ok {
+				break
+			}
+			line := buf[rstart:rend]
+			if !s.lineHasKey(line, key, fullKey) {
+				break
+			}
+			if pos == 0 {
+				// The block begins with a match, so matches may continue
+				// into the previous block
+				continues = true
+			}
+			block = append(block, line)
+			pos = rend
+		}
+		for i := len(block) - 1; i >= 0; i-- {
+			lines = append(lines, clonebs(block[i]))
+		}
+		if !continues {
+			break
+		}
+	}
+
+	if len(lines) == 0 {
+		return nil, ErrNotFound
+	}
+	return lines, nil
+}
+
+// LastLine returns the last line in the dataset that begins with key,
+// i.e. the final line that Lines would return. Matching lines are scanned
+// forward from the first (continuing into following blocks as required),
+// but only the last is copied.
+func (s *Searcher) LastLine(key []byte) ([]byte, error) {
+	s = s.acquire()
+	defer s.release()
+	if err := s.requireIndex(); err != nil {
+		return nil, err
+	}
+	key = s.normaliseKey(key)
+	if len(key) < s.minKeyLen {
+		return nil, ErrKeyTooShort
+	}
+	_, entry, err := s.blockEntry(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var last []byte
+	s.scanLinesWithKeyFunc(s.mmap[entry.Offset:], key, func(line []byte) bool {
+		last = line
+		return true
+	})
+	if last == nil {
+		return nil, ErrNotFound
+	}
+	return clonebs(last), nil
+}
+
+// LookupBySortKey returns all lines in the dataset whose sort key column
+// (see SearcherOptions.SortKeyColumn) equals sk, using a binary search.
+// This allows locale-correct lookups using plain byte comparisons, by
+// sorting the dataset on a column of precomputed sort keys (e.g. ICU sort
+// key bytes) while retaining the human-readable key in another column.
+// Returns ErrNoSortKeyColumn if the index has no sort key column.
+func (s *Searcher) LookupBySortKey(sk []byte) ([][]byte, error) {
+	s = s.acquire()
+	defer s.release()
+	if err := s.requireIndex(); err != nil {
+		return nil, err
+	}
+	if s.Index.SortKeyColumn == 0 {
+		return nil, ErrNoSortKeyColumn
+	}
+	return s.Lines(sk)
+}
+
+// LinesPrefixSuffix returns all lines in the dataset whose key begins
+// with prefix and ends with suffix (compared bytewise, or using the
+// Compare option if set). Note that only the prefix benefits from the
+// index - all keys with the prefix are scanned, and filtered on suffix.
+func (s *Searcher) LinesPrefixSuffix(prefix, suffix []byte) ([][]byte, error) {
+	s = s.acquire()
+	defer s.release()
+	if err := s.requireIndex(); err != nil {
+		return nil, err
+	}
+	prefix = s.normaliseKey(prefix)
+	if len(prefix) < s.minKeyLen {
+		return nil, ErrKeyTooShort
+	}
+	_, entry, err := s.blockEntry(prefix)
+	if err == ErrNotFound {
+		// Keys beginning with prefix may still sort after the first key
+		entry = s.Index.List[0]
+	} else if err != nil {
+		return nil, err
+	}
+
+	var lines [][]byte
+	buf := s.mmap[entry.Offset:]
+	framer := s.framer()
+	pos := s.skipLinesBefore(buf, prefix)
+	for {
+		start, end, ok := framer.NextRecord(buf, pos)
+		if !ok {
+			break
+		}
+		line := buf[start:end]
+		key := s.lineKey(line)
+		if !s.hasKeyPrefix(key, prefix) {
+			break
+		}
+		if s.hasKeySuffix(key, suffix) {
+			lines = append(lines, clonebs(line))
+		}
+		pos = end
+	}
+	if len(lines) == 0 {
+		return nil, ErrNotFound
+	}
+	return lines, nil
+}
+
+// LinesBetween returns all lines in the dataset with keys in the range
+// [lo, hi) i.e. greater-than-or-equal-to lo and less than hi, in dataset
+// order. Keys are compared in full (using the index Compare function, if
+// set), so e.g. a range of ["010.", "011.") returns all keys beginning
+// with "010.". The index is used to locate lo, and lines are then scanned
+// up to the first key >= hi (or the end of the dataset). Returns an empty
+// slice if lo >= hi, and ErrNotFound if no lines fall in a non-empty range.
+func (s *Searcher) LinesBetween(lo, hi []byte) ([][]byte, error) {
+	s = s.acquire()
+	defer s.release()
+	if err := s.requireIndex(); err != nil {
+		return nil, err
+	}
+	lo = s.normaliseKey(lo)
+	hi = s.normaliseKey(hi)
+	if s.Index.compareKeys(lo, hi) >= 0 {
+		return [][]byte{}, nil
+	}
+	_, entry, err := s.blockEntry(lo)
+	if err == ErrNotFound {
+		// lo sorts before the first index entry
+		entry = s.Index.List[0]
+	} else if err != nil {
+		return nil, err
+	}
+
+	var lines [][]byte
+	buf := s.mmap[entry.Offset:]
+	framer := s.framer()
+	pos := s.skipLinesBefore(buf, lo)
+	for {
+		start, end, ok := framer.NextRecord(buf, pos)
+		if !ok {
+			break
+		}
+		line := buf[start:end]
+		if s.Index.compareKeys(s.lineKey(line), hi) >= 0 {
+			break
+		}
+		lines = append(lines, clonebs(line))
+		pos = end
+	}
+	if len(lines) == 0 {
+		return nil, ErrNotFound
+	}
+	return lines, nil
+}
+
+// Glob returns all lines in the dataset whose key field matches the glob
+// pattern, using path.Match semantics (so '*' and '?' do not match '/').
+// Only the literal prefix of pattern (before its first wildcard) benefits
+// from the index - all keys with that prefix are scanned and filtered on
+// the full pattern, so a pattern with a leading wildcard degrades to a
+// scan of the whole dataset (subject to MinKeyLen, which applies to the
+// literal prefix). Returns path.ErrBadPattern if pattern is malformed,
+// and ErrNotFound if no lines match.
+func (s *Searcher) Glob(pattern []byte) ([][]byte, error) {
+	s = s.acquire()
+	defer s.release()
+	if err := s.requireIndex(); err != nil {
+		return nil, err
+	}
+	// Check pattern syntax up front (Match only reports errors lazily)
+	if _, err := path.Match(string(pattern), ""); err != nil {
+		return nil, err
+	}
+	prefix := pattern
+	if i := bytes.IndexAny(pattern, "*?[\\"); i > -1 {
+		prefix = pattern[:i]
+	}
+	if len(prefix) < s.minKeyLen {
+		return nil, ErrKeyTooShort
+	}
+	_, entry, err := s.blockEntry(prefix)
+	if err == ErrNotFound {
+		// Keys beginning with prefix may still sort after the first key
+		entry = s.Index.List[0]
+	} else if err != nil {
+		return nil, err
+	}
+
+	var lines [][]byte
+	glob := string(pattern)
+	buf := s.mmap[entry.Offset:]
+	framer := s.framer()
+	pos := s.skipLinesBefore(buf, prefix)
+	for {
+		start, end, ok := framer.NextRecord(buf, pos)
+		if !ok {
+			break
+		}
+		line := buf[start:end]
+		key := s.lineKey(line)
+		if !s.hasKeyPrefix(key, prefix) {
+			break
+		}
+		if matched, _ := path.Match(glob, string(key)); matched {
+			lines = append(lines, clonebs(line))
+		}
+		pos = end
+	}
+	if len(lines) == 0 {
+		return nil, ErrNotFound
+	}
+	return lines, nil
+}
+
+// hasKeyPrefix returns true if key begins with prefix. With a custom
+// comparison, prefixes of key are compared at each rune boundary, since
+// equal keys may differ in length (e.g. with collations).
+func (s *Searcher) hasKeyPrefix(key, prefix []byte) bool {
+	if s.Index.compare == nil {
+		return bytes.HasPrefix(key, prefix)
+	}
+	for i := 0; ; {
+		cmp := s.Index.compare(key[:i], prefix)
+		if cmp == 0 {
+			return true
+		}
+		if cmp > 0 || i == len(key) {
+			return false
+		}
+		_, size := utf8.DecodeRune(key[i:])
+		i += size
+	}
+}
+
+// hasKeySuffix returns true if key ends with suffix. With a custom
+// comparison, suffixes of key are compared at each rune boundary, as for
+// hasKeyPrefix.
+func (s *Searcher) hasKeySuffix(key, suffix []byte) bool {
+	if s.Index.compare == nil {
+		return bytes.HasSuffix(key, suffix)
+	}
+	for i := len(key); ; {
+		if s.Index.compare(key[i:], suffix) == 0 {
+			return true
+		}
+		if i == 0 {
+			return false
+		}
+		_, size := utf8.DecodeLastRune(key[:i])
+		i -= size
+	}
+}
+
+// FieldByName returns the value of the name column from the first line
+// beginning with key, using the column names recorded in the index from
+// the dataset header. Returns ErrNoColumns if the index has no column
+// names, and ErrUnknownColumn if name is not one of them. The line is
+// split into fields as for Records, so quoted fields are parsed if the
+// CSVQuoting option is set.
+func (s *Searcher) FieldByName(key []byte, name string) ([]byte, error) {
+	s = s.acquire()
+	defer s.release()
+	if err := s.requireIndex(); err != nil {
+		return nil, err
+	}
+	if len(s.Index.Columns()) == 0 {
+		return nil, ErrNoColumns
+	}
+	col := -1
+	for i, c := range s.Index.Columns() {
+		if c == name {
+			col = i
+			break
+		}
+	}
+	if col == -1 {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownColumn, name)
+	}
+
+	line, err := s.Line(key)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := s.parseRecord(line)
+	if err != nil {
+		return nil, err
+	}
+	if col >= len(fields) {
+		return nil, fmt.Errorf("line for %q has no %q column (%d fields)",
+			key, name, len(fields))
+	}
+	return []byte(fields[col]), nil
+}
+
+// AssertValue checks that field (0-based, or negative to count back from
+// the last field) of the first line beginning with key equals expected,
+// e.g. for data integrity checks in test suites. Lines are split into
+// fields as Records does, so quoted fields are unquoted with CSVQuoting. Returns ErrNotFound if
+// there is no line for key, and an ErrValueMismatch error describing the
+// difference if the field differs or does not exist.
+func (s *Searcher) AssertValue(key []byte, field int, expected []byte) error {
+	s = s.acquire()
+	defer s.release()
+	line, err := s.Line(key)
+	if err != nil {
+		return err
+	}
+	fields, err := s.parseRecord(line)
+	if err != nil {
+		return err
+	}
+	column := field
+	if column < 0 {
+		column += len(fields)
+	}
+	if column < 0 || column >= len(fields) {
+		return fmt.Errorf("%w: line for key %q has no field %d: %q",
+			ErrValueMismatch, key, field, line)
+	}
+	value := fields[column]
+	if value != string(expected) {
+		return fmt.Errorf("%w: key %q field %d is %q, expected %q",
+			ErrValueMismatch, key, field, value, expected)
+	}
+	return nil
+}
+
+// LinesChan streams all lines in the reader that begin with key on the
+// returned line channel, which is closed when all matches have been sent,
+// or when ctx is cancelled. Errors (including ErrNotFound if there are no
+// matches, and ctx.Err() if cancellation interrupted sending, so that not
+// all matches were sent) are sent on the error channel, which is closed
+// after the line channel.
+// Lines are sent unbuffered, so the scan blocks until each line is
+// received. Each line is a copy, so remains valid after the scan moves on.
+// SortBy is not applied, since it requires all matches to be materialized.
+func (s *Searcher) LinesChan(ctx context.Context, key []byte) (<-chan []byte, <-chan error) {
+	lc := make(chan []byte)
+	ec := make(chan error, 1)
+	s = s.acquire()
+	if err := s.requireIndex(); err != nil {
+		s.release()
+		close(lc)
+		ec <- err
+		close(ec)
+		return lc, ec
+	}
+	key = s.normaliseKey(key)
+
+	go func() {
+		defer close(ec)
+		defer close(lc)
+		defer s.release()
+
+		if len(key) < s.minKeyLen {
+			ec <- ErrKeyTooShort
+			return
+		}
+		_, entry, err := s.blockEntry(key)
+		if err != nil {
+			ec <- err
+			return
+		}
+
+		found, interrupted := false, false
+		s.scanLinesWithKeyFunc(s.mmap[entry.Offset:], key, func(line []byte) bool {
+			select {
+			case lc <- clonebs(line):
+				found = true
+				return true
+			case <-ctx.Done():
+				interrupted = true
+				return false
+			}
+		})
+		if interrupted {
+			ec <- ctx.Err()
+		} else if !found {
+			ec <- ErrNotFound
+		}
+	}()
+
+	return lc, ec
+}
+
+// MissingKeys returns the keys from keys (which must be sorted) that do
+// not exist in the dataset. Rather than doing a full lookup for each key,
+// this does a single forward pass through the dataset, only jumping ahead
+// via the index where that skips data.
+func (s *Searcher) MissingKeys(keys [][]byte) ([][]byte, error) {
+	s = s.acquire()
+	defer s.release()
+	if err := s.requireIndex(); err != nil {
+		return nil, err
+	}
+
+	var missing [][]byte
+	var offset int64
+	var prevKey []byte
+	for i, key := range keys {
+		nkey := s.normaliseKey(key)
+		if i > 0 && s.Index.compareKeys(nkey, prevKey) < 0 {
+			return nil, fmt.Errorf("keys not sorted - %q < %q", nkey, prevKey)
+		}
+		prevKey = nkey
+
+		_, entry, err := s.blockEntry(nkey)
+		if err == ErrNotFound {
+			missing = append(missing, key)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry.Offset > offset {
+			offset = entry.Offset
+		}
+
+		// Advance to the first line >= nkey, and check if it matches
+		offset += int64(s.skipLinesBefore(s.mmap[offset:], nkey))
+		found := false
+		s.scanLinesWithKeyFunc(s.mmap[offset:], nkey, func(line []byte) bool {
+			found = true
+			return false
+		})
+		if !found {
+			missing = append(missing, key)
+		}
+	}
+
+	return missing, nil
+}
+
+// Count returns the number of lines in the reader that begin with key
+// (i.e. the number of lines Lines would return), scanning the matches in
+// place without copying them. Returns 0 (and no error) if no lines match.
+// MaxMatches and OnNotFound are not applied.
+func (s *Searcher) Count(key []byte) (int, error) {
+	s = s.acquire()
+	defer s.release()
+	if err := s.requireIndex(); err != nil {
+		return 0, err
+	}
+	key = s.normaliseKey(key)
+	if len(key) < s.minKeyLen {
+		return 0, ErrKeyTooShort
+	}
+	_, entry, err := s.blockEntry(key)
+	if err == ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	s.scanLinesWithKeyFunc(s.mmap[entry.Offset:], key, func(line []byte) bool {
+		count++
+		return true
+	})
+	return count, nil
+}
+
+// EstimateCount returns cheap lower and upper bounds on the number of lines
+// beginning with key, without materializing them. The lower bound is the
+// number of matches within the first block examined (at most Blocksize
+// bytes), and the upper bound assumes every line between there and the
+// next index entry with a greater key is a minimal-length match. With
+// TrimKeySpace, a custom Compare or a KeyFunc, matching keys can be
+// shorter than key, so the upper bound is instead the number of lines in
+// that region (which requires counting them). These are estimates only -
+// use Count to get an exact count.
+func (s *Searcher) EstimateCount(key []byte) (min, max int, err error) {
+	s = s.acquire()
+	defer s.release()
+	if err := s.requireIndex(); err != nil {
+		return 0, 0, err
+	}
+	if err := s.requireLineFramer(); err != nil {
+		return 0, 0, err
+	}
+	key = s.normaliseKey(key)
+	e, entry, err := s.blockEntry(key)
+	if err == ErrNotFound {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Find the end of the region that can contain key i.e. the offset of
+	// the first subsequent entry with a key greater than key
+	end := s.l
+	list := s.Index.List[e+1:]
+	n := sort.Search(len(list), func(i int) bool {
+		return s.Index.compareKeys([]byte(list[i].Key), key) > 0
+	})
+	if n < len(list) {
+		end = list[n].Offset
+	}
+
+	// Count matches in the first block (truncated to the last full line)
+	blockEnd := entry.Offset + int64(s.Index.Blocksize)
+	if blockEnd < end {
+		if nlidx := bytes.LastIndexByte(s.mmap[entry.Offset:blockEnd], '\n'); nlidx > -1 {
+			blockEnd = entry.Offset + int64(nlidx) + 1
+		}
+	} else {
+		blockEnd = end
+	}
+	s.scanLinesWithKeyFunc(s.mmap[entry.Offset:blockEnd], key, func(line []byte) bool {
+		min++
+		return true
+	})
+
+	if s.Index.TrimKeySpace || s.Index.compare != nil || s.Index.keyFunc != nil {
+		// Matching line keys may be shorter than key, so count the lines
+		// in the region instead
+		region := s.mmap[entry.Offset:end]
+		max = bytes.Count(region, []byte{'\n'})
+		if len(region) > 0 && region[len(region)-1] != '\n' {
+			max++
+		}
+	} else {
+		// The shortest possible matching line is key+delimiter+newline
+		max = int((end - entry.Offset) / int64(len(key)+len(s.Index.Delimiter)+1))
+	}
+	if s.Index.KeysUnique && max > 1 {
+		max = 1
+	}
+	if max < min {
+		max = min
+	}
+	return min, max, nil
+}
+
+// BlockKey returns the offset and length of the index block in which
+// lines beginning with key would begin. The (filepath, offset) pair is
+// stable for a given index, so is suitable for use as an external block
+// cache key. Returns ErrNotFound if key sorts before the first block.
+func (s *Searcher) BlockKey(key []byte) (offset int64, length int64, err error) {
+	s = s.acquire()
+	defer s.release()
+	if err := s.requireIndex(); err != nil {
+		return 0, 0, err
+	}
+	e, entry, err := s.blockEntry(s.normaliseKey(key))
+	if err != nil {
+		return 0, 0, err
+	}
+	if next, ok := s.Index.blockEntryN(e + 1); ok {
+		if next.Offset <= entry.Offset || next.Offset > s.l {
+			return 0, 0, fmt.Errorf("%w: entry %d offset %d not in (%d, %d]",
+				ErrIndexCorrupt, e+1, next.Offset, entry.Offset, s.l)
+		}
+		return entry.Offset, next.Offset - entry.Offset, nil
+	}
+	return entry.Offset, s.l - entry.Offset, nil
+}
+
+// MatchSection returns an io.SectionReader over the contiguous byte range
+// of the dataset holding all lines that begin with key (from the start of
+// the first matching line to just past the newline terminating the last),
+// and its length, allowing large matches to be streamed without copying
+// them into memory. This is only possible because searchers only support
+// uncompressed datasets, in which matching lines are contiguous. The
+// section reader reads from the searcher's reader, so is only valid until
+// the searcher is closed or reopened. Returns ErrNotFound if no lines
+// match.
+func (s *Searcher) MatchSection(key []byte) (*io.SectionReader, int64, error) {
+	s = s.acquire()
+	defer s.release()
+	start, end, err := s.matchRange(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return io.NewSectionReader(s.r, start, end-start), end - start, nil
+}
+
+// MatchSize returns the total byte length of all lines that begin with
+// key, including their newlines (i.e. the length of the MatchSection
+// region), without reading the matching lines themselves, e.g. for
+// setting a Content-Length before streaming them. Since searchers only
+// support uncompressed datasets, in which matching lines are contiguous,
+// this is computed from the offsets of the first and last matching lines,
+// so only the blocks at either end of the match are scanned, however many
+// lines match (whereas a compressed dataset would require decompressing
+// and scanning every matching block). Returns ErrNotFound if no lines
+// match.
+func (s *Searcher) MatchSize(key []byte) (int64, error) {
+	s = s.acquire()
+	defer s.release()
+	start, end, err := s.matchRange(key)
+	if err != nil {
+		return 0, err
+	}
+	return end - start, nil
+}
+
+// matchRange returns the dataset offsets of the start of the first line
+// beginning with key, and of the end of the last one (including its
+// newline). The first line is found by scanning forwards from the block
+// entry for key, and the last by scanning backwards from the first index
+// entry with a key greater than key, so the lines in between are not read.
+func (s *Searcher) matchRange(key []byte) (int64, int64, error) {
+	if err := s.requireIndex(); err != nil {
+		return 0, 0, err
+	}
+	if err := s.requireLineFramer(); err != nil {
+		return 0, 0, err
+	}
+	key = s.normaliseKey(key)
+	if len(key) < s.minKeyLen {
+		return 0, 0, ErrKeyTooShort
+	}
+	_, entry, err := s.blockEntry(key)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Find the first matching line
+	fullKey := s.fullKeyCompare()
+	buf := s.mmap[entry.Offset:]
+	pos := s.skipLinesBefore(buf, key)
+	start, lineEnd, ok := s.framer().NextRecord(buf, pos)
+	if !ok || !s.lineHasKey(buf[start:lineEnd], key, fullKey) {
+		return 0, 0, ErrNotFound
+	}
+	first := entry.Offset + int64(start)
+
+	// Find the last matching line, scanning backwards from the next block
+	// with a key greater than key (all lines between the last match and
+	// that block have greater keys)
+	list := s.Index.List
+	e := sort.Search(len(list), func(n int) bool {
+		return s.Index.compareEntryKey(list[n].Key, key) > 0
+	})
+	end := s.l
+	if e < len(list) && list[e].Offset > first {
+		end = list[e].Offset
+	}
+	for end > first {
+		region := s.mmap[first:end]
+		lineEnd := len(region)
+		if region[lineEnd-1] == '\n' {
+			lineEnd--
+		}
+		lineStart := bytes.LastIndexByte(region[:lineEnd], '\n') + 1
+		if lineEnd > lineStart && s.lineHasKey(region[lineStart:lineEnd], key, fullKey) {
+			break
+		}
+		end = first + int64(lineStart)
+	}
+	return first, end, nil
+}
+
+// PrevBlockBytes returns the offset and a copy of the bytes of the index
+// block preceding the block in which lines beginning with key would begin
+// (e.g. for checking block boundaries). Since searchers only support
+// uncompressed datasets, data is the raw dataset bytes read from the
+// mmapped file, without any decompression. Returns ErrFirstBlock if key
+// is in the first block.
+func (s *Searcher) PrevBlockBytes(key []byte) (offset int64, data []byte, err error) {
+	s = s.acquire()
+	defer s.release()
+	if err := s.requireIndex(); err != nil {
+		return 0, nil, err
+	}
+	e, entry, err := s.blockEntry(s.normaliseKey(key))
+	if err != nil {
+		return 0, nil, err
+	}
+	prev, ok := s.Index.blockEntryN(e - 1)
+	if !ok {
+		return 0, nil, ErrFirstBlock
+	}
+	if prev.Offset < 0 || prev.Offset > entry.Offset {
+		return 0, nil, fmt.Errorf("%w: entry %d offset %d not in [0, %d]",
+			ErrIndexCorrupt, e-1, prev.Offset, entry.Offset)
+	}
+	return prev.Offset, clonebs(s.mmap[prev.Offset:entry.Offset]), nil
+}
+
+// LinesWithLineNo returns all lines in the dataset that begin with key,
+// with their 1-based line numbers. Line numbers are physical line numbers
+// in the dataset file, so include any header line (i.e. the first data
+// line of a dataset with a header is line 2). If the index was built with
+// IndexOptions.LineCounts, line numbers are derived from the block line
+// counts, otherwise by counting newlines up to the block offset.
+func (s *Searcher) LinesWithLineNo(key []byte) ([]LineNo, error) {
+	s = s.acquire()
+	defer s.release()
+	if err := s.requireIndex(); err != nil {
+		return nil, err
+	}
+	if err := s.requireLineFramer(); err != nil {
+		return nil, err
+	}
+	key = s.normaliseKey(key)
+	if len(key) < s.minKeyLen {
+		return nil, ErrKeyTooShort
+	}
+	e, entry, err := s.blockEntry(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the line number of the first line in the block
+	var lineno int64
+	if s.Index.LineCounts {
+		lineno = s.Index.blockLineStarts()[e] + 1
+		if s.Index.Header {
+			lineno++
+		}
+	} else {
+		lineno = int64(bytes.Count(s.mmap[:entry.Offset], []byte{'\n'})) + 1
+	}
+
+	buf := s.mmap[entry.Offset:]
+	framer := s.framer()
+	pos := s.skipLinesBefore(buf, key)
+
+	var lines []LineNo
+	fullKey := s.fullKeyCompare()
+	counted := 0
+	for {
+		start, end, ok := framer.NextRecord(buf, pos)
+		if !ok {
+			break
+		}
+		line := buf[start:end]
+		if !s.lineHasKey(line, key, fullKey) {
+			break
+		}
+		lineno += int64(bytes.Count(buf[counted:start], []byte{'\n'}))
+		counted = start
+		lines = append(lines, LineNo{Line: clonebs(line), Number: lineno})
+		pos = end
+	}
+	if len(lines) == 0 {
+		return nil, ErrNotFound
+	}
+	return lines, nil
+}
+
+// LineRange returns up to count data lines starting from the start'th
+// line of the dataset (0-based, excluding any header), using the block
+// line counts recorded by an index built with IndexOptions.LineCounts.
+// Returns ErrNoLineCounts if the index has no line counts, and
+// ErrNotFound if start is beyond the end of the dataset.
+func (s *Searcher) LineRange(start, count int64) ([][]byte, error) {
+	s = s.acquire()
+	defer s.release()
+	if err := s.requireIndex(); err != nil {
+		return nil, err
+	}
+	if err := s.requireLineFramer(); err != nil {
+		return nil, err
+	}
+	if !s.Index.LineCounts {
+		return nil, ErrNoLineCounts
+	}
+	if start < 0 || count < 0 {
+		return nil, fmt.Errorf("invalid line range - start %d, count %d", start, count)
+	}
+	lineStarts := s.Index.blockLineStarts()
+	if start >= lineStarts[len(lineStarts)-1] {
+		return nil, ErrNotFound
+	}
+
+	// Find the block containing line start i.e. the last block whose
+	// first line ordinal is <= start
+	e := sort.Search(len(s.Index.List), func(i int) bool {
+		return lineStarts[i+1] > start
+	})
+	entry := s.Index.List[e]
+	if entry.Offset < 0 || entry.Offset > s.l {
+		return nil, fmt.Errorf("%w: entry %d offset %d outside dataset (length %d)",
+			ErrIndexCorrupt, e, entry.Offset, s.l)
+	}
+
+	// Skip to line start within the block, then collect count lines
+	buf := s.mmap[entry.Offset:]
+	offset := 0
+	for skip := start - lineStarts[e]; skip > 0 && offset < len(buf); skip-- {
+		nlidx := bytes.IndexByte(buf[offset:], '\n')
+		if nlidx == -1 {
+			offset = len(buf)
+			break
+		}
+		offset += nlidx + 1
+	}
+	var lines [][]byte
+	for int64(len(lines)) < count && offset < len(buf) {
+		nlidx := bytes.IndexByte(buf[offset:], '\n')
+		if nlidx == -1 {
+			nlidx = len(buf) - offset
+		}
+		lines = append(lines, clonebs(buf[offset:offset+nlidx]))
+		offset += nlidx + 1
+	}
+	return lines, nil
+}
+
+// Reopen checks whether the searcher's data file has been replaced (e.g.
+// via an atomic rename) or modified since it was opened, and if so,
+// reopens it and reloads (or regenerates) its index using the original
+// options. If the file is unchanged, Reopen is a noop. On error, the
+// searcher continues to use the original file. Returns ErrNoFilepath for
+// searchers created with NewSearcherReader.
+// Reopen is safe for concurrent use with other Searcher methods: the
+// reopened data and index are fully loaded and then swapped in
+// atomically, without blocking readers, and in-flight queries complete
+// against the previous snapshot (whose file is closed and unmapped once
+// they finish). Note that the exported Index field is not updated - use
+// CurrentIndex to get the index in use. Note also that if the data file
+// is replaced before its index is, the reloaded index may be stale, or
+// expired and regenerated.
+func (s *Searcher) Reopen() error {
+	if s.filepath == "" {
+		return ErrNoFilepath
+	}
+	s.reopenMu.Lock()
+	defer s.reopenMu.Unlock()
+
+	stat, err := os.Stat(s.filepath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrFileNotFound
+		}
+		return err
+	}
+	old := s.snapshot()
+	if os.SameFile(stat, old.stat) && stat.Size() == old.stat.Size() &&
+		stat.ModTime().Equal(old.stat.ModTime()) {
+		return nil
+	}
+
+	ns, err := NewSearcherOptions(s.filepath, s.opt)
+	if err != nil {
+		return err
+	}
+	ns.detached = old.detachedColumns()
+	s.replace(old, ns)
+	return nil
+}
+
+// replace makes ns the current searcher snapshot in place of old, which
+// is retired, and unmapped once it has no readers. The caller must hold
+// s.reopenMu.
+func (s *Searcher) replace(old, ns *Searcher) {
+	s.current.Store(ns)
+	old.retire()
+}
+
+// CurrentIndex returns the index currently in use by the searcher, which
+// differs from the Index field once the searcher has been reopened. Returns
+// nil if index generation was deferred (see requireIndex) and no query has
+// required it yet.
+func (s *Searcher) CurrentIndex() *Index {
+	snap := s.snapshot()
+	snap.indexMu.Lock()
+	defer snap.indexMu.Unlock()
+	return snap.Index
+}
+
+// snapshot returns the current searcher snapshot i.e. the searcher
+// itself, unless it has been replaced by Reopen
+func (s *Searcher) snapshot() *Searcher {
+	if ns, ok := s.current.Load().(*Searcher); ok {
+		return ns
+	}
+	return s
+}
+
+// acquire returns the current searcher snapshot with a reader reference
+// held, so that it is not unmapped by Reopen while in use. The caller
+// must call release on the snapshot when finished.
+func (s *Searcher) acquire() *Searcher {
+	for {
+		snap := s.snapshot()
+		atomic.AddInt64(&snap.refs, 1)
+		// Check snap was not replaced before we got our reference
+		if s.snapshot() == snap {
+			return snap
+		}
+		snap.release()
+	}
+}
+
+// release releases a reader reference on a snapshot returned by acquire,
+// unmapping it if it has been retired and this was the last reference
+func (s *Searcher) release() {
+	if atomic.AddInt64(&s.refs, -1) == -1 {
+		s.unmap()
+	}
+}
+
+// retire marks snapshot s as no longer current (once only), unmapping it
+// when it has no readers. Retirement drops a reference rather than
+// setting a flag checked on release, so that a reader acquiring s between
+// another's release and the check cannot have s unmapped under it.
+func (s *Searcher) retire() {
+	if atomic.CompareAndSwapInt32(&s.retired, 0, 1) {
+		s.release()
+	}
+}
+
+// unmap closes and unmaps a retired snapshot (once only)
+func (s *Searcher) unmap() {
+	s.unmapped.Do(func() {
+		s.close()
+		if s.mapped {
+			gommap.MMap(s.mmap).UnsafeUnmap()
+		}
+	})
+}
+
+// Close closes the searcher's reader (if applicable, and not borrowed via
+// NewSearcherFile), and any attached secondary indexes, and unmaps the
+// dataset. If queries (or LineIters) are in flight, this happens once
+// they complete. The searcher must not be used after Close.
+func (s *Searcher) Close() {
+	s.snapshot().retire()
+}
+
+// close closes the reader and any secondary indexes of snapshot s
+func (s *Searcher) close() {
+	if closer, ok := s.r.(io.Closer); ok && !s.borrowed {
+		closer.Close()
+	}
+	s.secondaryMu.Lock()
+	defer s.secondaryMu.Unlock()
+	for _, ss := range s.secondary {
+		ss.Close()
+	}
+}
+
+// prefixCompare compares the initial sequence of bufa matches b
+// (up to len(b) only).
+func prefixCompare(bufa, b []byte) int {
+	// If len(bufa) < len(b) we compare up to len(bufa), but disallow equality
+	if len(bufa) < len(b) {
+		cmp := bytes.Compare(bufa, b[:len(bufa)])
+		if cmp == 0 {
+			// An equal match here is short, so actually a less than
+			return -1
+		}
+		return cmp
+	}
+
+	return bytes.Compare(bufa[:len(b)], b)
+}
+
+// readData reads the length bytes of data from r into memory, for datasets
+// that are not (or cannot be) mmapped
+func readData(r io.ReaderAt, length int64) ([]byte, error) {
+	data := make([]byte, length)
+	_, err := io.ReadFull(io.NewSectionReader(r, 0, length), data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// clonebs returns a copy of the given byte slice
+func clonebs(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+// keyDelim returns key followed by delim in a new slice (rather than
+// appending to key, which would modify the caller's backing array if key
+// has spare capacity)
+func keyDelim(key, delim []byte) []byte {
+	kd := make([]byte, len(key)+len(delim))
+	copy(kd, key)
+	copy(kd[len(key):], delim)
+	return kd
 }
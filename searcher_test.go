@@ -1,9 +1,19 @@
 package bsearch
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	//"github.com/rs/zerolog"
 	//"github.com/rs/zerolog/log"
@@ -190,6 +200,44 @@ alstom.com,alstom.com,ULT
 	}
 }
 
+// Test Searcher.LineExact() using the alstom fixtures
+func TestSearcherLineExact(t *testing.T) {
+	var tests = []struct {
+		filename string
+		header   bool
+		key      string
+		expect   string
+	}{
+		{"alstom1.csv", false, "alstom.com", "alstom.com,alstom.com,SOA"},
+		{"alstom1.csv", false, "alstom.com.au", "alstom.com.au,alstom.com,RED"},
+		{"alstom1.csv", false, "alstom.co", ""},
+		{"alstom1.csv", false, "alstom", ""},
+		{"alstom2.csv", true, "alstom.com", "alstom.com,alstom.com,SOA"},
+		{"alstom2.csv", true, "alstom.com.br", "alstom.com.br,alstom.com,RED"},
+		{"alstom2.csv", true, "alstom.com.b", ""},
+		{"alstom3.csv", true, "alstom.com", "alstom.com,first"},
+		{"alstom3.csv", true, "alstom.c", ""},
+		{"alstom4.csv", true, "alstom.co.th", "alstom.co.th,first"},
+	}
+
+	for _, tc := range tests {
+		desc := tc.filename + " " + tc.key
+		s, err := NewSearcherOptions(filepath.Join("testdata", tc.filename),
+			SearcherOptions{Header: tc.header})
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := s.LineExact([]byte(tc.key))
+		if tc.expect == "" {
+			assert.Equal(t, ErrNotFound, err, desc)
+		} else {
+			assert.Nil(t, err, desc)
+			assert.Equal(t, tc.expect, string(line), desc)
+		}
+		s.Close()
+	}
+}
+
 // Test Searcher.Lines() using testdata/alstom2.csv (header)
 func TestSearcherLines2(t *testing.T) {
 	var tests = []struct {
@@ -338,21 +386,2518 @@ func TestSearcherLinesFoo(t *testing.T) {
 	}
 }
 
-// Benchmark Searcher.Lines()
-func BenchmarkSearcherLines(b *testing.B) {
-	bss, err := NewSearcher("testdata/rdns1.csv")
+// Test NewSearcherOptions() with a .csv index built with a tab delimiter
+func TestSearcherDelimiterMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
 	if err != nil {
-		b.Fatal(err)
+		t.Fatal(err)
 	}
-	defer bss.Close()
-	prefix := []byte("162.")
-	for i := 0; i < b.N; i++ {
-		lines, err := bss.Lines(prefix)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mismatch.csv")
+	// Data lines must include the index delimiter, so include tabs
+	err = ioutil.WriteFile(path, []byte("bar,1\tx\nfoo,2\ty\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Build and write an index with the wrong delimiter
+	idx, err := NewIndexOptions(path, IndexOptions{Delimiter: []byte("\t")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Default options should just warn
+	s, err := NewSearcher(path)
+	assert.Nil(t, err)
+	if s != nil {
+		assert.Equal(t, "\t", string(s.Index.Delimiter))
+		s.Close()
+	}
+
+	// Strict option should return an error
+	_, err = NewSearcherOptions(path, SearcherOptions{Strict: true})
+	assert.Equal(t, ErrDelimiterMismatch, err)
+}
+
+// Test Searcher.Lines() with a SortBy option using testdata/events.csv
+// (matches sorted by the third field, a timestamp)
+func TestSearcherLinesSortBy(t *testing.T) {
+	var tests = []struct {
+		key    string
+		n      int
+		expect []string
+	}{
+		{"alpha", 0, []string{"alpha,b,2020-01-01", "alpha,c,2020-02-01", "alpha,a,2020-03-01"}},
+		{"alpha", 2, []string{"alpha,b,2020-01-01", "alpha,c,2020-02-01"}},
+		{"beta", 0, []string{"beta,x,2021-01-01"}},
+		{"gamma", 1, []string{"gamma,z,2019-05-01"}},
+	}
+
+	field3 := func(line []byte) string {
+		return strings.SplitN(string(line), ",", 3)[2]
+	}
+	o := SearcherOptions{
+		SortBy: func(a, b []byte) bool { return field3(a) < field3(b) },
+	}
+	ensureIndex(t, "events.csv")
+	s, err := NewSearcherOptions("testdata/events.csv", o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range tests {
+		lines, err := s.LinesN([]byte(tc.key), tc.n)
 		if err != nil {
-			b.Fatal(err)
+			t.Fatalf("%s: %s\n", tc.key, err.Error())
+		}
+		got := []string{}
+		for _, line := range lines {
+			got = append(got, string(line))
+		}
+		assert.Equal(t, tc.expect, got, tc.key)
+	}
+}
+
+// Test Searcher.BlockKey() using testdata/foo.csv (header, duplicate keys)
+func TestSearcherBlockKey(t *testing.T) {
+	s, err := NewSearcherOptions("testdata/foo.csv", SearcherOptions{Header: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var total int64
+	for _, key := range []string{"bar", "foo"} {
+		offset, length, err := s.BlockKey([]byte(key))
+		if err != nil {
+			t.Fatalf("%s: %s\n", key, err.Error())
+		}
+		assert.Equal(t, key+",", string(s.mmap[offset:offset+int64(len(key))+1]), key)
+		assert.Equal(t, byte('\n'), s.mmap[offset+length-1], key)
+		total += length
+	}
+	// Both blocks together should cover everything after the header
+	assert.Equal(t, s.l-s.Index.List[0].Offset, total)
+
+	_, _, err = s.BlockKey([]byte("aaa"))
+	assert.Equal(t, ErrNotFound, err)
+}
+
+// Test Searcher.PrevBlockBytes() using testdata/rdns1.csv
+func TestSearcherPrevBlockBytes(t *testing.T) {
+	s, err := NewSearcher("testdata/rdns1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	list := s.Index.List
+	if len(list) < 4 {
+		t.Fatalf("expected at least 4 index entries, got %d\n", len(list))
+	}
+
+	for _, e := range []int{1, 3, len(list) - 1} {
+		key := list[e].Key
+		offset, data, err := s.PrevBlockBytes([]byte(key))
+		if err != nil {
+			t.Fatalf("%s: %s\n", key, err.Error())
+		}
+		assert.Equal(t, list[e-1].Offset, offset, key)
+		assert.Equal(t, list[e].Offset-list[e-1].Offset, int64(len(data)), key)
+		assert.True(t, bytes.HasPrefix(data, []byte(list[e-1].Key+",")), key)
+		assert.Equal(t, byte('\n'), data[len(data)-1], key)
+	}
+
+	_, _, err = s.PrevBlockBytes([]byte(list[0].Key))
+	assert.Equal(t, ErrFirstBlock, err)
+	_, _, err = s.PrevBlockBytes([]byte("000.000.000.000"))
+	assert.Equal(t, ErrNotFound, err)
+}
+
+// Test Searcher.LineEntry() using testdata/rdns1.csv
+func TestSearcherLineEntry(t *testing.T) {
+	s, err := NewSearcher("testdata/rdns1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	list := s.Index.List
+	if len(list) < 4 {
+		t.Fatalf("expected at least 4 index entries, got %d\n", len(list))
+	}
+
+	for _, e := range []int{0, 1, 3, len(list) - 1} {
+		key := list[e].Key
+		line, entry, err := s.LineEntry([]byte(key))
+		if err != nil {
+			t.Fatalf("%s: %s\n", key, err.Error())
+		}
+		expect, err := s.Line([]byte(key))
+		assert.Nil(t, err, key)
+		assert.Equal(t, string(expect), string(line), key)
+		assert.Equal(t, list[e], entry, key)
+	}
+
+	// Lines within a block should return the block entry
+	line, entry, err := s.LineEntry([]byte("001.034.164.000"))
+	assert.Nil(t, err)
+	assert.Equal(t, "001.034.164.000,1-34-164-0.HINET-IP.hinet.net,202003,hinet.net", string(line))
+	assert.Equal(t, list[0], entry)
+
+	_, _, err = s.LineEntry([]byte("000.000.000.000"))
+	assert.Equal(t, ErrNotFound, err)
+}
+
+// Test Searcher.Lines() using testdata/colons.txt (multi-byte delimiter)
+func TestSearcherLinesMultiByteDelimiter(t *testing.T) {
+	var tests = []struct {
+		key    string
+		expect []string
+	}{
+		{"a", []string{"a::1"}},
+		{"a:b", []string{"a:b::2"}},
+		{"ab", []string{"ab::3", "ab::4", "ab::5"}},
+		{"b", []string{"b::8", "b:::9"}},
+		{"bb", []string{"bb::11", "bb::12", "bb::13", "bb::14"}},
+		{"c:c", []string{"c:c::16"}},
+		{"a:", nil},
+		{"c:", nil},
+		{"e", nil},
+	}
+
+	path := "testdata/colons.txt"
+	idx, err := NewIndexOptions(path, IndexOptions{Delimiter: []byte("::"), Blocksize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSearcherOptions(path, SearcherOptions{Delimiter: []byte("::")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range tests {
+		lines, err := s.Lines([]byte(tc.key))
+		if tc.expect == nil {
+			assert.Equal(t, ErrNotFound, err, tc.key)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s\n", tc.key, err.Error())
+		}
+		got := []string{}
+		for _, line := range lines {
+			got = append(got, string(line))
+		}
+		assert.Equal(t, tc.expect, got, tc.key)
+	}
+}
+
+// Test exact key field matching across Searcher methods with a two-byte
+// delimiter, using testdata/colons.txt
+func TestSearcherMultiByteDelimiterMethods(t *testing.T) {
+	path := "testdata/colons.txt"
+	idx, err := NewIndexOptions(path, IndexOptions{Delimiter: []byte("::"), Blocksize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fullKey := range []bool{false, true} {
+		s, err := NewSearcherOptions(path, SearcherOptions{
+			Delimiter:    []byte("::"),
+			FullKeyMatch: fullKey,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc := fmt.Sprintf("fullKey %v", fullKey)
+
+		line, err := s.Line([]byte("a:b"))
+		assert.Nil(t, err, desc)
+		assert.Equal(t, "a:b::2", string(line), desc)
+		line, err = s.LineExact([]byte("b"))
+		assert.Nil(t, err, desc)
+		assert.Equal(t, "b::8", string(line), desc)
+		line, err = s.LastLine([]byte("b"))
+		assert.Nil(t, err, desc)
+		assert.Equal(t, "b:::9", string(line), desc)
+		value, err := s.LineValue([]byte("b"))
+		assert.Nil(t, err, desc)
+		assert.Equal(t, "8", string(value), desc)
+		count, err := s.Count([]byte("bb"))
+		assert.Nil(t, err, desc)
+		assert.Equal(t, 4, count, desc)
+		size, err := s.MatchSize([]byte("ab"))
+		assert.Nil(t, err, desc)
+		assert.Equal(t, int64(len("ab::3\nab::4\nab::5\n")), size, desc)
+		lines, err := s.LinesReverse([]byte("abc"))
+		assert.Nil(t, err, desc)
+		assert.Equal(t, [][]byte{[]byte("abc::7"), []byte("abc::6")}, lines, desc)
+		for _, key := range []string{"a:", "c:", "b:", ":"} {
+			ok, err := s.Has([]byte(key))
+			assert.Nil(t, err, key)
+			assert.False(t, ok, "%s %s", desc, key)
+			_, err = s.Line([]byte(key))
+			assert.Equal(t, ErrNotFound, err, "%s %s", desc, key)
 		}
-		if len(lines) != 12 {
-			b.Fatal(fmt.Errorf("Lines returned %d results, expected 12\n", len(lines)))
+		s.Close()
+	}
+}
+
+// Test lookups using a crafted corrupt index on testdata/foo.csv
+func TestSearcherCorruptIndex(t *testing.T) {
+	s, err := NewSearcherOptions("testdata/foo.csv", SearcherOptions{Header: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Final entry offset beyond the end of the dataset
+	first := s.Index.List[0]
+	s.Index.List = []IndexEntry{first, {Key: "foo", Offset: s.l + 100}}
+	_, err = s.Lines([]byte("foo"))
+	assert.True(t, errors.Is(err, ErrIndexCorrupt), "Lines foo ErrIndexCorrupt")
+	_, _, err = s.BlockKey([]byte("bar"))
+	assert.True(t, errors.Is(err, ErrIndexCorrupt), "BlockKey bar ErrIndexCorrupt")
+
+	// Non-monotonic entry offsets
+	s.Index.List = []IndexEntry{first, {Key: "foo", Offset: first.Offset}}
+	_, _, err = s.BlockKey([]byte("bar"))
+	assert.True(t, errors.Is(err, ErrIndexCorrupt), "BlockKey bar ErrIndexCorrupt")
+}
+
+// Test Searcher.LinesChan() using testdata/foo.csv (header, duplicate keys)
+func TestSearcherLinesChan(t *testing.T) {
+	s, err := NewSearcherOptions("testdata/foo.csv", SearcherOptions{Header: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// All lines
+	lc, ec := s.LinesChan(context.Background(), []byte("foo"))
+	count := 0
+	var last []byte
+	for line := range lc {
+		if count == 0 {
+			assert.Equal(t, "foo,2", string(line))
+		}
+		last = line
+		count++
+	}
+	assert.Nil(t, <-ec)
+	assert.Equal(t, 9999, count)
+	assert.Equal(t, "foo,10000", string(last))
+
+	// Cancellation part-way through
+	ctx, cancel := context.WithCancel(context.Background())
+	lc, ec = s.LinesChan(ctx, []byte("foo"))
+	<-lc
+	<-lc
+	cancel()
+	for range lc {
+	}
+	assert.Equal(t, context.Canceled, <-ec)
+
+	// Cancellation after all lines were sent is not an error
+	lc, ec = s.LinesChan(doneAfterSendCtx{context.Background()}, []byte("bar"))
+	for range lc {
+	}
+	assert.Nil(t, <-ec)
+
+	// Missing key
+	lc, ec = s.LinesChan(context.Background(), []byte("baz"))
+	for range lc {
+		t.Error("unexpected line for missing key")
+	}
+	assert.Equal(t, ErrNotFound, <-ec)
+}
+
+// doneAfterSendCtx is a context reporting cancellation that never
+// interrupts a send (i.e. as if cancelled after the last line was sent)
+type doneAfterSendCtx struct {
+	context.Context
+}
+
+func (doneAfterSendCtx) Done() <-chan struct{} { return nil }
+func (doneAfterSendCtx) Err() error            { return context.Canceled }
+
+// Test Searcher.FieldByName() using testdata/domains2.csv (header)
+func TestSearcherFieldByName(t *testing.T) {
+	var tests = []struct {
+		key    string
+		name   string
+		expect string
+		err    error
+	}{
+		{"accuweather.com", "dr", "567", nil},
+		{"accuweather.com", "domain", "accuweather.com", nil},
+		{"zenfolio.com", "dr", "416", nil},
+		{"zzz.com", "dr", "", ErrNotFound},
+		{"zenfolio.com", "foo", "", ErrUnknownColumn},
+	}
+
+	// Regenerate the index to ensure it includes column names
+	ensureNoIndex(t, "domains2.csv")
+	ensureIndex(t, "domains2.csv")
+	s, err := NewSearcherOptions("testdata/domains2.csv", SearcherOptions{Header: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range tests {
+		val, err := s.FieldByName([]byte(tc.key), tc.name)
+		if tc.err != nil {
+			assert.True(t, errors.Is(err, tc.err), tc.key+" "+tc.name+" error")
+			continue
+		}
+		assert.Nil(t, err, tc.key+" "+tc.name)
+		assert.Equal(t, tc.expect, string(val), tc.key+" "+tc.name)
+	}
+
+	// Datasets without a header have no column names
+	s2, err := NewSearcher("testdata/rdns1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	_, err = s2.FieldByName([]byte("001.000.128.000"), "domain")
+	assert.Equal(t, ErrNoColumns, err)
+
+	// Quoted fields containing the delimiter, with CSVQuoting
+	s3, err := NewSearcherOptions("testdata/quoted.csv", SearcherOptions{
+		Header:     true,
+		CSVQuoting: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s3.Close()
+	for _, tc := range []struct{ key, name, expect string }{
+		{"alpha", "name", "Smith, John"},
+		{"alpha", "note", `said "hi"`},
+		{"beta", "note", "text"},
+	} {
+		val, err := s3.FieldByName([]byte(tc.key), tc.name)
+		assert.Nil(t, err, tc.key+" "+tc.name)
+		assert.Equal(t, tc.expect, string(val), tc.key+" "+tc.name)
+	}
+}
+
+// Test Searcher.Lines() with TrimKeySpace using testdata/padded.csv
+func TestSearcherLinesTrimKeySpace(t *testing.T) {
+	var tests = []struct {
+		key    string
+		expect []string
+	}{
+		{"alpha", []string{" alpha,1"}},
+		{"beta", []string{"beta  ,2"}},
+		{" delta ", []string{"  delta,3"}},
+		{"gamma", []string{"gamma,4", "gamma ,5"}},
+		{"epsilon", nil},
+		{"gam", nil},
+	}
+
+	path := "testdata/padded.csv"
+	idx, err := NewIndexOptions(path, IndexOptions{TrimKeySpace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSearcherOptions(path, SearcherOptions{TrimKeySpace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range tests {
+		lines, err := s.Lines([]byte(tc.key))
+		if tc.expect == nil {
+			assert.Equal(t, ErrNotFound, err, tc.key)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s\n", tc.key, err.Error())
+		}
+		got := []string{}
+		for _, line := range lines {
+			got = append(got, string(line))
+		}
+		assert.Equal(t, tc.expect, got, tc.key)
+	}
+}
+
+// Test Searcher.Line() with an OnNotFound fallback using testdata/domains1.csv
+func TestSearcherOnNotFound(t *testing.T) {
+	var tests = []struct {
+		key    string
+		expect string
+	}{
+		{"accuweather.com", "accuweather.com,567"},
+		{"aaa.com", "default,0"},
+		{"zzz.com", "default,0"},
+	}
+
+	o := SearcherOptions{
+		OnNotFound: func(key []byte) ([][]byte, error) {
+			return [][]byte{[]byte("default,0")}, nil
+		},
+	}
+	s, err := NewSearcherOptions("testdata/domains1.csv", o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range tests {
+		line, err := s.Line([]byte(tc.key))
+		assert.Nil(t, err, tc.key)
+		assert.Equal(t, tc.expect, string(line), tc.key)
+	}
+
+	// Fallback errors should be returned as-is
+	errFallback := errors.New("fallback error")
+	o.OnNotFound = func(key []byte) ([][]byte, error) {
+		return nil, errFallback
+	}
+	s2, err := NewSearcherOptions("testdata/domains1.csv", o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	_, err = s2.Lines([]byte("aaa.com"))
+	assert.Equal(t, errFallback, err)
+}
+
+// Test Searcher.Lines() with MinKeyLen using testdata/domains1.csv
+func TestSearcherMinKeyLen(t *testing.T) {
+	var tests = []struct {
+		key string
+		err error
+	}{
+		{"", ErrKeyTooShort},
+		{"a", ErrKeyTooShort},
+		{"adw", ErrNotFound},
+		{"adweek.com", nil},
+	}
+
+	s, err := NewSearcherOptions("testdata/domains1.csv", SearcherOptions{MinKeyLen: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range tests {
+		_, err := s.Lines([]byte(tc.key))
+		assert.Equal(t, tc.err, err, tc.key)
+		_, err = s.Line([]byte(tc.key))
+		assert.Equal(t, tc.err, err, tc.key)
+	}
+}
+
+func TestSearcherMaxMatches(t *testing.T) {
+	var tests = []struct {
+		maxMatches int
+		n          int
+		count      int
+		err        error
+	}{
+		{111, 0, 111, nil},
+		{200, 0, 111, nil},
+		{110, 0, 0, ErrTooManyMatches},
+		{110, 5, 5, nil},
+		{110, 110, 110, nil},
+		{110, 111, 0, ErrTooManyMatches},
+		{1, 0, 0, ErrTooManyMatches},
+	}
+
+	ensureIndex(t, "rdns2.csv")
+	key := []byte("001.000.128.000")
+	for _, tc := range tests {
+		s, err := NewSearcherOptions("testdata/rdns2.csv", SearcherOptions{MaxMatches: tc.maxMatches})
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines, err := s.LinesN(key, tc.n)
+		if tc.err != nil {
+			assert.ErrorIs(t, err, tc.err, "max %d, n %d", tc.maxMatches, tc.n)
+		} else {
+			assert.Nil(t, err, "max %d, n %d", tc.maxMatches, tc.n)
 		}
+		assert.Equal(t, tc.count, len(lines), "max %d, n %d", tc.maxMatches, tc.n)
+		s.Close()
 	}
 }
+
+// Test MatchLE lookups using testdata/matchle.csv, which has even keys
+// key00 to key30 in 4-line blocks, so that e.g. the LE predecessor of
+// key07 is key06, the last line of the first block
+func TestSearcherMatchLE(t *testing.T) {
+	path := "testdata/matchle.csv"
+	idx, err := NewIndexOptions(path, IndexOptions{Blocksize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 4, len(idx.List))
+	assert.Equal(t, "key08", idx.List[1].Key)
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		key    string
+		expect string
+	}{
+		{"key00", "key00"},
+		{"key01", "key00"},
+		{"key07", "key06"},
+		{"key08", "key08"},
+		{"key0800", "key08"},
+		{"key23", "key22"},
+		{"key99", "key30"},
+		{"key", ""},
+		{"a", ""},
+	}
+	s, err := NewSearcherOptions(path, SearcherOptions{MatchLE: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, tc := range tests {
+		line, err := s.Line([]byte(tc.key))
+		if tc.expect == "" {
+			assert.Equal(t, ErrNotFound, err, tc.key)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s\n", tc.key, err.Error())
+		}
+		assert.Equal(t, tc.expect+",123456789", string(line), tc.key)
+	}
+
+	// MatchLE does not apply to Lines
+	_, err = s.Lines([]byte("key07"))
+	assert.Equal(t, ErrNotFound, err)
+
+	s2, err := NewSearcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	_, err = s2.Line([]byte("key07"))
+	assert.Equal(t, ErrNotFound, err)
+}
+
+// Test Searcher.EstimateCount() bounds against Searcher.Lines()
+func TestSearcherEstimateCount(t *testing.T) {
+	var tests = []struct {
+		filename string
+		header   bool
+		key      string
+	}{
+		{"foo.csv", true, "bar"},
+		{"foo.csv", true, "foo"},
+		{"foo.csv", true, "baz"},
+		{"alstom3.csv", true, "alstom.com"},
+		{"rdns1.csv", false, "032.176.184.000"},
+		{"rdns1.csv", false, "000.000.000.000"},
+		{"domains1.csv", false, "zenfolio.com"},
+	}
+
+	for _, tc := range tests {
+		o := SearcherOptions{Header: tc.header}
+		s, err := NewSearcherOptions(filepath.Join("testdata", tc.filename), o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines, _ := s.Lines([]byte(tc.key))
+		min, max, err := s.EstimateCount([]byte(tc.key))
+		s.Close()
+		assert.Nil(t, err, tc.key)
+		assert.LessOrEqual(t, min, len(lines), tc.key+" min")
+		assert.GreaterOrEqual(t, max, len(lines), tc.key+" max")
+		if len(lines) > 0 {
+			assert.Greater(t, min, 0, tc.key+" min")
+		}
+	}
+}
+
+// Test Searcher.EstimateCount() bounds with CompareNumeric, where matching
+// line keys are shorter than the (zero-padded) search key
+func TestSearcherEstimateCountCompare(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "numeric.csv")
+	var buf bytes.Buffer
+	buf.WriteString("5,a\n")
+	for i := 0; i < 40; i++ {
+		buf.WriteString("7,a\n")
+	}
+	buf.WriteString("8,a\n")
+	err = ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := NewIndexOptions(path, IndexOptions{Blocksize: 32, Compare: CompareNumeric})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSearcherOptions(path, SearcherOptions{Compare: CompareNumeric})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	key := []byte("0007")
+	lines, err := s.Lines(key)
+	assert.Nil(t, err)
+	assert.Equal(t, 40, len(lines))
+	min, max, err := s.EstimateCount(key)
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, min, len(lines), "min")
+	assert.GreaterOrEqual(t, max, len(lines), "max")
+}
+
+// Test Searcher.MissingKeys() using testdata/domains1.csv
+func TestSearcherMissingKeys(t *testing.T) {
+	s, err := NewSearcher("testdata/domains1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	keys := [][]byte{}
+	for _, k := range []string{
+		"aaa.com", "accuweather.com", "adweek.co", "adweek.com", "adweek.com",
+		"etracker.com", "evernote.com", "matterport.com", "openfusion.com.au",
+		"zenfolio.com", "zzz.com",
+	} {
+		keys = append(keys, []byte(k))
+	}
+	missing, err := s.MissingKeys(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, k := range missing {
+		got = append(got, string(k))
+	}
+	assert.Equal(t, []string{"aaa.com", "adweek.co", "openfusion.com.au", "zzz.com"}, got)
+
+	// Unsorted keys should return an error
+	_, err = s.MissingKeys([][]byte{[]byte("zenfolio.com"), []byte("adweek.com")})
+	assert.NotNil(t, err)
+}
+
+// Test Searcher.Reopen() after the data file is atomically replaced
+func TestSearcherReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "reopen.csv")
+	writeDataset := func(data string, mtime time.Time) {
+		tmp := filepath.Join(dir, "reopen.tmp")
+		err := ioutil.WriteFile(tmp, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(tmp, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Rename(tmp, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx, err := NewIndex(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = idx.Write()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now().Add(-time.Minute)
+	writeDataset("bar,1\nfoo,1\n", now)
+	s, err := NewSearcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	line, err := s.Line([]byte("foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, "foo,1", string(line))
+
+	// Unchanged - Reopen is a noop
+	assert.Nil(t, s.Reopen())
+	line, err = s.Line([]byte("foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, "foo,1", string(line))
+
+	// Replace the dataset
+	writeDataset("bar,2\nbaz,2\nfoo,2\n", now.Add(time.Second))
+	line, err = s.Line([]byte("foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, "foo,1", string(line), "stale before Reopen")
+	assert.Nil(t, s.Reopen())
+	line, err = s.Line([]byte("foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, "foo,2", string(line), "updated after Reopen")
+	line, err = s.Line([]byte("baz"))
+	assert.Nil(t, err)
+	assert.Equal(t, "baz,2", string(line))
+}
+
+// Test SearcherOptions.RebuildIndex writes missing and stale indexes
+func TestSearcherRebuildIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rebuild.csv")
+	idxpath, err := IndexPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeDataset := func(data string, mtime time.Time) {
+		err := ioutil.WriteFile(path, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(path, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	opt := SearcherOptions{RebuildIndex: true}
+
+	// Missing indexes are written when the searcher is created
+	writeDataset("alpha,1\nbeta,2\n", time.Now().Add(-time.Hour))
+	s, err := NewSearcherOptions(path, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(t, s.Index)
+	s.Close()
+	_, err = os.Stat(idxpath)
+	assert.Nil(t, err, "index written")
+
+	// Expired indexes are rewritten
+	writeDataset("alpha,1\nbeta,2\ngamma,3\n", time.Now().Add(time.Hour))
+	_, err = LoadIndex(path)
+	assert.Equal(t, ErrIndexExpired, err)
+	s, err = NewSearcherOptions(path, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := s.Line([]byte("gamma"))
+	assert.Nil(t, err)
+	assert.Equal(t, "gamma,3", string(line))
+	s.Close()
+	err = os.Chtimes(path, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadIndex(path)
+	assert.Nil(t, err, "index rewritten")
+
+	// Index write errors are returned
+	err = os.Remove(idxpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { IndexPathFunc = DefaultIndexPath }()
+	IndexPathFunc = func(dataPath string) (string, error) {
+		return filepath.Join(dir, "missing", "rebuild.bsx"), nil
+	}
+	_, err = NewSearcherOptions(path, opt)
+	assert.True(t, os.IsNotExist(errors.Unwrap(err)) || os.IsNotExist(err), "write error %v", err)
+	_, err = NewSearcherOptions(path, SearcherOptions{})
+	assert.Nil(t, err, "index generation deferred without RebuildIndex")
+}
+
+// Test Searcher.Reopen() while concurrently querying (run with -race)
+func TestSearcherReopenConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "reopen.csv")
+	mtime := time.Now().Add(-time.Hour)
+	writeDataset := func(version int) {
+		var buf bytes.Buffer
+		for i := 0; i < 1000; i++ {
+			fmt.Fprintf(&buf, "key%04d,%d\n", i, version)
+		}
+		tmp := filepath.Join(dir, "reopen.tmp")
+		err := ioutil.WriteFile(tmp, buf.Bytes(), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mtime = mtime.Add(time.Second)
+		err = os.Chtimes(tmp, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Rename(tmp, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx, err := NewIndexOptions(path, IndexOptions{Blocksize: 256})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = idx.Write()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeDataset(0)
+	s, err := NewSearcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	reloads := 10
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := r; ; i += 7 {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				key := fmt.Sprintf("key%04d", i%1000)
+				line, err := s.Line([]byte(key))
+				if !assert.Nil(t, err, key) {
+					return
+				}
+				// Each line must come from a single, complete version
+				var version int
+				_, err = fmt.Sscanf(string(line), key+",%d", &version)
+				assert.Nil(t, err, string(line))
+				assert.True(t, version >= 0 && version <= reloads, string(line))
+			}
+		}(r)
+	}
+
+	for v := 1; v <= reloads; v++ {
+		writeDataset(v)
+		assert.Nil(t, s.Reopen())
+	}
+	close(done)
+	wg.Wait()
+
+	line, err := s.Line([]byte("key0500"))
+	assert.Nil(t, err)
+	assert.Equal(t, fmt.Sprintf("key0500,%d", reloads), string(line))
+	assert.Equal(t, s.CurrentIndex().Epoch, mtime.Unix())
+}
+
+// Benchmark Searcher.Lines() for a key with a few matches
+func BenchmarkSearcherLines(b *testing.B) {
+	bss, err := NewSearcher("testdata/rdns1.csv")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer bss.Close()
+	key := []byte("032.176.184.000")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		lines, err := bss.Lines(key)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(lines) != 6 {
+			b.Fatal(fmt.Errorf("Lines returned %d results, expected 6\n", len(lines)))
+		}
+	}
+}
+
+// Benchmark Searcher.Lines() for a high-frequency key
+func BenchmarkSearcherLinesHighFrequency(b *testing.B) {
+	ensureIndex(b, "rdns2.csv")
+	bss, err := NewSearcher("testdata/rdns2.csv")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer bss.Close()
+	key := []byte("001.000.128.000")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		lines, err := bss.Lines(key)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(lines) != 111 {
+			b.Fatal(fmt.Errorf("Lines returned %d results, expected 111\n", len(lines)))
+		}
+	}
+}
+
+// Benchmark Searcher.Line() on a single-block match (fast path)
+func BenchmarkSearcherLine(b *testing.B) {
+	bss, err := NewSearcher("testdata/rdns1.csv")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer bss.Close()
+	key := []byte("202.047.145.000")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, err := bss.Line(key)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Benchmark single-block matches via the general scanLinesWithKey path,
+// for comparison with BenchmarkSearcherLine
+func BenchmarkSearcherLineGeneral(b *testing.B) {
+	bss, err := NewSearcher("testdata/rdns1.csv")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer bss.Close()
+	key := []byte("202.047.145.000")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, entry, err := bss.blockEntry(key)
+		if err != nil {
+			b.Fatal(err)
+		}
+		lines := bss.scanLinesWithKey(bss.mmap[entry.Offset:], key, 1)
+		if len(lines) != 1 {
+			b.Fatal(ErrNotFound)
+		}
+	}
+}
+
+// Test Searcher.LineRange() using copies of testdata/domains2.csv (which
+// has a header) and testdata/indexme.csv (a single key spanning blocks)
+func TestSearcherLineRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"domains2.csv", "indexme.csv"} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name)
+		err = ioutil.WriteFile(path, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx, err := NewIndexOptions(path, IndexOptions{Blocksize: 256, LineCounts: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = idx.Write()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewSearcher(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		// Expected data lines, excluding any header
+		expect := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		if s.Index.Header {
+			expect = expect[1:]
+		}
+		total := int64(len(expect))
+
+		for _, start := range []int64{0, 1, 7, 15, 16, 42, total - 5, total - 1} {
+			for _, count := range []int64{0, 1, 3, 10} {
+				lines, err := s.LineRange(start, count)
+				if err != nil {
+					t.Fatalf("%s [%d:+%d]: %s\n", name, start, count, err.Error())
+				}
+				end := start + count
+				if end > total {
+					end = total
+				}
+				got := []string{}
+				for _, line := range lines {
+					got = append(got, string(line))
+				}
+				assert.Equal(t, expect[start:end], got,
+					fmt.Sprintf("%s [%d:+%d]", name, start, count))
+			}
+		}
+
+		_, err = s.LineRange(total, 1)
+		assert.Equal(t, ErrNotFound, err, name)
+	}
+
+	// Indexes built without LineCounts are rejected
+	s, err := NewSearcher("testdata/rdns1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, err = s.LineRange(0, 1)
+	assert.Equal(t, ErrNoLineCounts, err)
+}
+
+// Test concurrent Searcher.LineRange() calls on a fresh searcher (run
+// with -race)
+func TestSearcherLineRangeConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "linerange.csv")
+	var buf bytes.Buffer
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&buf, "key%05d,%d\n", i, i)
+	}
+	err = ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := NewIndexOptions(path, IndexOptions{Blocksize: 256, LineCounts: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSearcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	start := make(chan struct{})
+	errs := make(chan error, 16)
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			<-start
+			n := int64(g * 100)
+			lines, err := s.LineRange(n, 1)
+			if err == nil && (len(lines) != 1 || string(lines[0]) != fmt.Sprintf("key%05d,%d", n, n)) {
+				err = fmt.Errorf("line %d: unexpected lines %q", n, lines)
+			}
+			errs <- err
+		}(g)
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Test Searcher.Line() with LowercaseKey using testdata/domains1.csv
+// (which is lowercase)
+func TestSearcherLineLowercaseKey(t *testing.T) {
+	var tests = []struct {
+		key    string
+		expect string
+	}{
+		{"accuweather.com", "accuweather.com,567"},
+		{"AccuWeather.com", "accuweather.com,567"},
+		{"ADYEN.COM", "adyen.com,524"},
+		{"adWeek.com", "adweek.com,305"},
+	}
+
+	s, err := NewSearcherOptions("testdata/domains1.csv", SearcherOptions{LowercaseKey: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range tests {
+		key := []byte(tc.key)
+		line, err := s.Line(key)
+		if err != nil {
+			t.Fatalf("%s: %s\n", tc.key, err.Error())
+		}
+		assert.Equal(t, tc.expect, string(line), tc.key)
+		assert.Equal(t, tc.key, string(key), "search key unmodified")
+	}
+
+	// Mixed-case keys are not found without LowercaseKey
+	s2, err := NewSearcher("testdata/domains1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	_, err = s2.Line([]byte("AccuWeather.com"))
+	assert.Equal(t, ErrNotFound, err)
+}
+
+// Test searching testdata/boundary.csv, whose size (512 bytes) is an
+// exact multiple of the blocksize, so the final block ends exactly at EOF
+func TestSearcherExactBlockBoundary(t *testing.T) {
+	path := "testdata/boundary.csv"
+	idx, err := NewIndexOptions(path, IndexOptions{Blocksize: 128, StrictValidate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 4, len(idx.List))
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSearcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	assert.Equal(t, int64(512), s.l)
+
+	for _, key := range []string{"key00", "key07", "key08", "key24", "key31"} {
+		line, err := s.Line([]byte(key))
+		if err != nil {
+			t.Fatalf("%s: %s\n", key, err.Error())
+		}
+		assert.Equal(t, key+",123456789", string(line), key)
+	}
+
+	// The final block should reach EOF exactly
+	offset, length, err := s.BlockKey([]byte("key31"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(384), offset)
+	assert.Equal(t, s.l, offset+length)
+
+	_, err = s.Line([]byte("key32"))
+	assert.Equal(t, ErrNotFound, err)
+}
+
+// Test Searcher.LinesWithLineNo() with and without index line counts
+func TestSearcherLinesWithLineNo(t *testing.T) {
+	var tests = []struct {
+		dataset string
+		key     string
+	}{
+		{"domains2.csv", "accuweather.com"},
+		{"domains2.csv", "adyen.com"},
+		{"domains2.csv", "indiamart.com"},
+		{"domains2.csv", "zenfolio.com"},
+		{"foo.csv", "bar"},
+		{"foo.csv", "foo"},
+		{"rdns1.csv", "202.047.145.000"},
+	}
+
+	for _, lineCounts := range []bool{false, true} {
+		for _, tc := range tests {
+			path := filepath.Join("testdata", tc.dataset)
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var expect []LineNo
+			for i, line := range strings.Split(string(data), "\n") {
+				if strings.HasPrefix(line, tc.key+",") {
+					expect = append(expect, LineNo{Line: []byte(line), Number: int64(i + 1)})
+				}
+			}
+			if len(expect) == 0 {
+				t.Fatalf("%s: no lines with key %q\n", tc.dataset, tc.key)
+			}
+
+			s, err := NewSearcher(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if lineCounts {
+				s.Index, err = NewIndexOptions(path, IndexOptions{Blocksize: 256, LineCounts: true})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := s.LinesWithLineNo([]byte(tc.key))
+			desc := fmt.Sprintf("%s %s (line counts %v)", tc.dataset, tc.key, lineCounts)
+			if err != nil {
+				t.Fatalf("%s: %s\n", desc, err.Error())
+			}
+			assert.Equal(t, expect, got, desc)
+		}
+	}
+}
+
+// Test the single key Line() path stays within a small allocation budget
+func TestSearcherLineAllocs(t *testing.T) {
+	s, err := NewSearcher("testdata/rdns1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	key := []byte("202.047.145.000")
+
+	allocs := testing.AllocsPerRun(100, func() {
+		_, err := s.Line(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.LessOrEqual(t, allocs, float64(4), "Line() allocations")
+}
+
+// Test NewSearcher() on a dataset updated to include a line longer than
+// the default blocksize, whose index should be regenerated with larger
+// blocksizes
+func TestSearcherLongLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "long.csv")
+	err = ioutil.WriteFile(path, []byte("alpha,1\ngamma,3\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := NewIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Update the dataset (so the index is expired)
+	long := "beta," + strings.Repeat("x", 5000)
+	err = ioutil.WriteFile(path, []byte("alpha,1\n"+long+"\ngamma,3\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Minute)
+	err = os.Chtimes(path, mtime, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Default blocksize fails
+	_, err = NewIndex(path)
+	assert.True(t, errors.Is(err, ErrKeyExceedsBlocksize), "NewIndex returns ErrKeyExceedsBlocksize")
+
+	// MaxBlocksize caps retries
+	_, err = NewSearcherOptions(path, SearcherOptions{MaxBlocksize: 4096})
+	assert.True(t, errors.Is(err, ErrKeyExceedsBlocksize), "MaxBlocksize 4096 returns ErrKeyExceedsBlocksize")
+
+	s, err := NewSearcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	assert.Equal(t, 8192, s.Index.Blocksize)
+	for _, expect := range []string{"alpha,1", long, "gamma,3"} {
+		key := strings.SplitN(expect, ",", 2)[0]
+		line, err := s.Line([]byte(key))
+		assert.Nil(t, err, key)
+		assert.Equal(t, expect, string(line), key)
+	}
+}
+
+// Test Searcher.LinesPrefixSuffix() using testdata/domains1.csv
+func TestSearcherLinesPrefixSuffix(t *testing.T) {
+	var tests = []struct {
+		prefix string
+		suffix string
+		expect []string
+	}{
+		{"a", ".com", []string{"accuweather.com,567", "adparlor.com,637", "adweek.com,305", "adyen.com,524", "angieslist.com,608"}},
+		{"a", ".nl", []string{"autoriteitpersoonsgegevens.nl,397"}},
+		{"ad", "n.com", []string{"adyen.com,524"}},
+		{"adyen.com", "", []string{"adyen.com,524"}},
+		{"", "adyen.com", []string{"adyen.com,524"}},
+		{"a", ".org", nil},
+		{"0", "", nil},
+	}
+
+	s, err := NewSearcher("testdata/domains1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range tests {
+		desc := tc.prefix + "*" + tc.suffix
+		lines, err := s.LinesPrefixSuffix([]byte(tc.prefix), []byte(tc.suffix))
+		if tc.expect == nil {
+			assert.Equal(t, ErrNotFound, err, desc)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s\n", desc, err.Error())
+		}
+		got := []string{}
+		for _, line := range lines {
+			got = append(got, string(line))
+		}
+		assert.Equal(t, tc.expect, got, desc)
+	}
+}
+
+// Test Searcher.LinesBetween() on a multi-block dataset
+func TestSearcherLinesBetween(t *testing.T) {
+	var tests = []struct {
+		lo    string
+		hi    string
+		first string
+		count int
+	}{
+		{"005.", "011.", "005.000", 60},
+		{"007.003", "007.006", "007.003", 3},
+		{"007.003", "007.0035", "007.003", 1},
+		{"", "001.", "000.000", 10},
+		{"019.005", "999", "019.005", 5},
+		{"000.000", "999", "000.000", 200},
+		{"007.", "007.", "", 0},
+		{"011.", "005.", "", 0},
+		{"020.", "030.", "", -1},
+	}
+
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "between.csv")
+	var buf bytes.Buffer
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 10; j++ {
+			fmt.Fprintf(&buf, "%03d.%03d,%d\n", i, j, i*10+j)
+		}
+	}
+	err = ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := NewIndexOptions(path, IndexOptions{Blocksize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, len(idx.List) > 5, "multiple blocks")
+
+	s, err := NewSearcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range tests {
+		desc := "[" + tc.lo + ", " + tc.hi + ")"
+		lines, err := s.LinesBetween([]byte(tc.lo), []byte(tc.hi))
+		if tc.count == -1 {
+			assert.Equal(t, ErrNotFound, err, desc)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s\n", desc, err.Error())
+		}
+		assert.Equal(t, tc.count, len(lines), desc)
+		if tc.count > 0 {
+			assert.Equal(t, tc.first+",", string(lines[0][:len(tc.first)+1]), desc)
+		}
+		for i := 1; i < len(lines); i++ {
+			assert.True(t, bytes.Compare(lines[i-1], lines[i]) < 0, desc)
+		}
+	}
+}
+
+// Test the temporary index generated for datasets without an index, with
+// and without PersistTempIndex
+func TestSearcherPersistTempIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, persist := range []bool{false, true} {
+		path := filepath.Join(dir, fmt.Sprintf("temp_%v.csv", persist))
+		err = ioutil.WriteFile(path, []byte("alpha,1\nbeta,2\ngamma,3\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idxpath, err := IndexPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := NewSearcherOptions(path, SearcherOptions{PersistTempIndex: persist})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		assert.Nil(t, s.Index, "index deferred to first use")
+		_, err = os.Stat(idxpath)
+		assert.True(t, os.IsNotExist(err), "no index file before query")
+
+		line, err := s.Line([]byte("beta"))
+		assert.Nil(t, err)
+		assert.Equal(t, "beta,2", string(line))
+		assert.NotNil(t, s.Index, "temporary index generated")
+
+		_, err = os.Stat(idxpath)
+		if persist {
+			assert.Nil(t, err, "index file written after query")
+			_, err = LoadIndex(path)
+			assert.Nil(t, err, "index file loads")
+		} else {
+			assert.True(t, os.IsNotExist(err), "no index file after query")
+		}
+	}
+}
+
+// Test concurrent first queries on a searcher without an index, which
+// must generate the temporary index once (run with -race)
+func TestSearcherTempIndexConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "concurrent.csv")
+	var buf bytes.Buffer
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&buf, "key%05d,%d\n", i, i)
+	}
+	err = ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSearcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	assert.Nil(t, s.CurrentIndex(), "index deferred to first use")
+
+	start := make(chan struct{})
+	errs := make(chan error, 16)
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			<-start
+			key := fmt.Sprintf("key%05d", g*1000)
+			line, err := s.Line([]byte(key))
+			if err == nil && string(line) != fmt.Sprintf("%s,%d", key, g*1000) {
+				err = fmt.Errorf("%s: unexpected line %q", key, line)
+			}
+			errs <- err
+		}(g)
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+	assert.NotNil(t, s.CurrentIndex(), "temporary index generated")
+}
+
+// Test the temporary index is checked against the filename delimiter
+func TestSearcherTempIndexDelimiter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "temp.csv")
+	err = ioutil.WriteFile(path, []byte("alpha|1\nbeta|2\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSearcherOptions(path, SearcherOptions{Delimiter: []byte("|"), Strict: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, err = s.Line([]byte("beta"))
+	assert.Equal(t, ErrDelimiterMismatch, err)
+	assert.Nil(t, s.CurrentIndex())
+}
+
+func TestSearcherLookupBySortKey(t *testing.T) {
+	var tests = []struct {
+		sk     string
+		expect []string
+		err    error
+	}{
+		{"apple", []string{"Apple,apple,1", "apple,apple,2"}, nil},
+		{"cafe", []string{"Café,cafe,4", "cafe,cafe,5"}, nil},
+		{"eclair", []string{"Éclair,eclair,6"}, nil},
+		{"zoe", []string{"Zoë,zoe,8"}, nil},
+		{"banan", nil, ErrNotFound},
+		{"dog", nil, ErrNotFound},
+	}
+
+	s, err := NewSearcherOptions("testdata/sortkey.csv", SearcherOptions{
+		Header:        true,
+		SortKeyColumn: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range tests {
+		lines, err := s.LookupBySortKey([]byte(tc.sk))
+		if tc.err != nil {
+			assert.ErrorIs(t, err, tc.err, tc.sk)
+			continue
+		}
+		assert.Nil(t, err, tc.sk)
+		got := make([]string, len(lines))
+		for i, line := range lines {
+			got[i] = string(line)
+		}
+		assert.Equal(t, tc.expect, got, tc.sk)
+	}
+	assert.Equal(t, 1, s.Index.SortKeyColumn)
+	assert.Equal(t, "apple", s.Index.List[0].Key)
+
+	// Searchers without a sort key column
+	s2, err := NewSearcher("testdata/foo.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	_, err = s2.LookupBySortKey([]byte("apple"))
+	assert.ErrorIs(t, err, ErrNoSortKeyColumn)
+}
+
+func TestSearcherCacheLastResult(t *testing.T) {
+	for _, cache := range []bool{false, true} {
+		s, err := NewSearcherOptions("testdata/rdns1.csv", SearcherOptions{CacheLastResult: cache})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key := []byte("001.034.164.000")
+		lines, err := s.LinesN(key, 1)
+		assert.Nil(t, err)
+		// Cached results are returned as-is, without rescanning
+		lines2, err := s.LinesN(key, 1)
+		assert.Nil(t, err)
+		assert.Equal(t, lines, lines2)
+		assert.Equal(t, cache, &lines[0][0] == &lines2[0][0], "cache %v", cache)
+
+		// Different key or n invalidates the cache
+		_, err = s.LinesN([]byte("202.047.145.000"), 1)
+		assert.Nil(t, err)
+		lines3, err := s.LinesN(key, 1)
+		assert.Nil(t, err)
+		assert.Equal(t, lines, lines3)
+		assert.False(t, &lines2[0][0] == &lines3[0][0], "cache %v", cache)
+
+		// Failed queries are not cached
+		_, err = s.LinesN([]byte("999"), 1)
+		assert.Equal(t, ErrNotFound, err)
+		_, err = s.LinesN([]byte("999"), 1)
+		assert.Equal(t, ErrNotFound, err)
+		s.Close()
+	}
+}
+
+// Test Searcher.ValuePrefix() using testdata/longvalues.csv, whose
+// values are longer than the default blocksize
+func TestSearcherValuePrefix(t *testing.T) {
+	var tests = []struct {
+		key    string
+		max    int
+		expect string
+	}{
+		{"alpha", 0, ""},
+		{"alpha", 10, "nktfVCONOK"},
+		{"beta", 20, "PTGAHUZ7fKUm9ywqiTFK"},
+		{"gamma", 5, "L26Mr"},
+	}
+
+	s, err := NewSearcher("testdata/longvalues.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range tests {
+		value, err := s.ValuePrefix([]byte(tc.key), tc.max)
+		assert.Nil(t, err, tc.key)
+		assert.Equal(t, tc.expect, string(value), tc.key)
+	}
+
+	// Whole values
+	line, err := s.Line([]byte("beta"))
+	assert.Nil(t, err)
+	value, err := s.ValuePrefix([]byte("beta"), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, string(line[len("beta,"):]), string(value))
+	assert.True(t, len(value) > defaultBlocksize)
+
+	_, err = s.ValuePrefix([]byte("delta"), 10)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+// Test Searcher.LineValue() using testdata/rdns1.csv
+func TestSearcherLineValue(t *testing.T) {
+	s, err := NewSearcher("testdata/rdns1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	value, err := s.LineValue([]byte("001.034.164.000"))
+	assert.Nil(t, err)
+	assert.Equal(t, "1-34-164-0.HINET-IP.hinet.net,202003,hinet.net", string(value))
+
+	_, err = s.LineValue([]byte("000.000.000.000"))
+	assert.Equal(t, ErrNotFound, err)
+}
+
+// Test Searcher.Has() against Searcher.Line()
+func TestSearcherHas(t *testing.T) {
+	var tests = []struct {
+		filename string
+		key      string
+		expect   bool
+	}{
+		{"foo.csv", "bar", true},
+		{"foo.csv", "foo", true},
+		{"foo.csv", "fo", false},
+		{"foo.csv", "baz", false},
+		{"foo.csv", "zzz", false},
+		{"longvalues.csv", "beta", true},
+		{"longvalues.csv", "delta", false},
+	}
+
+	for _, tc := range tests {
+		s, err := NewSearcher(filepath.Join("testdata", tc.filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		has, err := s.Has([]byte(tc.key))
+		assert.Nil(t, err, tc.key)
+		assert.Equal(t, tc.expect, has, tc.key)
+
+		_, err = s.Line([]byte(tc.key))
+		assert.Equal(t, tc.expect, err == nil, tc.key)
+		s.Close()
+	}
+}
+
+// Test Searcher.LinesReverse() against Searcher.Lines(), including for
+// keys whose matches span multiple blocks
+func TestSearcherLinesReverse(t *testing.T) {
+	var tests = []struct {
+		key   string
+		count int
+	}{
+		{"alpha", 1},
+		{"bravo", 5},
+		{"mike", 200},
+		{"zulu", 3},
+	}
+
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "reverse.csv")
+	var buf bytes.Buffer
+	for _, tc := range tests {
+		for i := 0; i < tc.count; i++ {
+			fmt.Fprintf(&buf, "%s,%03d\n", tc.key, i)
+		}
+	}
+	err = ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := NewIndexOptions(path, IndexOptions{Blocksize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSearcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	assert.True(t, len(s.Index.List) > 1, "multiple blocks")
+
+	for _, tc := range tests {
+		lines, err := s.Lines([]byte(tc.key))
+		assert.Nil(t, err, tc.key)
+		reverse, err := s.LinesReverse([]byte(tc.key))
+		assert.Nil(t, err, tc.key)
+		assert.Equal(t, tc.count, len(reverse), tc.key)
+		for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+			lines[i], lines[j] = lines[j], lines[i]
+		}
+		assert.Equal(t, lines, reverse, tc.key)
+	}
+
+	for _, key := range []string{"a", "charlie", "mik", "zz"} {
+		_, err = s.LinesReverse([]byte(key))
+		assert.Equal(t, ErrNotFound, err, key)
+	}
+}
+
+// Test Searcher.LastLine(), including for keys whose matches span
+// multiple blocks
+func TestSearcherLastLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "last.csv")
+	var buf bytes.Buffer
+	for _, key := range []string{"alpha", "bravo", "mike"} {
+		for i := 0; i < 40; i++ {
+			fmt.Fprintf(&buf, "%s,%03d\n", key, i)
+		}
+	}
+	err = ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := NewIndexOptions(path, IndexOptions{Blocksize: 128})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSearcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	assert.True(t, len(s.Index.List) > 1, "multiple blocks")
+
+	for _, key := range []string{"alpha", "bravo", "mike"} {
+		line, err := s.LastLine([]byte(key))
+		assert.Nil(t, err, key)
+		assert.Equal(t, key+",039", string(line), key)
+	}
+	for _, key := range []string{"a", "charlie", "mik", "zz"} {
+		_, err = s.LastLine([]byte(key))
+		assert.Equal(t, ErrNotFound, err, key)
+	}
+}
+
+// Test NewSearcherFile() uses, but does not close, the caller's file
+func TestSearcherNewFile(t *testing.T) {
+	ensureIndex(t, "rdns1.csv")
+	fh, err := os.Open("testdata/rdns1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+
+	s, err := NewSearcherFile(fh, SearcherOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := s.Line([]byte("001.000.128.000"))
+	assert.Nil(t, err)
+	assert.Equal(t, "001.000.128.000,node-0.pool-1-0.dynamic.totinternet.net,202003,totinternet.net", string(line))
+	s.Close()
+
+	// The file handle remains open after Close
+	_, err = fh.Stat()
+	assert.Nil(t, err)
+	buf := make([]byte, 3)
+	_, err = fh.ReadAt(buf, 0)
+	assert.Nil(t, err)
+}
+
+// closeRecorder is an io.ReaderAt recording whether it has been closed
+type closeRecorder struct {
+	*bytes.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+// Test NewSearcherReader(), with generated and attached indexes
+func TestSearcherNewReader(t *testing.T) {
+	var tests = []struct {
+		key    string
+		expect string
+	}{
+		{"001.000.128.000", "001.000.128.000,node-0.pool-1-0.dynamic.totinternet.net,202003,totinternet.net"},
+		{"001.034.164.000", "001.034.164.000,1-34-164-0.HINET-IP.hinet.net,202003,hinet.net"},
+	}
+
+	ensureIndex(t, "rdns1.csv")
+	data, err := ioutil.ReadFile("testdata/rdns1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := LoadIndex("testdata/rdns1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opt := range []SearcherOptions{
+		{Delimiter: []byte(",")},
+		{Index: idx},
+	} {
+		r := &closeRecorder{Reader: bytes.NewReader(data)}
+		s, err := NewSearcherReader(r, int64(len(data)), opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tc := range tests {
+			line, err := s.Line([]byte(tc.key))
+			assert.Nil(t, err, tc.key)
+			assert.Equal(t, tc.expect, string(line), tc.key)
+		}
+		_, err = s.Line([]byte("000"))
+		assert.Equal(t, ErrNotFound, err)
+		assert.Equal(t, ErrNoFilepath, s.Reopen())
+		s.Close()
+		assert.True(t, r.closed)
+	}
+
+	// Readers that are not io.Closers
+	s, err := NewSearcherReader(bytes.NewReader(data), int64(len(data)),
+		SearcherOptions{Delimiter: []byte(",")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := s.Line([]byte(tests[0].key))
+	assert.Nil(t, err)
+	assert.Equal(t, tests[0].expect, string(line))
+	s.Close()
+
+	// No delimiter and no index
+	s, err = NewSearcherReader(bytes.NewReader(data), int64(len(data)), SearcherOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Line([]byte(tests[0].key))
+	assert.Equal(t, ErrUnknownDelimiter, err)
+	s.Close()
+
+	// Short reads
+	_, err = NewSearcherReader(bytes.NewReader(data), int64(len(data))+1, SearcherOptions{})
+	assert.NotNil(t, err)
+
+	// Options applied to the index leave the caller's index unchanged
+	s, err = NewSearcherReader(bytes.NewReader(data), int64(len(data)),
+		SearcherOptions{Index: idx, Compare: bytes.Compare})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err = s.Line([]byte(tests[1].key))
+	assert.Nil(t, err)
+	assert.Equal(t, tests[1].expect, string(line))
+	assert.True(t, idx.compare == nil, "caller's index compare unset")
+	assert.True(t, s.Index.compare != nil, "searcher index compare set")
+	s.Close()
+}
+
+// Test searching testdata/emptykey.csv, with leading empty-key lines
+func TestSearcherEmptyKey(t *testing.T) {
+	var tests = []struct {
+		key    string
+		expect []string
+	}{
+		// The empty key matches only lines with an empty key field
+		{"", []string{",empty01", ",empty02", ",empty03", ",empty04", ",empty05", ",empty06"}},
+		{"alpha", []string{"alpha,1"}},
+		{"beta", []string{"beta,2", "beta,3"}},
+		{"gamma", []string{"gamma,4"}},
+	}
+
+	data, err := ioutil.ReadFile("testdata/emptykey.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "emptykey.csv")
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Use a small blocksize so the empty-key lines span several blocks
+	idx, err := NewIndexOptions(path, IndexOptions{Blocksize: 16, StrictValidate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "", idx.List[0].Key)
+	assert.Equal(t, int64(0), idx.List[0].Offset)
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSearcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, tc := range tests {
+		lines, err := s.Lines([]byte(tc.key))
+		assert.Nil(t, err, tc.key)
+		got := make([]string, len(lines))
+		for i, line := range lines {
+			got[i] = string(line)
+		}
+		assert.Equal(t, tc.expect, got, tc.key)
+
+		line, err := s.Line([]byte(tc.key))
+		assert.Nil(t, err, tc.key)
+		assert.Equal(t, tc.expect[0], string(line), tc.key)
+	}
+}
+
+// Test Searcher.MatchSection() returns the byte range of matching lines
+func TestSearcherMatchSection(t *testing.T) {
+	ensureIndex(t, "foo.csv")
+	s, err := NewSearcher("testdata/foo.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, key := range []string{"bar", "foo"} {
+		lines, err := s.Lines([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := append(bytes.Join(lines, []byte("\n")), '\n')
+
+		sr, length, err := s.MatchSection([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, int64(len(expect)), length, key)
+		assert.Equal(t, length, sr.Size(), key)
+		data, err := ioutil.ReadAll(sr)
+		assert.Nil(t, err, key)
+		assert.Equal(t, string(expect), string(data), key)
+	}
+
+	_, _, err = s.MatchSection([]byte("baz"))
+	assert.Equal(t, ErrNotFound, err)
+}
+
+// Test SearcherOptions.FullKeyMatch with fixed-length hash keys, with and
+// without the option. Prefix matching already requires the delimiter after
+// the key, so the results are the same either way.
+func TestSearcherFullKeyMatch(t *testing.T) {
+	var tests = []struct {
+		key    string
+		expect string
+	}{
+		{"317d411a", "317d411a,hotkey.net,4"},
+		{"84afaefb", "84afaefb,golang.org,10"},
+		// Shorter keys (which prefixCompare treats as equal) and longer
+		// keys do not match
+		{"317d411", ""},
+		{"317d411a0", ""},
+		// Keys spanning the delimiter neither equal a key field nor match
+		// as a prefix (which compares the line only up to its delimiter)
+		{"317d411a,hotkey.net", ""},
+		{"317d411a,", ""},
+	}
+
+	ensureIndex(t, "hashed.csv")
+	for _, fullKey := range []bool{false, true} {
+		s, err := NewSearcherOptions("testdata/hashed.csv", SearcherOptions{FullKeyMatch: fullKey})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, fullKey, s.fullKeyCompare())
+
+		for _, tc := range tests {
+			desc := fmt.Sprintf("%s fullKey %v", tc.key, fullKey)
+			line, err := s.Line([]byte(tc.key))
+			if tc.expect == "" {
+				assert.Equal(t, ErrNotFound, err, desc)
+			} else {
+				assert.Nil(t, err, desc)
+			}
+			assert.Equal(t, tc.expect, string(line), desc)
+			count, err := s.Count([]byte(tc.key))
+			assert.Nil(t, err, desc)
+			assert.Equal(t, len(tc.expect) > 0, count == 1, desc)
+		}
+		s.Close()
+	}
+}
+
+// Test Searcher.Close() defers closing and unmapping until in-flight
+// iterators complete
+func TestSearcherCloseInFlight(t *testing.T) {
+	ensureIndex(t, "foo.csv")
+	s, err := NewSearcher("testdata/foo.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, s.mapped)
+	expect, err := s.Lines([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := s.LinesIter([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	var lines [][]byte
+	for it.Next() {
+		lines = append(lines, clonebs(it.Bytes()))
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, expect, lines)
+
+	data, err := ioutil.ReadFile("testdata/foo.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &closeRecorder{Reader: bytes.NewReader(data)}
+	s, err = NewSearcherReader(r, int64(len(data)), SearcherOptions{Delimiter: []byte(",")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, s.mapped)
+	it, err = s.LinesIter([]byte("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	assert.False(t, r.closed)
+	assert.True(t, it.Next())
+	it.Close()
+	assert.True(t, r.closed)
+}
+
+// Test Searcher.Glob() on testdata/domains1.csv
+func TestSearcherGlob(t *testing.T) {
+	var tests = []struct {
+		pattern string
+		expect  []string
+	}{
+		{"ad*", []string{"adparlor.com,637", "adweek.com,305", "adyen.com,524"}},
+		{"ad*k.com", []string{"adweek.com,305"}},
+		{"ad?e*", []string{"adweek.com,305", "adyen.com,524"}},
+		{"a[cn]*.com", []string{"accuweather.com,567", "angieslist.com,608"}},
+		{"adyen.com", []string{"adyen.com,524"}},
+		// Leading wildcards scan the whole dataset
+		{"???.com", []string{"moz.com,563", "ted.com,475"}},
+		{"ad*z.com", nil},
+		{"zz*", nil},
+	}
+
+	ensureIndex(t, "domains1.csv")
+	s, err := NewSearcher("testdata/domains1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range tests {
+		lines, err := s.Glob([]byte(tc.pattern))
+		if tc.expect == nil {
+			assert.Equal(t, ErrNotFound, err, tc.pattern)
+			continue
+		}
+		assert.Nil(t, err, tc.pattern)
+		got := make([]string, len(lines))
+		for i, line := range lines {
+			got[i] = string(line)
+		}
+		assert.Equal(t, tc.expect, got, tc.pattern)
+	}
+
+	_, err = s.Glob([]byte("ad[*"))
+	assert.Equal(t, path.ErrBadPattern, err)
+}
+
+// Test Searcher.MatchSize() against the lengths of the matching lines,
+// using a small blocksize so that matches span several blocks
+func TestSearcherMatchSize(t *testing.T) {
+	var tests = []struct {
+		key   string
+		count int
+	}{
+		{"alpha", 1},
+		{"bravo", 5},
+		{"mike", 200},
+		{"zulu", 3},
+	}
+
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "size.csv")
+	var buf bytes.Buffer
+	for _, tc := range tests {
+		for i := 0; i < tc.count; i++ {
+			fmt.Fprintf(&buf, "%s,%03d\n", tc.key, i)
+		}
+	}
+	err = ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := NewIndexOptions(path, IndexOptions{Blocksize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSearcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range tests {
+		lines, err := s.Lines([]byte(tc.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.count, len(lines), tc.key)
+		var expect int64
+		for _, line := range lines {
+			expect += int64(len(line)) + 1
+		}
+		size, err := s.MatchSize([]byte(tc.key))
+		assert.Nil(t, err, tc.key)
+		assert.Equal(t, expect, size, tc.key)
+	}
+
+	for _, key := range []string{"aaa", "charlie", "zzz"} {
+		_, err = s.MatchSize([]byte(key))
+		assert.Equal(t, ErrNotFound, err, key)
+	}
+}
+
+// Test Searcher.Count() against Searcher.Lines()
+func TestSearcherCount(t *testing.T) {
+	var tests = []struct {
+		filename string
+		key      string
+		expect   int
+	}{
+		{"foo.csv", "foo", 9999},
+		{"foo.csv", "bar", 1},
+		{"foo.csv", "fo", 0},
+		{"foo.csv", "aaa", 0},
+		{"alstom3.csv", "alstom.com", 438},
+		{"alstom3.csv", "alstom.ca", 1},
+	}
+
+	for _, tc := range tests {
+		desc := tc.filename + " " + tc.key
+		s, err := NewSearcherOptions(filepath.Join("testdata", tc.filename),
+			SearcherOptions{Header: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		count, err := s.Count([]byte(tc.key))
+		assert.Nil(t, err, desc)
+		assert.Equal(t, tc.expect, count, desc)
+
+		lines, _ := s.Lines([]byte(tc.key))
+		assert.Equal(t, len(lines), count, desc)
+		s.Close()
+	}
+}
+
+// Test Searcher.Lines() on a descending dataset against the equivalent
+// ascending dataset
+func TestSearcherDescending(t *testing.T) {
+	var tests = []struct {
+		key   string
+		count int
+	}{
+		{"key000", 1},
+		{"key017", 3},
+		{"key030", 1},
+		{"key059", 3},
+		{"key001", 0},
+		{"key060", 0},
+		{"aaa", 0},
+		{"zzz", 0},
+	}
+
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var lines []string
+	for i := 0; i < 60; i++ {
+		if i%3 == 1 {
+			continue
+		}
+		n := 1
+		if i%3 == 2 {
+			n = 3
+		}
+		for j := 0; j < n; j++ {
+			lines = append(lines, fmt.Sprintf("key%03d,%d", i, j))
+		}
+	}
+	ascPath := filepath.Join(dir, "asc.csv")
+	err = ioutil.WriteFile(ascPath, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(lines)))
+	descPath := filepath.Join(dir, "desc.csv")
+	err = ioutil.WriteFile(descPath, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Indexing a descending dataset requires Descending
+	_, err = NewIndexOptions(descPath, IndexOptions{Blocksize: 64})
+	assert.NotNil(t, err)
+	idx, err := NewIndexOptions(descPath, IndexOptions{Blocksize: 64, Descending: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, len(idx.List) > 5, "multiple blocks")
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err = LoadIndex(descPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, idx.Descending)
+
+	asc, err := NewSearcher(ascPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer asc.Close()
+	desc, err := NewSearcherOptions(descPath, SearcherOptions{Descending: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer desc.Close()
+
+	for _, tc := range tests {
+		expect, err := asc.Lines([]byte(tc.key))
+		if tc.count == 0 {
+			assert.Equal(t, ErrNotFound, err, tc.key)
+		} else {
+			assert.Nil(t, err, tc.key)
+		}
+		got, err := desc.Lines([]byte(tc.key))
+		if tc.count == 0 {
+			assert.Equal(t, ErrNotFound, err, tc.key)
+			continue
+		}
+		assert.Nil(t, err, tc.key)
+		assert.Equal(t, tc.count, len(got), tc.key)
+		// Lines are returned in dataset order, so reversed for duplicates
+		for i, j := 0, len(got)-1; i < j; i, j = i+1, j-1 {
+			got[i], got[j] = got[j], got[i]
+		}
+		assert.Equal(t, expect, got, tc.key)
+	}
+}
+
+// Test Searcher.AssertValue() using testdata/domains1.csv
+func TestSearcherAssertValue(t *testing.T) {
+	var tests = []struct {
+		key      string
+		field    int
+		expected string
+		err      error
+	}{
+		{"accuweather.com", 1, "567", nil},
+		{"accuweather.com", 0, "accuweather.com", nil},
+		{"accuweather.com", -1, "567", nil},
+		{"accuweather.com", 1, "568", ErrValueMismatch},
+		{"accuweather.com", 2, "567", ErrValueMismatch},
+		{"zzz.com", 1, "567", ErrNotFound},
+	}
+
+	ensureIndex(t, "domains1.csv")
+	s, err := NewSearcher("testdata/domains1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tc := range tests {
+		desc := fmt.Sprintf("%s field %d", tc.key, tc.field)
+		err := s.AssertValue([]byte(tc.key), tc.field, []byte(tc.expected))
+		if tc.err == nil {
+			assert.Nil(t, err, desc)
+		} else {
+			assert.True(t, errors.Is(err, tc.err), desc+" error")
+		}
+	}
+
+	// Quoted fields containing the delimiter, with CSVQuoting
+	s2, err := NewSearcherOptions("testdata/quoted.csv", SearcherOptions{
+		Header:     true,
+		CSVQuoting: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	assert.Nil(t, s2.AssertValue([]byte("alpha"), 1, []byte("Smith, John")))
+	assert.Nil(t, s2.AssertValue([]byte("alpha"), -1, []byte(`said "hi"`)))
+	err = s2.AssertValue([]byte("alpha"), 2, []byte(" John\""))
+	assert.True(t, errors.Is(err, ErrValueMismatch), "quoted field mismatch")
+}
+
+// Test SearcherOptions.VerifySorted reports unsorted lines in the block
+// a lookup begins in
+func TestSearcherVerifySorted(t *testing.T) {
+	ensureIndex(t, "rdns1.csv")
+	data, err := ioutil.ReadFile("testdata/rdns1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := LoadIndex("testdata/rdns1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.List) < 4 {
+		t.Fatalf("expected at least 4 index entries, got %d\n", len(idx.List))
+	}
+
+	// Swap the second and third lines, leaving later offsets unchanged
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	lines[1], lines[2] = lines[2], lines[1]
+	data = bytes.Join(lines, nil)
+
+	first := []byte("001.000.128.000")
+	other := []byte(idx.List[3].Key)
+	for _, verify := range []bool{false, true} {
+		s, err := NewSearcherReader(bytes.NewReader(data), int64(len(data)),
+			SearcherOptions{Index: idx, VerifySorted: verify})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Line(first)
+		if verify {
+			assert.True(t, errors.Is(err, ErrUnsorted), "verify: %v", err)
+		} else {
+			assert.Nil(t, err)
+		}
+		_, err = s.Line(other)
+		assert.Nil(t, err, "verify %v", verify)
+		s.Close()
+	}
+}
+
+// Test lookups do not modify the spare capacity of the caller's key
+func TestSearcherKeySpareCapacity(t *testing.T) {
+	s, err := NewSearcher("testdata/rdns1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	db, err := NewDB("testdata/rdns1.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	buf := []byte("032.176.184.000XXXX")
+	key := buf[:len("032.176.184.000")]
+	lines, err := s.Lines(key)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, len(lines))
+	assert.Equal(t, "032.176.184.000XXXX", string(buf))
+
+	_, err = db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, "032.176.184.000XXXX", string(buf))
+}
@@ -0,0 +1,227 @@
+/*
+bsearch secondary index functions, for lookups on columns other than the
+primary (sorted) key column
+*/
+
+package bsearch
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+)
+
+var (
+	ErrNoSecondaryIndex       = errors.New("no secondary index attached for column")
+	ErrSecondaryIndexDetached = errors.New("secondary index detached by Reopen for column")
+)
+
+// lineField returns the column'th field (0-based) of line, split on delim.
+// If column is negative it counts back from the last field (i.e. -1 is the
+// last field). Returns false if line has no such field.
+func lineField(line, delim []byte, column int) ([]byte, bool) {
+	fields := bytes.Split(line, delim)
+	if column < 0 {
+		column += len(fields)
+	}
+	if column < 0 || column >= len(fields) {
+		return nil, false
+	}
+	return fields[column], true
+}
+
+type secondaryEntry struct {
+	key    []byte
+	offset int64
+}
+
+// WriteSecondaryIndex writes a secondary index for column of the searcher
+// dataset to idxPath. The secondary index is itself a dataset, sorted
+// bytewise on the column values, mapping each value to the offsets of the
+// primary dataset lines containing it (using the primary delimiter), and
+// has its own bsearch index. Column is 0-based, and may be negative to
+// count back from the last field (i.e. -1 is the last field). Lines
+// without the given column are skipped.
+func (s *Searcher) WriteSecondaryIndex(column int, idxPath string) error {
+	s = s.acquire()
+	defer s.release()
+	if err := s.requireIndex(); err != nil {
+		return err
+	}
+	if err := s.requireLineFramer(); err != nil {
+		return err
+	}
+	delim := s.Index.Delimiter
+
+	var entries []secondaryEntry
+	offset := 0
+	if s.Index.Header {
+		if nlidx := bytes.IndexByte(s.mmap, '\n'); nlidx > -1 {
+			offset = nlidx + 1
+		} else {
+			offset = len(s.mmap)
+		}
+	}
+	for offset < len(s.mmap) {
+		nlidx := bytes.IndexByte(s.mmap[offset:], '\n')
+		if nlidx == -1 {
+			nlidx = len(s.mmap) - offset
+		}
+		line := s.mmap[offset : offset+nlidx]
+		if key, ok := lineField(line, delim, column); ok && len(key) > 0 {
+			entries = append(entries, secondaryEntry{key: key, offset: int64(offset)})
+		}
+		offset += nlidx + 1
+	}
+	if len(entries) == 0 {
+		return ErrIndexEmpty
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+
+	fh, err := os.OpenFile(idxPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	w := bufio.NewWriter(fh)
+	for _, entry := range entries {
+		w.Write(entry.key)
+		w.Write(delim)
+		w.WriteString(strconv.FormatInt(entry.offset, 10))
+		w.WriteByte('\n')
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	err = fh.Close()
+	if err != nil {
+		return err
+	}
+
+	// Generate and write a bsearch index for the secondary index dataset
+	index, err := NewIndexOptions(idxPath, IndexOptions{Delimiter: delim})
+	if err != nil {
+		return err
+	}
+	return index.Write()
+}
+
+// AttachSecondaryIndex attaches the secondary index at idxPath (as written
+// by WriteSecondaryIndex) for column, for use with LinesBySecondary. Note
+// that the secondary index must be sorted bytewise on the column values
+// (as WriteSecondaryIndex does), and must be regenerated whenever the
+// primary dataset changes, since it records primary dataset offsets
+// (Reopen closes and detaches any secondary indexes for this reason, and
+// they must be re-attached after regenerating them).
+// AttachSecondaryIndex is safe for concurrent use with LinesBySecondary:
+// a replaced secondary index is closed once in-flight lookups using it
+// complete.
+func (s *Searcher) AttachSecondaryIndex(column int, idxPath string) error {
+	s = s.acquire()
+	defer s.release()
+	if err := s.requireIndex(); err != nil {
+		return err
+	}
+	ss, err := NewSearcherOptions(idxPath, SearcherOptions{
+		Delimiter: s.Index.Delimiter,
+		Logger:    s.logger,
+	})
+	if err != nil {
+		return err
+	}
+	s.secondaryMu.Lock()
+	if s.secondary == nil {
+		s.secondary = make(map[int]*Searcher)
+	}
+	prev, ok := s.secondary[column]
+	s.secondary[column] = ss
+	s.secondaryMu.Unlock()
+	if ok {
+		// Lookups hold a reference on prev, so it is unmapped once they
+		// complete
+		prev.Close()
+	}
+	return nil
+}
+
+// detachedColumns returns the columns with secondary indexes attached to
+// snapshot s, or detached from it by an earlier Reopen and not since
+// re-attached, i.e. those a reopened snapshot detaches
+func (s *Searcher) detachedColumns() map[int]bool {
+	s.secondaryMu.RLock()
+	defer s.secondaryMu.RUnlock()
+	if len(s.secondary) == 0 && len(s.detached) == 0 {
+		return nil
+	}
+	detached := make(map[int]bool)
+	for column := range s.detached {
+		detached[column] = true
+	}
+	for column := range s.secondary {
+		detached[column] = true
+	}
+	return detached
+}
+
+// LinesBySecondary returns all lines in the dataset whose column field
+// equals key, using the secondary index attached for column, in dataset
+// order. Returns ErrNoSecondaryIndex if no secondary index is attached
+// for column (or ErrSecondaryIndexDetached if one was, but Reopen has
+// since detached it), and ErrNotFound if there are no matching lines.
+func (s *Searcher) LinesBySecondary(column int, key []byte) ([][]byte, error) {
+	s = s.acquire()
+	defer s.release()
+	// Hold a reference on the secondary searcher, so that it is not
+	// unmapped if it is replaced during the lookup
+	s.secondaryMu.RLock()
+	ss, ok := s.secondary[column]
+	if ok {
+		ss = ss.acquire()
+	}
+	s.secondaryMu.RUnlock()
+	if !ok {
+		if s.detached[column] {
+			return nil, fmt.Errorf("%w %d", ErrSecondaryIndexDetached, column)
+		}
+		return nil, fmt.Errorf("%w %d", ErrNoSecondaryIndex, column)
+	}
+	defer ss.release()
+	if err := s.requireIndex(); err != nil {
+		return nil, err
+	}
+	if err := s.requireLineFramer(); err != nil {
+		return nil, err
+	}
+	entries, err := ss.Lines(key)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		field, _ := lineField(entry, ss.Index.Delimiter, -1)
+		offset, err := strconv.ParseInt(string(field), 10, 64)
+		if err != nil || offset < 0 || offset >= s.l {
+			return nil, fmt.Errorf("%w: bad secondary index entry %q", ErrIndexCorrupt, entry)
+		}
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	lines := make([][]byte, 0, len(offsets))
+	for _, offset := range offsets {
+		line := s.mmap[offset:]
+		if nlidx := bytes.IndexByte(line, '\n'); nlidx > -1 {
+			line = line[:nlidx]
+		}
+		lines = append(lines, clonebs(line))
+	}
+	return lines, nil
+}
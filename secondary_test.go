@@ -0,0 +1,195 @@
+package bsearch
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test WriteSecondaryIndex(), AttachSecondaryIndex() and LinesBySecondary()
+func TestSearcherLinesBySecondary(t *testing.T) {
+	var tests = []struct {
+		column int
+		key    string
+		expect []string
+	}{
+		{-1, "uk", []string{"alice,london,uk", "carol,leeds,uk", "frank,london,uk"}},
+		{-1, "fr", []string{"bob,paris,fr", "dave,lyon,fr"}},
+		{-1, "it", []string{"eve,rome,it"}},
+		{-1, "de", nil},
+		{1, "london", []string{"alice,london,uk", "frank,london,uk"}},
+		{1, "lyon", []string{"dave,lyon,fr"}},
+		{1, "uk", nil},
+	}
+
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "people.csv")
+	data := "name,city,country\nalice,london,uk\nbob,paris,fr\ncarol,leeds,uk\n" +
+		"dave,lyon,fr\neve,rome,it\nfrank,london,uk\n"
+	err = ioutil.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := NewIndexOptions(path, IndexOptions{Header: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSearcherOptions(path, SearcherOptions{Header: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	_, err = s.LinesBySecondary(-1, []byte("uk"))
+	assert.True(t, errors.Is(err, ErrNoSecondaryIndex), "no secondary index attached")
+
+	for _, column := range []int{-1, 1} {
+		idxPath := filepath.Join(dir, fmt.Sprintf("people_col%d.csv", column))
+		err = s.WriteSecondaryIndex(column, idxPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.AttachSecondaryIndex(column, idxPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range tests {
+		lines, err := s.LinesBySecondary(tc.column, []byte(tc.key))
+		if tc.expect == nil {
+			assert.Equal(t, ErrNotFound, err, tc.key)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s\n", tc.key, err.Error())
+		}
+		got := []string{}
+		for _, line := range lines {
+			got = append(got, string(line))
+		}
+		assert.Equal(t, tc.expect, got, tc.key)
+	}
+
+	// Reopen detaches the secondary indexes, which must be regenerated
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, []byte(data+"gina,rome,it\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err = NewIndexOptions(path, IndexOptions{Header: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Reopen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.LinesBySecondary(-1, []byte("it"))
+	assert.True(t, errors.Is(err, ErrSecondaryIndexDetached), "detached by Reopen: %v", err)
+	_, err = s.LinesBySecondary(0, []byte("eve"))
+	assert.True(t, errors.Is(err, ErrNoSecondaryIndex), "never attached: %v", err)
+
+	idxPath := filepath.Join(dir, "people_col-1.csv")
+	err = s.WriteSecondaryIndex(-1, idxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.AttachSecondaryIndex(-1, idxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines, err := s.LinesBySecondary(-1, []byte("it"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("eve,rome,it"), []byte("gina,rome,it")}, lines)
+}
+
+// Test re-attaching a secondary index while lookups are in flight (run
+// with -race)
+func TestSearcherAttachSecondaryConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "people.csv")
+	data := "alice,london,uk\nbob,paris,fr\ncarol,leeds,uk\n"
+	err = ioutil.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSearcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	idxPath := filepath.Join(dir, "people_country.csv")
+	err = s.WriteSecondaryIndex(-1, idxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.AttachSecondaryIndex(-1, idxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					errs <- nil
+					return
+				default:
+				}
+				lines, err := s.LinesBySecondary(-1, []byte("uk"))
+				if err == nil && len(lines) != 2 {
+					err = fmt.Errorf("expected 2 lines, got %q", lines)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		err = s.AttachSecondaryIndex(-1, idxPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+}